@@ -1,13 +1,16 @@
-module speedyvault
-
-go 1.25.5
-
-require (
-	github.com/andybalholm/brotli v1.2.0 // indirect
-	github.com/klauspost/compress v1.18.3 // indirect
-	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
-	github.com/mattn/go-sqlite3 v1.14.33 // indirect
-	github.com/valyala/bytebufferpool v1.0.0 // indirect
-	github.com/valyala/fasthttp v1.69.0 // indirect
-	github.com/zeebo/blake3 v0.2.4 // indirect
-)
+module speedyvault
+
+go 1.25.5
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.33
+	github.com/valyala/fasthttp v1.69.0
+	github.com/zeebo/blake3 v0.2.4
+)
+
+require (
+	github.com/andybalholm/brotli v1.2.0 // indirect
+	github.com/klauspost/compress v1.18.3 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+)
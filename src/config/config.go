@@ -1,42 +1,316 @@
 package config
 
-/* TODO: convert this to a loadable JSON config */
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
 
+// The config can be loaded from a JSON file using the field names in the tags below, and every field can be overridden
+// through an environment variable of the same name in upper case prefixed with 'SV_' (e.g. 'SV_DATA_DIRECTORY').
 type AppConfigType struct {
+	// Adjusts behaviour depending on the type of build (e.g. database enters memory mode and is seeded with test rows in debug).
+	DebugMode bool `json:"debug_mode"`
+
 	// The interface and port to listen on.
-	ListenInterfacePort string
+	ListenInterfacePort string `json:"listen_interface_port"`
 
 	// Only use when Nginx (or another compatible reverse proxy) is in front of the backend.
 	// Requires some additional Nginx config, but will improve file upload/download performance substantially
 	// by offloading upload/download onto Nginx rather than having Nginx proxy everything in-between.
-	UseNginxStreaming bool
+	UseNginxStreaming bool `json:"use_nginx_streaming"`
+
+	// Only applies when 'UseNginxStreaming' is enabled.
+	// The internal Nginx location which maps onto the data directory, downloads are handed over to Nginx through 'X-Accel-Redirect' to a path within it.
+	NginxInternalLocation string `json:"nginx_internal_location"`
+
+	// Only applies when 'UseNginxStreaming' is enabled.
+	// The directory Nginx spools request bodies into ('client_body_temp_path'), uploads are only accepted from files within it.
+	// Should be on the same filesystem as the data directory, otherwise every upload has to be copied rather than moved into place.
+	NginxUploadDirectory string `json:"nginx_upload_directory"`
 
 	// Does not apply when 'UseNginxStreaming' is enabled.
 	// Not to be confused with the maximum size of an object.
 	// The maximum size in bytes that a single part can be streamed into an object without having to be split into multiple parts.
 	// Parts larger than this will be rejected with a 413 status code once the stream goes over this byte threshold.
-	MaxSinglePartSize uint64
+	MaxSinglePartSize uint64 `json:"max_single_part_size"`
 
 	// Does not apply when 'UseNginxStreaming' is enabled.
 	// The chunk size in bytes to receive and stream into an object at once.
 	// Higher values usually improve upload performance at a cost of higher memory (mostly with lots of concurrent uploads).
 	// Values too low (especially below a few KBs) will use less memory, but will result in significantly degraded upload performance.
 	// Up to a certain point, any performance improvements will stagnate which is determined by the system's IO throughput.
-	UploadStreamingChunkSize uint32
+	UploadStreamingChunkSize uint32 `json:"upload_streaming_chunk_size"`
 
 	// Does not apply when 'UseNginxStreaming' is enabled.
 	// Same principle as UploadStreamingChunkSize but the other way round, the chunk size to use when streaming a file to the connection.
-	DownloadStreamingChunkSize uint32
+	DownloadStreamingChunkSize uint32 `json:"download_streaming_chunk_size"`
+
+	// Does not apply when 'UseNginxStreaming' is enabled.
+	// How long in milliseconds writing a single chunk of a download may take before the client is considered stalled and the download is aborted.
+	// A value of 0 disables the timeout.
+	DownloadWriteTimeoutMs int64 `json:"download_write_timeout_ms"`
+
+	// Does not apply when 'UseNginxStreaming' is enabled.
+	// The minimum average rate in bytes per second a client must read a download at, checked once the download has run for longer than the write timeout.
+	// Slower downloads are aborted so that they don't hold on to a file and connection indefinitely. A value of 0 disables the check.
+	DownloadMinBytesPerSecond uint64 `json:"download_min_bytes_per_second"`
 
 	// How much clock skew to allow with signatures before rejecting them outright.
 	// Values too high will allow expired URLs to still be accessible for much longer, while values too low may incorrectly reject certain URLs due to clock skew on the signing server.
-	SignatureClockSkewMs int64
+	SignatureClockSkewMs int64 `json:"signature_clock_skew_ms"`
+
+	// How long in milliseconds a multipart upload can remain uncompleted before it is considered abandoned and removed alongside its parts.
+	MultipartUploadExpiryMs int64 `json:"multipart_upload_expiry_ms"`
+
+	// How often in milliseconds to sweep for and remove abandoned multipart uploads.
+	MultipartSweepIntervalMs int64 `json:"multipart_sweep_interval_ms"`
+
+	// How long in milliseconds a bucket (alongside its keys, selectors and rules) is cached for before being fetched from the database again.
+	// Changes made through the admin API take effect immediately regardless, this mostly matters for changes made to the database directly.
+	// A value of 0 caches buckets until they are changed.
+	BucketCacheTTLMs int64 `json:"bucket_cache_ttl_ms"`
+
+	// How long in milliseconds a bucket name which doesn't exist is remembered as missing, saving the database from repeated lookups.
+	// Buckets created through the admin API are available immediately regardless.
+	MissingBucketCacheTTLMs int64 `json:"missing_bucket_cache_ttl_ms"`
+
+	// The maximum amount of missing bucket names to remember at once, a value of 0 disables remembering them entirely.
+	MissingBucketCacheSize uint32 `json:"missing_bucket_cache_size"`
+
+	// The maximum amount of requests for buckets which don't exist that a single client can make per minute before being throttled with a 429 status code.
+	// The client is identified by the 'X-SV-RP-Client-IP' header if set by the reverse proxy, otherwise by the address of the connection.
+	// A value of 0 disables throttling, which is the default as without that header every client behind the reverse proxy would share a single limit.
+	MissingBucketRequestsPerMinute uint32 `json:"missing_bucket_requests_per_minute"`
+
+	// How often in milliseconds to remove files from the data directory which aren't tracked by the database (e.g. left behind by a crash).
+	// A value of 0 disables the background collection, it can still be run once with the '--gc' flag.
+	GarbageCollectionIntervalMs int64 `json:"garbage_collection_interval_ms"`
+
+	// How old in milliseconds an untracked file must be before it is removed, which must be comfortably longer than any upload takes.
+	GarbageCollectionGraceMs int64 `json:"garbage_collection_grace_ms"`
+
+	// How often in milliseconds every file should be re-read and checked against its digest to detect corruption at rest.
+	// A value of 0 disables the background scrubber, it can still be run once with the '--scrub' flag.
+	ScrubIntervalMs int64 `json:"scrub_interval_ms"`
+
+	// The maximum rate in bytes per second the scrubber reads files at, to avoid starving requests of disk IO.
+	// A value of 0 removes the limit.
+	ScrubBytesPerSecond uint64 `json:"scrub_bytes_per_second"`
+
+	// Whether to still serve files which failed verification (flagged with an 'X-SV-Integrity: corrupted' header), rather than refusing them with a 500 status code.
+	ServeCorruptedFiles bool `json:"serve_corrupted_files"`
+
+	// How far to go to ensure an acknowledged upload survives a power loss, one of:
+	// 'none' leaves flushing to the operating system, 'file' flushes the contents of the file before the upload is acknowledged,
+	// and 'file+dir' also flushes the directory the file is moved into, so that the move itself can't be lost.
+	UploadDurability string `json:"upload_durability"`
+
+	// How long in milliseconds to wait for in-progress uploads and downloads to finish when shutting down before forcefully exiting.
+	// Incomplete uploads are removed from disk when forcefully exiting.
+	ShutdownDeadlineMs int64 `json:"shutdown_deadline_ms"`
+
+	// The interface and port for the admin API to listen on, the admin API is disabled if left empty.
+	// This should never be exposed publicly as it allows full control over every bucket.
+	AdminListenInterfacePort string `json:"admin_listen_interface_port"`
+
+	// The root credential required in the 'X-SV-Admin-Key' header of every admin API request.
+	AdminRootKey string `json:"admin_root_key"`
+
+	// The path of the SQLite database file, defaults to 'database.sqlite' inside of the data directory if left empty.
+	// Ignored in debug mode, where an in-memory database is used instead.
+	DatabasePath string `json:"database_path"`
 
 	// Where all the magic happens; the root directory of where parts and objects will be uploaded & stored.
-	DataDirectory string
+	DataDirectory string `json:"data_directory"`
+}
+
+// The possible values of 'UploadDurability'.
+const (
+	DurabilityNone             = "none"
+	DurabilityFile             = "file"
+	DurabilityFileAndDirectory = "file+dir"
+)
+
+var AppConfig = AppConfigType{DebugMode: false, UseNginxStreaming: false, NginxInternalLocation: "/sv-internal/", NginxUploadDirectory: "", UploadStreamingChunkSize: 2097152, DownloadStreamingChunkSize: 2097152, DownloadWriteTimeoutMs: 30000, DownloadMinBytesPerSecond: 4096, MaxSinglePartSize: 104857600, DataDirectory: "./data", DatabasePath: "", SignatureClockSkewMs: 20000, MultipartUploadExpiryMs: 86400000, MultipartSweepIntervalMs: 600000, BucketCacheTTLMs: 60000, MissingBucketCacheTTLMs: 5000, MissingBucketCacheSize: 10000, MissingBucketRequestsPerMinute: 0, ShutdownDeadlineMs: 30000, GarbageCollectionIntervalMs: 3600000, GarbageCollectionGraceMs: 86400000, ScrubIntervalMs: 604800000, ScrubBytesPerSecond: 52428800, ServeCorruptedFiles: false, UploadDurability: DurabilityFileAndDirectory, ListenInterfacePort: "localhost:3000", AdminListenInterfacePort: "", AdminRootKey: ""}
+
+const envOverridePrefix = "SV_"
+
+// Loads the config from the JSON file at the path (if not empty) on top of the defaults, applies any environment variable overrides, and validates the result.
+// Returns an error listing every problem found if the config cannot be used.
+func LoadAppConfig(path string) error {
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("could not open config file: %w", err)
+		}
+
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&AppConfig)
+		file.Close()
+
+		if err != nil {
+			return fmt.Errorf("could not parse config file %s: %w", path, err)
+		}
+	}
+
+	problems := applyEnvOverrides(&AppConfig)
+	problems = append(problems, AppConfig.validate()...)
+
+	if len(problems) != 0 {
+		return errors.New("invalid config:\n\t" + strings.Join(problems, "\n\t"))
+	}
+
+	return nil
 }
 
-var AppConfig = AppConfigType{UseNginxStreaming: false, UploadStreamingChunkSize: 2097152, DownloadStreamingChunkSize: 2097152, MaxSinglePartSize: 104857600, DataDirectory: "./data", SignatureClockSkewMs: 20000, ListenInterfacePort: "localhost:3000"}
+// Overrides the fields of the config with the values of their respective environment variables (if set).
+// Returns a list of problems for any values which could not be parsed.
+func applyEnvOverrides(appConfig *AppConfigType) []string {
+	problems := []string{}
 
-// Adjusts behaviour depending on the type of build (e.g. database enters memory mode in debug).
-const DEBUG_MODE = true
+	value := reflect.ValueOf(appConfig).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Tag.Get("json")
+		envName := envOverridePrefix + strings.ToUpper(name)
+
+		raw, set := os.LookupEnv(envName)
+		if !set {
+			continue
+		}
+
+		field := value.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(raw)
+
+		case reflect.Bool:
+			parsed, err := strconv.ParseBool(raw)
+			if err != nil {
+				problems = append(problems, envName+": expected a boolean")
+				continue
+			}
+
+			field.SetBool(parsed)
+
+		case reflect.Uint32, reflect.Uint64:
+			parsed, err := strconv.ParseUint(raw, 10, field.Type().Bits())
+			if err != nil {
+				problems = append(problems, envName+": expected an unsigned integer")
+				continue
+			}
+
+			field.SetUint(parsed)
+
+		case reflect.Int64:
+			parsed, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				problems = append(problems, envName+": expected an integer")
+				continue
+			}
+
+			field.SetInt(parsed)
+
+		default:
+			panic("Unsupported config field type for " + name)
+		}
+	}
+
+	return problems
+}
+
+// Checks the config for values which would prevent the server from working correctly, returning a list of every problem found.
+func (appConfig AppConfigType) validate() []string {
+	problems := []string{}
+
+	if appConfig.ListenInterfacePort == "" {
+		problems = append(problems, "listen_interface_port: must not be empty")
+	}
+
+	if appConfig.UseNginxStreaming {
+		if !strings.HasPrefix(appConfig.NginxInternalLocation, "/") || !strings.HasSuffix(appConfig.NginxInternalLocation, "/") {
+			problems = append(problems, "nginx_internal_location: must start and end with '/'")
+		}
+
+		// Nginx passes the absolute path of spooled files, which are only accepted from within this directory.
+		if info, err := os.Stat(appConfig.NginxUploadDirectory); err != nil || !info.IsDir() || !filepath.IsAbs(appConfig.NginxUploadDirectory) {
+			problems = append(problems, "nginx_upload_directory: must be an existing absolute directory path when Nginx streaming is enabled")
+		}
+	}
+
+	if appConfig.MaxSinglePartSize == 0 {
+		problems = append(problems, "max_single_part_size: must be greater than zero")
+	}
+
+	if appConfig.UploadStreamingChunkSize == 0 {
+		problems = append(problems, "upload_streaming_chunk_size: must be greater than zero")
+	}
+
+	if appConfig.DownloadStreamingChunkSize == 0 {
+		problems = append(problems, "download_streaming_chunk_size: must be greater than zero")
+	}
+
+	if appConfig.DownloadWriteTimeoutMs < 0 {
+		problems = append(problems, "download_write_timeout_ms: must not be negative")
+	}
+
+	if appConfig.SignatureClockSkewMs < 0 {
+		problems = append(problems, "signature_clock_skew_ms: must not be negative")
+	}
+
+	if appConfig.MultipartUploadExpiryMs <= 0 {
+		problems = append(problems, "multipart_upload_expiry_ms: must be greater than zero")
+	}
+
+	if appConfig.MultipartSweepIntervalMs <= 0 {
+		problems = append(problems, "multipart_sweep_interval_ms: must be greater than zero")
+	}
+
+	if appConfig.BucketCacheTTLMs < 0 {
+		problems = append(problems, "bucket_cache_ttl_ms: must not be negative")
+	}
+
+	if appConfig.MissingBucketCacheTTLMs < 0 {
+		problems = append(problems, "missing_bucket_cache_ttl_ms: must not be negative")
+	}
+
+	if appConfig.GarbageCollectionIntervalMs < 0 {
+		problems = append(problems, "garbage_collection_interval_ms: must not be negative")
+	}
+
+	if appConfig.GarbageCollectionGraceMs < 0 {
+		problems = append(problems, "garbage_collection_grace_ms: must not be negative")
+	}
+
+	if appConfig.ScrubIntervalMs < 0 {
+		problems = append(problems, "scrub_interval_ms: must not be negative")
+	}
+
+	if appConfig.UploadDurability != DurabilityNone && appConfig.UploadDurability != DurabilityFile && appConfig.UploadDurability != DurabilityFileAndDirectory {
+		problems = append(problems, "upload_durability: must be one of 'none', 'file' or 'file+dir'")
+	}
+
+	if appConfig.ShutdownDeadlineMs < 0 {
+		problems = append(problems, "shutdown_deadline_ms: must not be negative")
+	}
+
+	if appConfig.AdminListenInterfacePort != "" && len(appConfig.AdminRootKey) < 32 {
+		problems = append(problems, "admin_root_key: must be at least 32 characters when the admin API is enabled")
+	}
+
+	// The data directory needs to exist and be writable, which is easiest to check by writing to it.
+	if probe, err := os.CreateTemp(appConfig.DataDirectory, ".sv-write-check-*"); err != nil {
+		problems = append(problems, "data_directory: must be an existing writable directory ("+err.Error()+")")
+	} else {
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+
+	return problems
+}
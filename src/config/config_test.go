@@ -0,0 +1,117 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Returns the default config, pointed at a temporary data directory so that it validates.
+func testAppConfig(t *testing.T) AppConfigType {
+	appConfig := AppConfig
+	appConfig.DataDirectory = t.TempDir()
+
+	return appConfig
+}
+
+func TestValidate(t *testing.T) {
+	if problems := testAppConfig(t).validate(); len(problems) != 0 {
+		t.Fatalf("default config has problems: %v", problems)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(appConfig *AppConfigType)
+		problem string
+	}{
+		{"empty listen address", func(c *AppConfigType) { c.ListenInterfacePort = "" }, "listen_interface_port"},
+		{"zero upload chunk size", func(c *AppConfigType) { c.UploadStreamingChunkSize = 0 }, "upload_streaming_chunk_size"},
+		{"zero download chunk size", func(c *AppConfigType) { c.DownloadStreamingChunkSize = 0 }, "download_streaming_chunk_size"},
+		{"zero single part size", func(c *AppConfigType) { c.MaxSinglePartSize = 0 }, "max_single_part_size"},
+		{"negative clock skew", func(c *AppConfigType) { c.SignatureClockSkewMs = -1 }, "signature_clock_skew_ms"},
+		{"zero multipart expiry", func(c *AppConfigType) { c.MultipartUploadExpiryMs = 0 }, "multipart_upload_expiry_ms"},
+		{"unknown durability", func(c *AppConfigType) { c.UploadDurability = "always" }, "upload_durability"},
+		{"short admin key", func(c *AppConfigType) { c.AdminListenInterfacePort = "localhost:3001"; c.AdminRootKey = "short" }, "admin_root_key"},
+		{"missing data directory", func(c *AppConfigType) { c.DataDirectory = filepath.Join(c.DataDirectory, "missing") }, "data_directory"},
+		{"nginx without upload directory", func(c *AppConfigType) { c.UseNginxStreaming = true }, "nginx_upload_directory"},
+		{"nginx location without slashes", func(c *AppConfigType) {
+			c.UseNginxStreaming = true
+			c.NginxUploadDirectory = c.DataDirectory
+			c.NginxInternalLocation = "internal"
+		}, "nginx_internal_location"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			appConfig := testAppConfig(t)
+			test.modify(&appConfig)
+
+			problems := appConfig.validate()
+			if len(problems) != 1 || !strings.HasPrefix(problems[0], test.problem+":") {
+				t.Errorf("got problems %v, want only one for %s", problems, test.problem)
+			}
+		})
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	t.Setenv("SV_LISTEN_INTERFACE_PORT", "0.0.0.0:8080")
+	t.Setenv("SV_USE_NGINX_STREAMING", "true")
+	t.Setenv("SV_MAX_SINGLE_PART_SIZE", "1024")
+	t.Setenv("SV_SIGNATURE_CLOCK_SKEW_MS", "-5")
+
+	appConfig := testAppConfig(t)
+	if problems := applyEnvOverrides(&appConfig); len(problems) != 0 {
+		t.Fatalf("got problems %v", problems)
+	}
+
+	if appConfig.ListenInterfacePort != "0.0.0.0:8080" || !appConfig.UseNginxStreaming || appConfig.MaxSinglePartSize != 1024 || appConfig.SignatureClockSkewMs != -5 {
+		t.Errorf("overrides not applied: %+v", appConfig)
+	}
+
+	// Fields without a variable set keep their value.
+	if appConfig.UploadStreamingChunkSize != AppConfig.UploadStreamingChunkSize {
+		t.Errorf("upload_streaming_chunk_size changed to %d", appConfig.UploadStreamingChunkSize)
+	}
+}
+
+func TestApplyEnvOverridesInvalid(t *testing.T) {
+	t.Setenv("SV_DEBUG_MODE", "perhaps")
+	t.Setenv("SV_MAX_SINGLE_PART_SIZE", "-1")
+	t.Setenv("SV_BUCKET_CACHE_TTL_MS", "soon")
+
+	appConfig := testAppConfig(t)
+	problems := applyEnvOverrides(&appConfig)
+	slices.Sort(problems)
+
+	want := []string{"SV_BUCKET_CACHE_TTL_MS: expected an integer", "SV_DEBUG_MODE: expected a boolean", "SV_MAX_SINGLE_PART_SIZE: expected an unsigned integer"}
+	if !slices.Equal(problems, want) {
+		t.Errorf("got problems %v, want %v", problems, want)
+	}
+}
+
+func TestLoadAppConfigListsEveryProblem(t *testing.T) {
+	defaults := AppConfig
+	defer func() { AppConfig = defaults }()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"upload_streaming_chunk_size": 0, "download_streaming_chunk_size": 0, "data_directory": "`+filepath.ToSlash(t.TempDir())+`"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := LoadAppConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "upload_streaming_chunk_size") || !strings.Contains(err.Error(), "download_streaming_chunk_size") {
+		t.Errorf("got %v, want both chunk sizes reported", err)
+	}
+
+	AppConfig = defaults
+	if err := os.WriteFile(path, []byte(`{"unknown_field": 1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := LoadAppConfig(path); err == nil {
+		t.Error("unknown field was accepted")
+	}
+}
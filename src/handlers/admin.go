@@ -0,0 +1,528 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+	"path"
+	. "speedyvault/src/handlers/constants"
+	"time"
+)
+
+type AdminBucket struct {
+	Id            int64  `json:"id"`
+	Name          string `json:"name"`
+	CreatedMs     int64  `json:"created_ms"`
+	SharedStorage bool   `json:"shared_storage"` // Whether files are deduplicated against every bucket using shared storage.
+}
+
+type AdminAPIKey struct {
+	Id        int64  `json:"id"`
+	Name      string `json:"name"`
+	CreatedMs int64  `json:"created_ms"`
+}
+
+type AdminMACSelector struct {
+	Id        int64  `json:"id"`
+	Selector  uint32 `json:"selector"`
+	CreatedMs int64  `json:"created_ms"`
+}
+
+type AdminAccessRule struct {
+	Id       int64                  `json:"id"`
+	Priority uint32                 `json:"priority"`
+	Regex    string                 `json:"regex"`
+	Action   BucketAccessRuleAction `json:"action"`
+}
+
+var AdminNotFoundError = errors.New("Resource does not exist")
+var AdminConflictError = errors.New("Resource conflicts with an existing resource")
+
+// Converts a constraint violation into AdminConflictError, leaving any other error as is.
+func adminConstraintError(err error) error {
+	if isConstraintError(err) {
+		return AdminConflictError
+	}
+
+	return err
+}
+
+// Fetches the ID of a bucket by its name, returning AdminNotFoundError if it doesn't exist.
+func (AdminHandler) getBucketId(name string) (int64, error) {
+	var bucketId int64
+	if err := DB.QueryRow("SELECT id FROM buckets WHERE name = ?", name).Scan(&bucketId); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, AdminNotFoundError
+		}
+
+		log.Println("Problem while fetching bucket from database ", err)
+		return 0, err
+	}
+
+	return bucketId, nil
+}
+
+// Deletes a row belonging to a bucket from one of the bucket tables, returning AdminNotFoundError if it doesn't exist.
+func (AdminHandler) deleteBucketRow(table string, bucketName string, id int64) error {
+	result, err := DB.Exec("DELETE FROM "+table+" WHERE id = ? AND bucket_id = (SELECT id FROM buckets WHERE name = ?)", id, bucketName)
+	if err != nil {
+		log.Println("Problem while deleting from "+table+" in database ", err)
+		return adminConstraintError(err)
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return AdminNotFoundError
+	}
+
+	Bucket.InvalidateCachedBucket(bucketName)
+	return nil
+}
+
+func (AdminHandler) ListBuckets() ([]AdminBucket, error) {
+	rows, err := DB.Query("SELECT id,name,created_ms,shared_storage FROM buckets ORDER BY name ASC")
+	if err != nil {
+		log.Println("Problem while fetching buckets from database ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []AdminBucket{}
+	for rows.Next() {
+		var bucket AdminBucket
+		if err := rows.Scan(&bucket.Id, &bucket.Name, &bucket.CreatedMs, &bucket.SharedStorage); err != nil {
+			log.Println("Problem while reading buckets from database ", err)
+			return nil, err
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets, rows.Err()
+}
+
+// Creates a new bucket alongside its directories on disk, returning AdminConflictError if the name is already taken.
+// The storage mode can't be changed afterwards, as existing files would have to be moved between directories.
+func (AdminHandler) CreateBucket(name string, sharedStorage bool) (*AdminBucket, error) {
+	bucket := AdminBucket{Name: name, CreatedMs: time.Now().UnixMilli(), SharedStorage: sharedStorage}
+	if err := DB.QueryRow(
+		"INSERT INTO buckets(name,created_ms,shared_storage) VALUES(?,?,?) RETURNING id", name, bucket.CreatedMs, sharedStorage,
+	).Scan(&bucket.Id); err != nil {
+		log.Println("Problem while inserting bucket to database ", err)
+		return nil, adminConstraintError(err)
+	}
+
+	objectDirectory := path.Join(getBucketDirectory(bucket.Id), "objects")
+	if sharedStorage {
+		objectDirectory = getSharedObjectDirectory()
+	}
+
+	if err := os.MkdirAll(objectDirectory, 0o755); err != nil {
+		log.Println("Problem while creating bucket objects directory ", err)
+
+		// A bucket without a directory is useless, so undo the creation.
+		if _, err := DB.Exec("DELETE FROM buckets WHERE id = ?", bucket.Id); err != nil {
+			log.Println("Problem while deleting bucket without a directory from database ", err)
+		}
+
+		return nil, err
+	}
+
+	Bucket.InvalidateCachedBucket(name)
+	return &bucket, nil
+}
+
+func (AdminHandler) RenameBucket(name string, newName string) error {
+	result, err := DB.Exec("UPDATE buckets SET name = ? WHERE name = ?", newName, name)
+	if err != nil {
+		log.Println("Problem while renaming bucket in database ", err)
+		return adminConstraintError(err)
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return AdminNotFoundError
+	}
+
+	Bucket.InvalidateCachedBucket(name)
+	Bucket.InvalidateCachedBucket(newName)
+	return nil
+}
+
+// Deletes a bucket alongside everything belonging to it, both from the database and disk.
+// Shared files which other buckets still reference are kept and handed over to one of those buckets.
+// Returns AdminConflictError if files stored in the bucket directory are still referenced from elsewhere.
+func (AdminHandler) DeleteBucket(name string) error {
+	dbCtx := context.Background()
+	dbConn, err := DB.Conn(dbCtx)
+	if err != nil {
+		log.Println("Problem while acquiring scoped database session ", err)
+		return err
+	}
+	defer dbConn.Close()
+
+	// We need to acquire an immediate lock here to keep the file reference counts consistent.
+	if _, err := dbConn.ExecContext(dbCtx, "BEGIN IMMEDIATE TRANSACTION"); err != nil {
+		log.Println("Problem while acquiring immediate transaction lock ", err)
+		return err
+	}
+
+	rollback := func() {
+		if _, err := dbConn.ExecContext(dbCtx, "ROLLBACK"); err != nil {
+			log.Println("Problem while rolling back database transaction ", err)
+		}
+	}
+
+	var bucketId int64
+	if err := dbConn.QueryRowContext(dbCtx, "SELECT id FROM buckets WHERE name = ?", name).Scan(&bucketId); err != nil {
+		rollback()
+
+		if err == sql.ErrNoRows {
+			return AdminNotFoundError
+		}
+
+		log.Println("Problem while fetching bucket from database ", err)
+		return err
+	}
+
+	// Files in the bucket directory can't outlive it, so they must not be referenced by any other bucket.
+	var foreignReferences int64
+	if err := dbConn.QueryRowContext(
+		dbCtx, "SELECT COUNT(*) FROM objects INNER JOIN files ON objects.file_id = files.id WHERE files.bucket_id = ? AND files.shared = 0 AND objects.bucket_id != ?", bucketId, bucketId,
+	).Scan(&foreignReferences); err != nil {
+		rollback()
+		log.Println("Problem while counting foreign file references ", err)
+		return err
+	}
+
+	if foreignReferences != 0 {
+		rollback()
+		return AdminConflictError
+	}
+
+	// Release the references the objects of the bucket hold on files, as the cascade wouldn't update the reference counts.
+	rows, err := dbConn.QueryContext(dbCtx, `
+		UPDATE files SET ref_count = ref_count - (SELECT COUNT(*) FROM objects WHERE objects.bucket_id = ? AND objects.file_id = files.id)
+		WHERE id IN (SELECT file_id FROM objects WHERE bucket_id = ?) RETURNING id, bucket_id, uid, shared, sharded, ref_count
+	`, bucketId, bucketId)
+	if err != nil {
+		rollback()
+		log.Println("Problem while decrementing file refcounts ", err)
+		return err
+	}
+
+	orphanedFileIds := []int64{}
+	orphanedFilePaths := []string{}
+	for rows.Next() {
+		var file CachedFile
+		var refCount int64
+		if err := rows.Scan(&file.id, &file.bucketId, &file.UID, &file.Shared, &file.sharded, &refCount); err != nil {
+			rows.Close()
+			rollback()
+			log.Println("Problem while reading file refcounts ", err)
+			return err
+		}
+
+		if refCount <= 0 {
+			orphanedFileIds = append(orphanedFileIds, file.id)
+			orphanedFilePaths = append(orphanedFilePaths, file.GetPath())
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		rollback()
+		log.Println("Problem while reading file refcounts ", err)
+		return err
+	}
+
+	rows.Close()
+
+	if _, err := dbConn.ExecContext(dbCtx, "DELETE FROM objects WHERE bucket_id = ?", bucketId); err != nil {
+		rollback()
+		log.Println("Problem while deleting bucket objects from database ", err)
+		return err
+	}
+
+	for _, fileId := range orphanedFileIds {
+		if _, err := dbConn.ExecContext(dbCtx, "DELETE FROM files WHERE id = ?", fileId); err != nil {
+			rollback()
+			log.Println("Problem while deleting zero-reference file ", err)
+			return err
+		}
+	}
+
+	// Shared files uploaded through this bucket which are still in use elsewhere are handed over, as their path doesn't depend on the bucket.
+	if _, err := dbConn.ExecContext(
+		dbCtx, "UPDATE files SET bucket_id = (SELECT objects.bucket_id FROM objects WHERE objects.file_id = files.id LIMIT 1) WHERE bucket_id = ? AND shared = 1 AND EXISTS(SELECT 1 FROM objects WHERE objects.file_id = files.id)",
+		bucketId,
+	); err != nil {
+		rollback()
+		log.Println("Problem while handing over shared files ", err)
+		return err
+	}
+
+	// Anything left is no longer referenced at all.
+	rows, err = dbConn.QueryContext(dbCtx, "DELETE FROM files WHERE bucket_id = ? RETURNING uid, shared, sharded", bucketId)
+	if err != nil {
+		rollback()
+		log.Println("Problem while deleting bucket files from database ", err)
+		return err
+	}
+
+	for rows.Next() {
+		file := CachedFile{bucketId: bucketId}
+		if err := rows.Scan(&file.UID, &file.Shared, &file.sharded); err != nil {
+			rows.Close()
+			rollback()
+			log.Println("Problem while reading deleted bucket files ", err)
+			return err
+		}
+
+		// Files in the bucket directory are removed alongside it.
+		if file.Shared {
+			orphanedFilePaths = append(orphanedFilePaths, file.GetPath())
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		rollback()
+		log.Println("Problem while reading deleted bucket files ", err)
+		return err
+	}
+
+	rows.Close()
+
+	if _, err := dbConn.ExecContext(dbCtx, "DELETE FROM buckets WHERE id = ?", bucketId); err != nil {
+		rollback()
+		log.Println("Problem while deleting bucket from database ", err)
+		return adminConstraintError(err)
+	}
+
+	// We're clear!
+	if _, err := dbConn.ExecContext(dbCtx, "COMMIT"); err != nil {
+		// Any errors are ignored here since there's not much we can do about it.
+		dbConn.ExecContext(dbCtx, "ROLLBACK")
+
+		log.Println("Problem while committing database transaction ", err)
+		return err
+	}
+
+	Bucket.InvalidateCachedBucket(name)
+
+	// We don't want to do potentially expensive IO operations while keeping the tables locked, so we do it after.
+	for _, filePath := range orphanedFilePaths {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Println("Problem while deleting unreferenced file ", err)
+		}
+	}
+
+	if err := os.RemoveAll(getBucketDirectory(bucketId)); err != nil {
+		log.Println("Problem while deleting bucket directory ", err)
+	}
+
+	return nil
+}
+
+func (AdminHandler) ListAPIKeys(bucketName string) ([]AdminAPIKey, error) {
+	bucketId, err := Admin.getBucketId(bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := DB.Query("SELECT id,name,created_ms FROM bucket_auth_api_keys WHERE bucket_id = ? ORDER BY id ASC", bucketId)
+	if err != nil {
+		log.Println("Problem while fetching bucket API keys from database ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []AdminAPIKey{}
+	for rows.Next() {
+		var key AdminAPIKey
+		if err := rows.Scan(&key.Id, &key.Name, &key.CreatedMs); err != nil {
+			log.Println("Problem while reading bucket API keys from database ", err)
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Generates a new API key for the bucket, returning the key alongside its secret.
+// The secret is never stored (only its digest is), so this is the only time it can be seen.
+func (AdminHandler) CreateAPIKey(bucketName string, name string) (*AdminAPIKey, string, error) {
+	bucketId, err := Admin.getBucketId(bucketName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Keys are 64 random bytes, which is what CachedBucketAPIKeyStore expects to decode.
+	rawKey := make([]byte, 64)
+	rand.Read(rawKey)
+	keyHash := sha512.Sum512(rawKey)
+
+	key := AdminAPIKey{Name: name, CreatedMs: time.Now().UnixMilli()}
+	if err := DB.QueryRow(
+		"INSERT INTO bucket_auth_api_keys(bucket_id,name,created_ms,key_hashed) VALUES(?,?,?,?) RETURNING id", bucketId, name, key.CreatedMs, keyHash[:],
+	).Scan(&key.Id); err != nil {
+		log.Println("Problem while inserting bucket API key to database ", err)
+		return nil, "", adminConstraintError(err)
+	}
+
+	Bucket.InvalidateCachedBucket(bucketName)
+	return &key, base64.RawStdEncoding.EncodeToString(rawKey), nil
+}
+
+func (AdminHandler) RenameAPIKey(bucketName string, id int64, newName string) error {
+	result, err := DB.Exec("UPDATE bucket_auth_api_keys SET name = ? WHERE id = ? AND bucket_id = (SELECT id FROM buckets WHERE name = ?)", newName, id, bucketName)
+	if err != nil {
+		log.Println("Problem while renaming bucket API key in database ", err)
+		return adminConstraintError(err)
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return AdminNotFoundError
+	}
+
+	Bucket.InvalidateCachedBucket(bucketName)
+	return nil
+}
+
+func (AdminHandler) DeleteAPIKey(bucketName string, id int64) error {
+	return Admin.deleteBucketRow("bucket_auth_api_keys", bucketName, id)
+}
+
+func (AdminHandler) ListMACSelectors(bucketName string) ([]AdminMACSelector, error) {
+	bucketId, err := Admin.getBucketId(bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := DB.Query("SELECT id,selector,created_ms FROM bucket_object_auth_mac WHERE bucket_id = ? ORDER BY selector ASC", bucketId)
+	if err != nil {
+		log.Println("Problem while fetching bucket object MAC authentication entries from database ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	selectors := []AdminMACSelector{}
+	for rows.Next() {
+		var selector AdminMACSelector
+		if err := rows.Scan(&selector.Id, &selector.Selector, &selector.CreatedMs); err != nil {
+			log.Println("Problem while reading bucket object MAC authentication entries from database ", err)
+			return nil, err
+		}
+
+		selectors = append(selectors, selector)
+	}
+
+	return selectors, rows.Err()
+}
+
+// Creates a new MAC selector for the bucket, generating a secret if one isn't provided.
+// Returns the selector alongside its secret, returning AdminConflictError if the selector is already in use.
+func (AdminHandler) CreateMACSelector(bucketName string, selectorKey uint32, secret []byte) (*AdminMACSelector, []byte, error) {
+	bucketId, err := Admin.getBucketId(bucketName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if secret == nil {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+
+	selector := AdminMACSelector{Selector: selectorKey, CreatedMs: time.Now().UnixMilli()}
+	if err := DB.QueryRow(
+		"INSERT INTO bucket_object_auth_mac(bucket_id,selector,secret,created_ms) VALUES(?,?,?,?) RETURNING id", bucketId, selectorKey, secret, selector.CreatedMs,
+	).Scan(&selector.Id); err != nil {
+		log.Println("Problem while inserting bucket object MAC authentication entry to database ", err)
+		return nil, nil, adminConstraintError(err)
+	}
+
+	Bucket.InvalidateCachedBucket(bucketName)
+	return &selector, secret, nil
+}
+
+func (AdminHandler) DeleteMACSelector(bucketName string, id int64) error {
+	return Admin.deleteBucketRow("bucket_object_auth_mac", bucketName, id)
+}
+
+func (AdminHandler) ListAccessRules(bucketName string) ([]AdminAccessRule, error) {
+	bucketId, err := Admin.getBucketId(bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := DB.Query("SELECT id,priority,regex,action FROM bucket_access_rules WHERE bucket_id = ? ORDER BY priority ASC", bucketId)
+	if err != nil {
+		log.Println("Problem while fetching bucket access rules from database ", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []AdminAccessRule{}
+	for rows.Next() {
+		var rule AdminAccessRule
+		if err := rows.Scan(&rule.Id, &rule.Priority, &rule.Regex, &rule.Action); err != nil {
+			log.Println("Problem while reading bucket access rules from database ", err)
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// Creates a new access rule for the bucket, the regex MUST have been validated beforehand.
+func (AdminHandler) CreateAccessRule(bucketName string, rule AdminAccessRule) (*AdminAccessRule, error) {
+	bucketId, err := Admin.getBucketId(bucketName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := DB.QueryRow(
+		"INSERT INTO bucket_access_rules(bucket_id,priority,regex,action) VALUES(?,?,?,?) RETURNING id", bucketId, rule.Priority, rule.Regex, rule.Action,
+	).Scan(&rule.Id); err != nil {
+		log.Println("Problem while inserting bucket access rule to database ", err)
+		return nil, adminConstraintError(err)
+	}
+
+	Bucket.InvalidateCachedBucket(bucketName)
+	return &rule, nil
+}
+
+// Replaces an existing access rule of the bucket, the regex MUST have been validated beforehand.
+func (AdminHandler) UpdateAccessRule(bucketName string, rule AdminAccessRule) error {
+	result, err := DB.Exec(
+		"UPDATE bucket_access_rules SET priority = ?, regex = ?, action = ? WHERE id = ? AND bucket_id = (SELECT id FROM buckets WHERE name = ?)",
+		rule.Priority, rule.Regex, rule.Action, rule.Id, bucketName,
+	)
+	if err != nil {
+		log.Println("Problem while updating bucket access rule in database ", err)
+		return adminConstraintError(err)
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return AdminNotFoundError
+	}
+
+	Bucket.InvalidateCachedBucket(bucketName)
+	return nil
+}
+
+func (AdminHandler) DeleteAccessRule(bucketName string, id int64) error {
+	return Admin.deleteBucketRow("bucket_access_rules", bucketName, id)
+}
+
+type AdminHandler struct{}
+
+var Admin = AdminHandler{}
@@ -0,0 +1,13 @@
+package handlers
+
+import "testing"
+
+func TestCreateBucketConflict(t *testing.T) {
+	if _, err := Admin.CreateBucket("conflict-bucket", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Admin.CreateBucket("conflict-bucket", false); err != AdminConflictError {
+		t.Errorf("creating a duplicate bucket gave %v, want AdminConflictError", err)
+	}
+}
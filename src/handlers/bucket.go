@@ -4,6 +4,7 @@ import (
 	"crypto/sha512"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"log"
 	"path"
 	"regexp"
@@ -15,8 +16,9 @@ import (
 )
 
 type CachedBucket struct {
-	id        int64
-	createdMs int64
+	id            int64
+	createdMs     int64
+	SharedStorage bool // Whether files are deduplicated against every bucket using shared storage rather than only within this bucket.
 
 	cachedMs    int64
 	APIKeys     CachedBucketAPIKeyStore
@@ -24,8 +26,27 @@ type CachedBucket struct {
 	AccessRules []*CachedBucketAccessRule
 }
 
+// The location newly uploaded object files of this bucket are stored at.
 func (b CachedBucket) GetObjectPath(objectId string) string {
-	return path.Join(config.AppConfig.DataDirectory, strconv.FormatInt(b.id, 10), "objects", objectId)
+	return getFilePath(b.id, b.SharedStorage, true, objectId)
+}
+
+func (b CachedBucket) GetPartPath(partId string) string {
+	return getBucketPartPath(b.id, partId)
+}
+
+func getBucketObjectPath(bucketId int64, objectId string) string {
+	return path.Join(getBucketDirectory(bucketId), "objects", objectId)
+}
+
+// Parts are sometimes handled without the bucket being cached (e.g. when sweeping expired uploads), hence the separate function.
+func getBucketPartPath(bucketId int64, partId string) string {
+	return path.Join(getBucketDirectory(bucketId), "parts", partId)
+}
+
+// The directory on disk which houses everything belonging to the bucket.
+func getBucketDirectory(bucketId int64) string {
+	return path.Join(config.AppConfig.DataDirectory, strconv.FormatInt(bucketId, 10))
 }
 
 func (b CachedBucket) GetKeyAccessCondition(key []byte) BucketAccessRuleAction {
@@ -85,18 +106,110 @@ type CachedBucketObjectAuthMAC struct {
 var nameBucketCacheLock sync.RWMutex
 var nameBucketCache = make(map[string]*CachedBucket)
 
+// Names of buckets which were recently found to not exist alongside when they were cached, saving the database from repeated lookups of unknown buckets.
+var missingBucketCache = make(map[string]int64)
+
+// Loads of buckets currently in progress, used to make concurrent requests for the same uncached bucket wait on a single load.
+var nameBucketLoads = make(map[string]*bucketLoad)
+
+// Given to those waiting on a bucket load which never finished (e.g. because it panicked).
+var BucketLoadIncompleteError = errors.New("Bucket load did not complete")
+
+type bucketLoad struct {
+	done   chan struct{}
+	bucket *CachedBucket
+	err    error
+}
+
+// Whether a cached bucket is still within the configured TTL (a TTL of 0 means cached buckets never expire).
+func (b CachedBucket) isFresh(currentMs int64) bool {
+	return config.AppConfig.BucketCacheTTLMs == 0 || currentMs-b.cachedMs < config.AppConfig.BucketCacheTTLMs
+}
+
 func (BucketHandler) GetBucketByName(name string) (*CachedBucket, error) {
 	nameBucketCacheLock.RLock()
 	cachedEntry, bucketInCache := nameBucketCache[name]
 	nameBucketCacheLock.RUnlock()
 
-	if bucketInCache {
+	currentMs := time.Now().UnixMilli()
+	if bucketInCache && cachedEntry.isFresh(currentMs) {
 		return cachedEntry, nil
 	}
 
+	nameBucketCacheLock.RLock()
+	missingCachedMs, bucketKnownMissing := missingBucketCache[name]
+	nameBucketCacheLock.RUnlock()
+
+	if bucketKnownMissing && currentMs-missingCachedMs < config.AppConfig.MissingBucketCacheTTLMs {
+		return nil, nil
+	}
+
+	// Either join a load that is already in progress, or start one ourselves.
+	nameBucketCacheLock.Lock()
+	load, loadInProgress := nameBucketLoads[name]
+	if !loadInProgress {
+		load = &bucketLoad{done: make(chan struct{})}
+		nameBucketLoads[name] = load
+	}
+	nameBucketCacheLock.Unlock()
+
+	if loadInProgress {
+		<-load.done
+		return load.bucket, load.err
+	}
+
+	// Waiters are released in a defer so that they aren't left blocked forever should loading panic.
+	load.err = BucketLoadIncompleteError
+	defer finishBucketLoad(name, load)
+
+	load.bucket, load.err = loadBucketByName(name)
+	return load.bucket, load.err
+}
+
+// Caches the outcome of a bucket load and releases everyone waiting on it.
+func finishBucketLoad(name string, load *bucketLoad) {
+	nameBucketCacheLock.Lock()
+	// If the bucket was invalidated while loading, what was loaded may already be outdated so it isn't cached.
+	if nameBucketLoads[name] == load {
+		delete(nameBucketLoads, name)
+
+		if load.err == nil && load.bucket != nil {
+			nameBucketCache[name] = load.bucket
+		} else {
+			delete(nameBucketCache, name)
+		}
+
+		if load.err == nil && load.bucket == nil && config.AppConfig.MissingBucketCacheSize != 0 {
+			// Make room by evicting an arbitrary entry, as the cache is only meant to absorb bursts of lookups.
+			if uint32(len(missingBucketCache)) >= config.AppConfig.MissingBucketCacheSize {
+				for evictedName := range missingBucketCache {
+					delete(missingBucketCache, evictedName)
+					break
+				}
+			}
+
+			missingBucketCache[name] = time.Now().UnixMilli()
+		}
+	}
+	nameBucketCacheLock.Unlock()
+
+	close(load.done)
+}
+
+// Removes a bucket from the cache, which MUST be called after any change to the bucket or the tables belonging to it so that the change takes effect.
+func (BucketHandler) InvalidateCachedBucket(name string) {
+	nameBucketCacheLock.Lock()
+	delete(nameBucketCache, name)
+	delete(missingBucketCache, name)
+	delete(nameBucketLoads, name)
+	nameBucketCacheLock.Unlock()
+}
+
+// Fetches a bucket alongside everything belonging to it from the database, returning nil if it doesn't exist.
+func loadBucketByName(name string) (*CachedBucket, error) {
 	// Fetch the bucket from the database.
 	bucket := CachedBucket{}
-	if err := DB.QueryRow("SELECT id,created_ms FROM buckets WHERE name = ?", name).Scan(&bucket.id, &bucket.createdMs); err != nil {
+	if err := DB.QueryRow("SELECT id,created_ms,shared_storage FROM buckets WHERE name = ?", name).Scan(&bucket.id, &bucket.createdMs, &bucket.SharedStorage); err != nil {
 		// No bucket of this name exists.
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -148,8 +261,15 @@ func (BucketHandler) GetBucketByName(name string) (*CachedBucket, error) {
 			return nil, err
 		}
 
-		// Regex would've been validated at insertion time, so fine to panic on error.
-		rule.Regex = regexp.MustCompile(rawRegex)
+		// Regex would've been validated at insertion time, but a bad one must not take down every request for the bucket.
+		regex, err := regexp.Compile(rawRegex)
+		if err != nil {
+			accessRuleRows.Close()
+			log.Println("Problem while compiling bucket access rule from database ", err)
+			return nil, err
+		}
+
+		rule.Regex = regex
 
 		// Add to the rule list (already in highest to lowest priority order from database).
 		bucket.AccessRules = append(bucket.AccessRules, &rule)
@@ -192,107 +312,22 @@ func (BucketHandler) GetBucketByName(name string) (*CachedBucket, error) {
 
 	apiKeyRows.Close()
 
-	// Add to the cache.
-	// NOTE: Multiple goroutines could get to this point and replace an existing cache entry, but unlike SpeedyGuard, this here has no consequence hence no check is needed.
-	nameBucketCacheLock.Lock()
-	nameBucketCache[name] = &bucket
-	nameBucketCacheLock.Unlock()
-
 	return &bucket, nil
 }
 
-func (BucketHandler) InitDBTables() {
-	var err error
-
-	_, err = DB.Exec(`
-		CREATE TABLE IF NOT EXISTS buckets (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name VARCHAR(64) UNIQUE NOT NULL,
-			created_ms UNSIGNED BIGINT NOT NULL
-		)
-	`)
-
-	if err != nil {
-		log.Fatal("Error while creating buckets table ", err)
-	}
-
-	_, err = DB.Exec(`
-		CREATE TABLE IF NOT EXISTS bucket_auth_api_keys (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			bucket_id INTEGER NOT NULL,
-			name VARCHAR(64) UNIQUE NOT NULL,
-			created_ms UNSIGNED BIGINT NOT NULL,
-			key_hashed BLOB(64) NOT NULL,
-
-			FOREIGN KEY (bucket_id) REFERENCES buckets (id) ON DELETE CASCADE
-		)
-	`)
-
-	if err != nil {
-		log.Fatal("Error while creating bucket API keys table ", err)
-	}
-
-	_, err = DB.Exec("CREATE INDEX idx_bucket_auth_api_keys_bucket_id ON bucket_auth_api_keys(bucket_id)")
-	if err != nil {
-		log.Fatal("Error while creating bucket API keys index ", err)
-	}
-
-	// TODO: When creating a rule, check if regex contains $ and ^ anchors, and warn user if not since rules can pass with partial matches!
-	_, err = DB.Exec(`
-		CREATE TABLE IF NOT EXISTS bucket_access_rules (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			bucket_id INTEGER NOT NULL,
-			priority UNSIGNED INTEGER NOT NULL,
-			
-			regex TEXT NOT NULL,
-			action UNSIGNED TINYINT NOT NULL,
-
-			FOREIGN KEY (bucket_id) REFERENCES buckets (id) ON DELETE CASCADE
-		)
-	`)
-
-	if err != nil {
-		log.Fatal("Error while creating bucket rules table ", err)
-	}
-
-	_, err = DB.Exec("CREATE INDEX idx_bucket_access_rules_bucket_id ON bucket_access_rules(bucket_id)")
-	if err != nil {
-		log.Fatal("Error while creating bucket access rules index ", err)
+// Inserts a test bucket with a known API key and MAC selector, only meant to be used with the in-memory database in debug mode.
+func (BucketHandler) InsertDebugRows() {
+	if _, err := DB.Exec("INSERT INTO buckets(name,created_ms) VALUES(?,?)", "test-bucket", time.Now().UnixMilli()); err != nil {
+		log.Fatal("Error while inserting bucket test row ", err)
 	}
 
-	_, err = DB.Exec(`
-		CREATE TABLE IF NOT EXISTS bucket_object_auth_mac (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			bucket_id INTEGER NOT NULL,
-
-			created_ms UNSIGNED BIGINT NOT NULL,
-			selector UNSIGNED INTEGER NOT NULL,
-			secret BLOB(32) NOT NULL,
-
-			FOREIGN KEY (bucket_id) REFERENCES buckets (id) ON DELETE CASCADE,
-			UNIQUE (bucket_id, selector)
-		)
-	`)
-
-	if err != nil {
-		log.Fatal("Error while creating bucket object auth mac table ", err)
+	keyHash := sha512.Sum512([]byte("canttouchthiscanttouchthissomemrcanttouchthiscanttouchthissomemr"))
+	if _, err := DB.Exec("INSERT INTO bucket_auth_api_keys(bucket_id,name,created_ms,key_hashed) VALUES(?,?,?,?)", 1, "Test Key", time.Now().UnixMilli(), keyHash[:]); err != nil {
+		log.Fatal("Error while inserting bucket API key test row ", err)
 	}
 
-	// Test rows.
-
-	if config.DEBUG_MODE {
-		if _, err := DB.Exec("INSERT INTO buckets(name,created_ms) VALUES(?,?)", "test-bucket", time.Now().UnixMilli()); err != nil {
-			log.Fatal("Error while inserting bucket test row ", err)
-		}
-
-		keyHash := sha512.Sum512([]byte("canttouchthiscanttouchthissomemrcanttouchthiscanttouchthissomemr"))
-		if _, err := DB.Exec("INSERT INTO bucket_auth_api_keys(bucket_id,name,created_ms,key_hashed) VALUES(?,?,?,?)", 1, "Test Key", time.Now().UnixMilli(), keyHash[:]); err != nil {
-			log.Fatal("Error while inserting bucket API key test row ", err)
-		}
-
-		if _, err := DB.Exec("INSERT INTO bucket_object_auth_mac(bucket_id,selector,secret,created_ms) VALUES(?,?,?,?)", 1, 1, "supersecretobjectsecretthatis32b", time.Now().UnixMilli()); err != nil {
-			log.Fatal("Error while inserting bucket object auth MAC test row ", err)
-		}
+	if _, err := DB.Exec("INSERT INTO bucket_object_auth_mac(bucket_id,selector,secret,created_ms) VALUES(?,?,?,?)", 1, 1, "supersecretobjectsecretthatis32b", time.Now().UnixMilli()); err != nil {
+		log.Fatal("Error while inserting bucket object auth MAC test row ", err)
 	}
 }
 
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestGetBucketByNameBadAccessRule(t *testing.T) {
+	bucket, err := Admin.CreateBucket("bad-rule-bucket", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Inserted directly, as the admin API would refuse the expression.
+	if _, err := DB.Exec("INSERT INTO bucket_access_rules(bucket_id,priority,regex,action) VALUES(?,0,'(',0)", bucket.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every concurrent lookup must return the compile error rather than panicking or blocking.
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if cached, err := Bucket.GetBucketByName("bad-rule-bucket"); err == nil || cached != nil {
+				t.Errorf("lookup gave %v, %v, want an error", cached, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	nameBucketCacheLock.RLock()
+	_, loadLeft := nameBucketLoads["bad-rule-bucket"]
+	_, cachedMissing := missingBucketCache["bad-rule-bucket"]
+	nameBucketCacheLock.RUnlock()
+
+	if loadLeft || cachedMissing {
+		t.Errorf("failed load left state behind (load %v, missing %v)", loadLeft, cachedMissing)
+	}
+}
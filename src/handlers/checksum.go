@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zeebo/blake3"
+)
+
+// Checksums of an object's contents which the client supplied (and were verified) on top of the BLAKE3 digest every file has.
+// Any left nil were not supplied.
+type Checksums struct {
+	SHA256 []byte
+	CRC32C []byte
+}
+
+// The digests a client expects a request body to have, any left nil were not supplied.
+type ExpectedDigests struct {
+	Blake3 []byte
+	SHA256 []byte
+	CRC32C []byte
+}
+
+var ChecksumInvalidError = errors.New("Digest header is invalid")
+var ChecksumConflictError = errors.New("Digest headers disagree on the expected digest")
+var ChecksumMismatchError = errors.New("Received content does not match the expected digest")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Sets the expected digest of an algorithm, returning ChecksumConflictError if a different digest was already expected.
+func setExpectedDigest(expected *[]byte, digest []byte) error {
+	if *expected != nil && !bytes.Equal(*expected, digest) {
+		return ChecksumConflictError
+	}
+
+	*expected = digest
+	return nil
+}
+
+// Parses a "Content-Digest" or "Repr-Digest" header (RFC 9530) into the expected digests.
+// Algorithms other than BLAKE3, SHA-256 and CRC32C are ignored.
+func (expected *ExpectedDigests) parseDigestHeader(header []byte) error {
+	for _, member := range strings.Split(string(header), ",") {
+		// Parameters carry nothing of use here, so they are dropped.
+		member, _, _ = strings.Cut(member, ";")
+
+		algorithm, value, found := strings.Cut(strings.TrimSpace(member), "=")
+		if !found || len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return ChecksumInvalidError
+		}
+
+		digest, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			return ChecksumInvalidError
+		}
+
+		var target *[]byte
+		var size int
+		switch strings.ToLower(algorithm) {
+		case "blake3":
+			target, size = &expected.Blake3, 32
+		case "sha-256":
+			target, size = &expected.SHA256, sha256.Size
+		case "crc32c":
+			target, size = &expected.CRC32C, crc32.Size
+		default:
+			continue
+		}
+
+		if len(digest) != size {
+			return ChecksumInvalidError
+		}
+
+		if err := setExpectedDigest(target, digest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Extracts the digests the client expects the request body to have from the "Content-Digest", "Repr-Digest" and "X-SV-Expected-Blake3" (hex encoded) headers.
+// Objects are stored exactly as received, so the content and representation digests are treated the same.
+// Returns ChecksumInvalidError if a header can't be parsed, or ChecksumConflictError if the headers expect different digests for the same algorithm.
+func (ChecksumHandler) GetExpectedDigests(header *fasthttp.RequestHeader) (ExpectedDigests, error) {
+	var expected ExpectedDigests
+
+	for _, name := range []string{"Content-Digest", "Repr-Digest"} {
+		if value := header.Peek(name); len(value) != 0 {
+			if err := expected.parseDigestHeader(value); err != nil {
+				return ExpectedDigests{}, err
+			}
+		}
+	}
+
+	if value := header.Peek("X-SV-Expected-Blake3"); len(value) != 0 {
+		digest, err := hex.DecodeString(string(value))
+		if err != nil || len(digest) != 32 {
+			return ExpectedDigests{}, ChecksumInvalidError
+		}
+
+		if err := setExpectedDigest(&expected.Blake3, digest); err != nil {
+			return ExpectedDigests{}, err
+		}
+	}
+
+	return expected, nil
+}
+
+// Hashes a request body as it is received.
+// The BLAKE3 digest is always computed, the other algorithms only when the client expects a digest for them.
+type BodyHasher struct {
+	expected ExpectedDigests
+	blake3   *blake3.Hasher
+	sha256   hash.Hash
+	crc32c   hash.Hash32
+}
+
+func (ChecksumHandler) NewBodyHasher(expected ExpectedDigests) *BodyHasher {
+	hasher := BodyHasher{expected: expected, blake3: blake3.New()}
+	if expected.SHA256 != nil {
+		hasher.sha256 = sha256.New()
+	}
+	if expected.CRC32C != nil {
+		hasher.crc32c = crc32.New(crc32cTable)
+	}
+
+	return &hasher
+}
+
+// Adds the bytes to every digest being computed, never returning an error.
+func (h *BodyHasher) Write(p []byte) (int, error) {
+	h.blake3.Write(p)
+	if h.sha256 != nil {
+		h.sha256.Write(p)
+	}
+	if h.crc32c != nil {
+		h.crc32c.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// Returns the BLAKE3 digest of the body.
+func (h *BodyHasher) Digest() []byte {
+	return h.blake3.Sum(nil)
+}
+
+// Compares the digests of the body against the ones the client expects, returning the checksums which should be stored alongside the object.
+// Returns ChecksumMismatchError if any of the digests differ.
+func (h *BodyHasher) Verify() (Checksums, error) {
+	var checksums Checksums
+
+	if h.expected.Blake3 != nil && !bytes.Equal(h.Digest(), h.expected.Blake3) {
+		return Checksums{}, ChecksumMismatchError
+	}
+
+	if h.sha256 != nil {
+		if checksums.SHA256 = h.sha256.Sum(nil); !bytes.Equal(checksums.SHA256, h.expected.SHA256) {
+			return Checksums{}, ChecksumMismatchError
+		}
+	}
+
+	if h.crc32c != nil {
+		if checksums.CRC32C = h.crc32c.Sum(nil); !bytes.Equal(checksums.CRC32C, h.expected.CRC32C) {
+			return Checksums{}, ChecksumMismatchError
+		}
+	}
+
+	return checksums, nil
+}
+
+// Formats the "Repr-Digest" header (RFC 9530) of an object from its BLAKE3 digest and any stored checksums.
+func (ChecksumHandler) FormatReprDigest(digest []byte, checksums Checksums) string {
+	var b strings.Builder
+	b.WriteString("blake3=:" + base64.StdEncoding.EncodeToString(digest) + ":")
+
+	if checksums.SHA256 != nil {
+		b.WriteString(", sha-256=:" + base64.StdEncoding.EncodeToString(checksums.SHA256) + ":")
+	}
+	if checksums.CRC32C != nil {
+		b.WriteString(", crc32c=:" + base64.StdEncoding.EncodeToString(checksums.CRC32C) + ":")
+	}
+
+	return b.String()
+}
+
+type ChecksumHandler struct{}
+
+var Checksum = ChecksumHandler{}
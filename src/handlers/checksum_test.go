@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zeebo/blake3"
+)
+
+var checksumTestContent = []byte("checksum test content")
+
+// The digests of checksumTestContent.
+var (
+	checksumTestBlake3 = func() []byte { digest := blake3.Sum256(checksumTestContent); return digest[:] }()
+	checksumTestSHA256 = func() []byte { digest := sha256.Sum256(checksumTestContent); return digest[:] }()
+	checksumTestCRC32C = binary.BigEndian.AppendUint32(nil, crc32.Checksum(checksumTestContent, crc32cTable))
+)
+
+func b64(digest []byte) string {
+	return ":" + base64.StdEncoding.EncodeToString(digest) + ":"
+}
+
+func TestGetExpectedDigests(t *testing.T) {
+	otherSHA256 := sha256.Sum256([]byte("other"))
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected ExpectedDigests
+		err      error
+	}{
+		{name: "none", headers: map[string]string{}},
+		{name: "sha-256", headers: map[string]string{"Content-Digest": "sha-256=" + b64(checksumTestSHA256)}, expected: ExpectedDigests{SHA256: checksumTestSHA256}},
+		{name: "every algorithm", headers: map[string]string{"Content-Digest": "blake3=" + b64(checksumTestBlake3) + ", sha-256=" + b64(checksumTestSHA256) + ",crc32c=" + b64(checksumTestCRC32C)}, expected: ExpectedDigests{Blake3: checksumTestBlake3, SHA256: checksumTestSHA256, CRC32C: checksumTestCRC32C}},
+		{name: "algorithm case ignored", headers: map[string]string{"Repr-Digest": "SHA-256=" + b64(checksumTestSHA256)}, expected: ExpectedDigests{SHA256: checksumTestSHA256}},
+		{name: "parameters dropped", headers: map[string]string{"Content-Digest": "sha-256=" + b64(checksumTestSHA256) + ";note=1"}, expected: ExpectedDigests{SHA256: checksumTestSHA256}},
+		{name: "unknown algorithm ignored", headers: map[string]string{"Content-Digest": "md5=" + b64([]byte("0123456789abcdef")) + ", crc32c=" + b64(checksumTestCRC32C)}, expected: ExpectedDigests{CRC32C: checksumTestCRC32C}},
+		{name: "headers agreeing", headers: map[string]string{"Content-Digest": "sha-256=" + b64(checksumTestSHA256), "Repr-Digest": "sha-256=" + b64(checksumTestSHA256)}, expected: ExpectedDigests{SHA256: checksumTestSHA256}},
+		{name: "headers combined", headers: map[string]string{"Content-Digest": "sha-256=" + b64(checksumTestSHA256), "Repr-Digest": "crc32c=" + b64(checksumTestCRC32C)}, expected: ExpectedDigests{SHA256: checksumTestSHA256, CRC32C: checksumTestCRC32C}},
+		{name: "blake3 hex", headers: map[string]string{"X-SV-Expected-Blake3": hex.EncodeToString(checksumTestBlake3)}, expected: ExpectedDigests{Blake3: checksumTestBlake3}},
+		{name: "blake3 hex agreeing", headers: map[string]string{"X-SV-Expected-Blake3": hex.EncodeToString(checksumTestBlake3), "Content-Digest": "blake3=" + b64(checksumTestBlake3)}, expected: ExpectedDigests{Blake3: checksumTestBlake3}},
+
+		{name: "headers conflicting", headers: map[string]string{"Content-Digest": "sha-256=" + b64(checksumTestSHA256), "Repr-Digest": "sha-256=" + b64(otherSHA256[:])}, err: ChecksumConflictError},
+		{name: "members conflicting", headers: map[string]string{"Content-Digest": "sha-256=" + b64(checksumTestSHA256) + ", sha-256=" + b64(otherSHA256[:])}, err: ChecksumConflictError},
+		{name: "blake3 hex conflicting", headers: map[string]string{"X-SV-Expected-Blake3": hex.EncodeToString(checksumTestBlake3), "Content-Digest": "blake3=" + b64(checksumTestSHA256)}, err: ChecksumConflictError},
+
+		{name: "not base64", headers: map[string]string{"Content-Digest": "sha-256=:not base64:"}, err: ChecksumInvalidError},
+		{name: "not a byte sequence", headers: map[string]string{"Content-Digest": "sha-256=" + base64.StdEncoding.EncodeToString(checksumTestSHA256)}, err: ChecksumInvalidError},
+		{name: "no value", headers: map[string]string{"Content-Digest": "sha-256"}, err: ChecksumInvalidError},
+		{name: "wrong length", headers: map[string]string{"Content-Digest": "sha-256=" + b64(checksumTestCRC32C)}, err: ChecksumInvalidError},
+		{name: "invalid unknown algorithm", headers: map[string]string{"Content-Digest": "md5=nope"}, err: ChecksumInvalidError},
+		{name: "blake3 hex invalid", headers: map[string]string{"X-SV-Expected-Blake3": "xyz"}, err: ChecksumInvalidError},
+		{name: "blake3 hex wrong length", headers: map[string]string{"X-SV-Expected-Blake3": hex.EncodeToString(checksumTestCRC32C)}, err: ChecksumInvalidError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var header fasthttp.RequestHeader
+			for name, value := range test.headers {
+				header.Set(name, value)
+			}
+
+			expected, err := Checksum.GetExpectedDigests(&header)
+			if err != test.err {
+				t.Fatalf("parsing gave error %v, want %v", err, test.err)
+			}
+
+			if !bytes.Equal(expected.Blake3, test.expected.Blake3) || !bytes.Equal(expected.SHA256, test.expected.SHA256) || !bytes.Equal(expected.CRC32C, test.expected.CRC32C) {
+				t.Errorf("parsing gave %x, want %x", expected, test.expected)
+			}
+		})
+	}
+}
+
+func TestBodyHasherVerify(t *testing.T) {
+	mismatched := bytes.Clone(checksumTestSHA256)
+	mismatched[0] ^= 1
+
+	tests := []struct {
+		name      string
+		expected  ExpectedDigests
+		checksums Checksums
+		err       error
+	}{
+		{name: "nothing expected", expected: ExpectedDigests{}},
+		{name: "blake3 matches", expected: ExpectedDigests{Blake3: checksumTestBlake3}},
+		{name: "every algorithm matches", expected: ExpectedDigests{Blake3: checksumTestBlake3, SHA256: checksumTestSHA256, CRC32C: checksumTestCRC32C}, checksums: Checksums{SHA256: checksumTestSHA256, CRC32C: checksumTestCRC32C}},
+		{name: "blake3 mismatches", expected: ExpectedDigests{Blake3: checksumTestSHA256}, err: ChecksumMismatchError},
+		{name: "sha-256 mismatches", expected: ExpectedDigests{SHA256: mismatched}, err: ChecksumMismatchError},
+		{name: "crc32c mismatches", expected: ExpectedDigests{CRC32C: []byte{0, 0, 0, 0}}, err: ChecksumMismatchError},
+		{name: "one of several mismatches", expected: ExpectedDigests{SHA256: checksumTestSHA256, CRC32C: []byte{0, 0, 0, 0}}, err: ChecksumMismatchError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hasher := Checksum.NewBodyHasher(test.expected)
+
+			// Written in pieces, as bodies are received in chunks.
+			hasher.Write(checksumTestContent[:5])
+			hasher.Write(checksumTestContent[5:])
+
+			if !bytes.Equal(hasher.Digest(), checksumTestBlake3) {
+				t.Errorf("hasher gave BLAKE3 digest %x, want %x", hasher.Digest(), checksumTestBlake3)
+			}
+
+			checksums, err := hasher.Verify()
+			if err != test.err {
+				t.Fatalf("verifying gave error %v, want %v", err, test.err)
+			}
+
+			if !bytes.Equal(checksums.SHA256, test.checksums.SHA256) || !bytes.Equal(checksums.CRC32C, test.checksums.CRC32C) {
+				t.Errorf("verifying gave checksums %x, want %x", checksums, test.checksums)
+			}
+		})
+	}
+}
+
+func TestFormatReprDigest(t *testing.T) {
+	if header := Checksum.FormatReprDigest(checksumTestBlake3, Checksums{}); header != "blake3="+b64(checksumTestBlake3) {
+		t.Errorf("formatting gave %s", header)
+	}
+
+	// Stored checksums are served back in the same format they are accepted in.
+	header := Checksum.FormatReprDigest(checksumTestBlake3, Checksums{SHA256: checksumTestSHA256, CRC32C: checksumTestCRC32C})
+
+	var requestHeader fasthttp.RequestHeader
+	requestHeader.Set("Repr-Digest", header)
+	expected, err := Checksum.GetExpectedDigests(&requestHeader)
+	if err != nil || !bytes.Equal(expected.Blake3, checksumTestBlake3) || !bytes.Equal(expected.SHA256, checksumTestSHA256) || !bytes.Equal(expected.CRC32C, checksumTestCRC32C) {
+		t.Errorf("formatted header %s parsed back as %x (%v)", header, expected, err)
+	}
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+type PreconditionResult uint8
+
+const (
+	PreconditionPassed      PreconditionResult = iota // The request should proceed as if it were not conditional.
+	PreconditionNotModified                           // The client's copy is current, which can be relayed as a 304 status code.
+	PreconditionFailed                                // The state of the object doesn't match what the client expects, which can be relayed as a 412 status code.
+)
+
+// The headers which make a request conditional on the current state of an object.
+type Preconditions struct {
+	IfMatch           []byte
+	IfNoneMatch       []byte
+	IfModifiedSince   []byte
+	IfUnmodifiedSince []byte
+}
+
+// Extracts the precondition headers of a request.
+func (ConditionalHandler) GetPreconditions(header *fasthttp.RequestHeader) Preconditions {
+	return Preconditions{
+		IfMatch:           header.Peek(fasthttp.HeaderIfMatch),
+		IfNoneMatch:       header.Peek(fasthttp.HeaderIfNoneMatch),
+		IfModifiedSince:   header.Peek(fasthttp.HeaderIfModifiedSince),
+		IfUnmodifiedSince: header.Peek(fasthttp.HeaderIfUnmodifiedSince),
+	}
+}
+
+// Whether the request carries any of the precondition headers.
+func (p Preconditions) Any() bool {
+	return len(p.IfMatch) != 0 || len(p.IfNoneMatch) != 0 || len(p.IfModifiedSince) != 0 || len(p.IfUnmodifiedSince) != 0
+}
+
+// Evaluates the preconditions against the object in the order laid out by RFC 9110 section 13.2.2.
+// The object may be nil, meaning no object currently exists under the key.
+// Safe requests (GET and HEAD) which are only asking for a copy the client doesn't have yet result in PreconditionNotModified, any other request in PreconditionFailed.
+func (ConditionalHandler) Evaluate(p Preconditions, object *CachedObject, safe bool) PreconditionResult {
+	var etag []byte
+	var lastModified time.Time
+	if object != nil {
+		etag = object.File.ETag
+		lastModified = object.LastModified()
+	}
+
+	// If-Match takes precedence over If-Unmodified-Since, and must strongly match the current ETag.
+	if len(p.IfMatch) != 0 {
+		if object == nil || !matchesETagList(p.IfMatch, etag, false) {
+			return PreconditionFailed
+		}
+	} else if len(p.IfUnmodifiedSince) != 0 && object != nil {
+		// Invalid dates are ignored.
+		if date, err := fasthttp.ParseHTTPDate(p.IfUnmodifiedSince); err == nil && lastModified.Truncate(time.Second).After(date) {
+			return PreconditionFailed
+		}
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since, and only needs to weakly match the current ETag.
+	if len(p.IfNoneMatch) != 0 {
+		if object != nil && matchesETagList(p.IfNoneMatch, etag, true) {
+			if safe {
+				return PreconditionNotModified
+			}
+
+			return PreconditionFailed
+		}
+	} else if len(p.IfModifiedSince) != 0 && safe && object != nil {
+		if date, err := fasthttp.ParseHTTPDate(p.IfModifiedSince); err == nil && !lastModified.Truncate(time.Second).After(date) {
+			return PreconditionNotModified
+		}
+	}
+
+	return PreconditionPassed
+}
+
+// Determines whether a range request should be answered with the range, judging by its "If-Range" header.
+// The header holds either an ETag, which must strongly match, or the exact date the object was last modified.
+func (ConditionalHandler) RangeApplies(ifRange []byte, object *CachedObject) bool {
+	if len(ifRange) == 0 {
+		return true
+	}
+
+	if ifRange[0] == '"' || bytes.HasPrefix(ifRange, []byte("W/")) {
+		return matchesETagList(ifRange, object.File.ETag, false)
+	}
+
+	date, err := fasthttp.ParseHTTPDate(ifRange)
+	return err == nil && object.LastModified().Truncate(time.Second).Equal(date)
+}
+
+// Determines whether the ETag is in the comma separated list of entity tags, or the list is "*" (matching any ETag).
+// Weak comparison ignores the weakness indicator of the tags, while strong comparison never matches weak tags.
+// An invalid list never matches.
+func matchesETagList(list []byte, etag []byte, weak bool) bool {
+	list = bytes.TrimSpace(list)
+	if bytes.Equal(list, []byte("*")) {
+		return true
+	}
+
+	for len(list) != 0 {
+		// Skip over the separators between tags, which may be surrounded by whitespace.
+		list = bytes.TrimLeft(list, " \t,")
+		if len(list) == 0 {
+			break
+		}
+
+		isWeak := bytes.HasPrefix(list, []byte("W/"))
+		if isWeak {
+			list = list[2:]
+		}
+
+		if len(list) == 0 || list[0] != '"' {
+			return false
+		}
+
+		end := bytes.IndexByte(list[1:], '"')
+		if end == -1 {
+			return false
+		}
+
+		tag := list[:end+2]
+		list = list[end+2:]
+
+		if (weak || !isWeak) && bytes.Equal(tag, etag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type ConditionalHandler struct{}
+
+var Conditional = ConditionalHandler{}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// An object stored half way through a second, as the dates in headers only have second precision.
+var conditionalTestObject = &CachedObject{CreatedMs: 1700000000500, File: CachedFile{ETag: []byte(`"abc"`)}}
+
+func conditionalTestDate(offset time.Duration) []byte {
+	return fasthttp.AppendHTTPDate(nil, conditionalTestObject.LastModified().Add(offset))
+}
+
+func TestConditionalEvaluate(t *testing.T) {
+	lastModified := conditionalTestDate(0)
+	before := conditionalTestDate(-time.Hour)
+	after := conditionalTestDate(time.Hour)
+
+	tests := []struct {
+		name          string
+		preconditions Preconditions
+		missing       bool // Whether no object exists under the key.
+		unsafe        bool
+		result        PreconditionResult
+	}{
+		{name: "no preconditions", result: PreconditionPassed},
+
+		{name: "if-match matches", preconditions: Preconditions{IfMatch: []byte(`"abc"`)}, result: PreconditionPassed},
+		{name: "if-match list matches", preconditions: Preconditions{IfMatch: []byte(`"x", "abc"`)}, result: PreconditionPassed},
+		{name: "if-match differs", preconditions: Preconditions{IfMatch: []byte(`"x"`)}, result: PreconditionFailed},
+		{name: "if-match weak never matches", preconditions: Preconditions{IfMatch: []byte(`W/"abc"`)}, result: PreconditionFailed},
+		{name: "if-match any", preconditions: Preconditions{IfMatch: []byte("*")}, result: PreconditionPassed},
+		{name: "if-match any without object", preconditions: Preconditions{IfMatch: []byte("*")}, missing: true, result: PreconditionFailed},
+		{name: "if-match invalid", preconditions: Preconditions{IfMatch: []byte(`"abc`)}, result: PreconditionFailed},
+
+		{name: "if-unmodified-since before", preconditions: Preconditions{IfUnmodifiedSince: before}, result: PreconditionFailed},
+		{name: "if-unmodified-since same second", preconditions: Preconditions{IfUnmodifiedSince: lastModified}, result: PreconditionPassed},
+		{name: "if-unmodified-since after", preconditions: Preconditions{IfUnmodifiedSince: after}, result: PreconditionPassed},
+		{name: "if-unmodified-since invalid ignored", preconditions: Preconditions{IfUnmodifiedSince: []byte("yesterday")}, result: PreconditionPassed},
+		{name: "if-unmodified-since without object", preconditions: Preconditions{IfUnmodifiedSince: before}, missing: true, result: PreconditionPassed},
+		{name: "if-match overrides if-unmodified-since", preconditions: Preconditions{IfMatch: []byte(`"abc"`), IfUnmodifiedSince: before}, result: PreconditionPassed},
+
+		{name: "if-none-match matches", preconditions: Preconditions{IfNoneMatch: []byte(`"abc"`)}, result: PreconditionNotModified},
+		{name: "if-none-match matches unsafe", preconditions: Preconditions{IfNoneMatch: []byte(`"abc"`)}, unsafe: true, result: PreconditionFailed},
+		{name: "if-none-match weak matches", preconditions: Preconditions{IfNoneMatch: []byte(`W/"abc"`)}, result: PreconditionNotModified},
+		{name: "if-none-match differs", preconditions: Preconditions{IfNoneMatch: []byte(`"x"`)}, result: PreconditionPassed},
+		{name: "if-none-match any", preconditions: Preconditions{IfNoneMatch: []byte("*")}, result: PreconditionNotModified},
+		{name: "if-none-match any unsafe", preconditions: Preconditions{IfNoneMatch: []byte("*")}, unsafe: true, result: PreconditionFailed},
+		{name: "if-none-match any without object", preconditions: Preconditions{IfNoneMatch: []byte("*")}, missing: true, unsafe: true, result: PreconditionPassed},
+
+		{name: "if-modified-since same second", preconditions: Preconditions{IfModifiedSince: lastModified}, result: PreconditionNotModified},
+		{name: "if-modified-since after", preconditions: Preconditions{IfModifiedSince: after}, result: PreconditionNotModified},
+		{name: "if-modified-since before", preconditions: Preconditions{IfModifiedSince: before}, result: PreconditionPassed},
+		{name: "if-modified-since unsafe ignored", preconditions: Preconditions{IfModifiedSince: lastModified}, unsafe: true, result: PreconditionPassed},
+		{name: "if-modified-since invalid ignored", preconditions: Preconditions{IfModifiedSince: []byte("yesterday")}, result: PreconditionPassed},
+		{name: "if-modified-since without object", preconditions: Preconditions{IfModifiedSince: lastModified}, missing: true, result: PreconditionPassed},
+		{name: "if-none-match overrides if-modified-since", preconditions: Preconditions{IfNoneMatch: []byte(`"x"`), IfModifiedSince: lastModified}, result: PreconditionPassed},
+
+		{name: "if-match before if-none-match", preconditions: Preconditions{IfMatch: []byte(`"x"`), IfNoneMatch: []byte(`"abc"`)}, result: PreconditionFailed},
+		{name: "if-unmodified-since before if-none-match", preconditions: Preconditions{IfUnmodifiedSince: before, IfNoneMatch: []byte(`"abc"`)}, result: PreconditionFailed},
+		{name: "if-unmodified-since before if-modified-since", preconditions: Preconditions{IfUnmodifiedSince: before, IfModifiedSince: lastModified}, result: PreconditionFailed},
+		{name: "both pass then not modified", preconditions: Preconditions{IfMatch: []byte(`"abc"`), IfNoneMatch: []byte(`"abc"`)}, result: PreconditionNotModified},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			object := conditionalTestObject
+			if test.missing {
+				object = nil
+			}
+
+			if result := Conditional.Evaluate(test.preconditions, object, !test.unsafe); result != test.result {
+				t.Errorf("evaluating gave %d, want %d", result, test.result)
+			}
+		})
+	}
+}
+
+func TestConditionalRangeApplies(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifRange []byte
+		applies bool
+	}{
+		{name: "absent", ifRange: nil, applies: true},
+		{name: "etag matches", ifRange: []byte(`"abc"`), applies: true},
+		{name: "etag differs", ifRange: []byte(`"x"`), applies: false},
+		{name: "weak etag never matches", ifRange: []byte(`W/"abc"`), applies: false},
+		{name: "date matches", ifRange: conditionalTestDate(0), applies: true},
+		{name: "date differs", ifRange: conditionalTestDate(time.Hour), applies: false},
+		{name: "invalid", ifRange: []byte("yesterday"), applies: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if applies := Conditional.RangeApplies(test.ifRange, conditionalTestObject); applies != test.applies {
+				t.Errorf("range applies %v, want %v", applies, test.applies)
+			}
+		})
+	}
+}
+
+func TestMatchesETagList(t *testing.T) {
+	etag := []byte(`"abc"`)
+
+	tests := []struct {
+		list    string
+		weak    bool
+		matches bool
+	}{
+		{list: `"abc"`, matches: true},
+		{list: ` "x" ,	"abc" `, matches: true},
+		{list: `"x","abc"`, matches: true},
+		{list: `W/"abc"`, matches: false},
+		{list: `W/"abc"`, weak: true, matches: true},
+		{list: `"x", W/"abc"`, weak: true, matches: true},
+		{list: `*`, matches: true},
+		{list: `"ab"`, matches: false},
+		{list: `abc`, matches: false},
+		{list: `"abc`, matches: false},
+		{list: `"x", abc, "abc"`, matches: false},
+		{list: ``, matches: false},
+	}
+
+	for _, test := range tests {
+		if matches := matchesETagList([]byte(test.list), etag, test.weak); matches != test.matches {
+			t.Errorf("matching %q (weak %v) gave %v, want %v", test.list, test.weak, matches, test.matches)
+		}
+	}
+}
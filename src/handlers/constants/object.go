@@ -7,6 +7,7 @@ const (
 	ObjectUpdate                                  // Allows updating/replacing an existing object, but doesn't allow creating one.
 	ObjectDelete                                  // Allows deleting an existing object, but doesn't allow read or write access.
 	ObjectRead                                    // Allows read access to an object.
+	ObjectList                                    // Allows listing the keys and metadata of objects in a bucket, but doesn't allow reading them.
 
 	ObjectFlagBoundary_ // Placeholder for determining the end of the flags enum.
 
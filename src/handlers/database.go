@@ -3,6 +3,7 @@ package handlers
 import (
 	"database/sql"
 	"log"
+	"path"
 	"speedyvault/src/config"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -10,16 +11,24 @@ import (
 
 var DB *sql.DB
 
+// Builds the connection string of the database.
+// Foreign key enforcement is a per connection setting, so it's part of the connection string to apply to every connection the pool opens rather than only the one a pragma happens to run on.
+func getDatabaseDSN(dbPath string) string {
+	return dbPath + "?_busy_timeout=5000&_foreign_keys=1"
+}
+
 func (DatabaseHandler) InitDatabase() {
 	var dbPath string
-	if config.DEBUG_MODE {
+	if config.AppConfig.DebugMode {
 		dbPath = ":memory:"
+	} else if config.AppConfig.DatabasePath != "" {
+		dbPath = config.AppConfig.DatabasePath
 	} else {
-		dbPath = "database.sqlite"
+		dbPath = path.Join(config.AppConfig.DataDirectory, "database.sqlite")
 	}
 
 	var err error
-	DB, err = sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
+	DB, err = sql.Open("sqlite3", getDatabaseDSN(dbPath))
 	if err != nil {
 		log.Fatal("Could not open database connection", err)
 	}
@@ -29,20 +38,17 @@ func (DatabaseHandler) InitDatabase() {
 		DB.SetMaxOpenConns(1)
 	}
 
-	// Enable foreign key enforcement.
-	if _, err = DB.Exec("PRAGMA foreign_keys = ON;"); err != nil {
-		log.Fatal("Could not set foreign key pragma", err)
-	}
-
 	// Enable WAL mode.
 	if _, err = DB.Exec("PRAGMA journal_mode = WAL;"); err != nil {
 		log.Fatal("Could not set WAL mode pragma", err)
 	}
 
-	// Initialize the handler tables.
-	Bucket.InitDBTables()
-	File.InitDBTables()
-	Object.InitDBTables()
+	// Create or update the tables.
+	Database.RunMigrations()
+
+	if config.AppConfig.DebugMode {
+		Bucket.InsertDebugRows()
+	}
 
 	log.Println("Successfully initialized database connection and tables")
 }
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"path"
+	"testing"
+)
+
+func TestDatabaseForeignKeysOnEveryConnection(t *testing.T) {
+	db, err := sql.Open("sqlite3", getDatabaseDSN(path.Join(t.TempDir(), "database.sqlite")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Holding connections open forces the pool to open new ones.
+	ctx := context.Background()
+	for i := range 3 {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		var enabled bool
+		if err := conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&enabled); err != nil {
+			t.Fatal(err)
+		}
+
+		if !enabled {
+			t.Errorf("foreign keys disabled on connection %d", i)
+		}
+	}
+}
@@ -3,19 +3,150 @@ package handlers
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"log"
+	"os"
+	"path"
+	"speedyvault/src/config"
+	"speedyvault/src/system"
 	"time"
 )
 
 type CachedFile struct {
-	id     int64
-	Digest []byte // BLAKE3 digest of the file, doesn't have an explicit length in the type as the SQLite3 library doesn't support this.
-	Size   uint64
-	UID    string // The UID of the disk file that this file is housed under.
+	id       int64
+	bucketId int64  // The bucket which originally uploaded the file, which is not necessarily the bucket serving it when shared.
+	Digest   []byte // BLAKE3 digest of the file, doesn't have an explicit length in the type as the SQLite3 library doesn't support this.
+	Size     uint64
+	UID      string // The UID of the disk file that this file is housed under.
+	Shared   bool   // Whether the file lives in the shared content-addressed store rather than in the directory of its bucket.
+	sharded  bool   // Whether the file has been moved into the fan-out directory layout, only false for files predating it.
+
+	Corrupted bool // Whether the integrity scrubber found the contents on disk to no longer match the digest.
 
 	ETag []byte // Not part of the database, but a cached parsed strong ETag for use in HTTP responses.
 }
 
+// The location of the file on disk.
+func (f CachedFile) GetPath() string {
+	return getFilePath(f.bucketId, f.Shared, f.sharded, f.UID)
+}
+
+// Opens the file on disk for reading.
+// Files can be moved while the server is running, so other locations are tried if the file was moved in the meantime.
+func (f CachedFile) Open() (*os.File, error) {
+	file, err := os.Open(f.GetPath())
+	if err == nil || !os.IsNotExist(err) {
+		return file, err
+	}
+
+	// Files predating the fan-out layout are moved into it in the background.
+	if !f.sharded {
+		return os.Open(getFilePath(f.bucketId, f.Shared, true, f.UID))
+	}
+
+	// New files are only moved into place once committed, so a request that fetched the file right after may be early.
+	if file, err := os.Open(getStagingPath(f.UID)); err == nil || !os.IsNotExist(err) {
+		return file, err
+	}
+
+	return os.Open(f.GetPath())
+}
+
+// Files are sometimes handled without the bucket being cached (e.g. when collecting garbage), hence the separate function.
+// Shared files are deduplicated across every bucket using shared storage, so they can't live in the directory of any one bucket.
+func getFilePath(bucketId int64, shared bool, sharded bool, fileUid string) string {
+	fileName := fileUid
+	if sharded {
+		fileName = shardFileName(fileUid)
+	}
+
+	if shared {
+		return path.Join(getSharedObjectDirectory(), fileName)
+	}
+
+	return getBucketObjectPath(bucketId, fileName)
+}
+
+// Spreads files over two levels of directories named after the leading characters of their UID.
+// UIDs are random, so this keeps every directory to a manageable size even with millions of files.
+func shardFileName(fileUid string) string {
+	return path.Join(fileUid[0:1], fileUid[1:2], fileUid)
+}
+
+// Uploads are received into the staging directory and only moved to their final location once committed to the database.
+func getStagingPath(fileUid string) string {
+	return path.Join(config.AppConfig.DataDirectory, "staging", fileUid)
+}
+
+func (FileHandler) GetStagingPath(fileUid string) string {
+	return getStagingPath(fileUid)
+}
+
+// Flushes the contents of a newly written file to disk if the durability level requires it.
+func (FileHandler) SyncDiskFile(file *os.File) error {
+	if config.AppConfig.UploadDurability == config.DurabilityNone {
+		return nil
+	}
+
+	return file.Sync()
+}
+
+// Flushes the directory entry of a newly created or moved file to disk if the durability level requires it.
+func (FileHandler) SyncDiskFileDirectory(filePath string) error {
+	if config.AppConfig.UploadDurability != config.DurabilityFileAndDirectory {
+		return nil
+	}
+
+	return system.SyncDirectory(path.Dir(filePath))
+}
+
+// Moves a file committed to the database from the staging directory to its final location.
+// The rename is atomic, so the file is either fully in place or not there at all.
+// If moving fails, the file is still served from the staging directory until it is moved on the next start.
+func (FileHandler) CommitStagedFile(fileUid string, filePath string) error {
+	if err := os.MkdirAll(path.Dir(filePath), 0o755); err != nil {
+		log.Println("Problem while creating directory for staged file ", err)
+		return err
+	}
+
+	if err := os.Rename(getStagingPath(fileUid), filePath); err != nil {
+		log.Println("Problem while moving staged file into place ", err)
+		return err
+	}
+
+	if err := File.SyncDiskFileDirectory(filePath); err != nil {
+		log.Println("Problem while flushing directory of staged file ", err)
+		return err
+	}
+
+	return nil
+}
+
+// Creates a new file on disk for writing, alongside any of its parent directories which don't exist yet.
+func (FileHandler) CreateDiskFile(filePath string) (*os.File, error) {
+	if err := os.MkdirAll(path.Dir(filePath), 0o755); err != nil {
+		return nil, err
+	}
+
+	return os.Create(filePath)
+}
+
+// The directory on disk which houses the files of every bucket using shared storage.
+func getSharedObjectDirectory() string {
+	return path.Join(config.AppConfig.DataDirectory, "shared", "objects")
+}
+
+// Converts a file digest into a strong ETag ready to be used in HTTP responses.
+func (FileHandler) FormatETag(digest []byte) []byte {
+	etagSize := base64.RawURLEncoding.EncodedLen(len(digest)) + 2
+	etag := make([]byte, etagSize)
+	etag[0] = '"'
+	etag[etagSize-1] = '"'
+	base64.RawURLEncoding.Encode(etag[1:etagSize-1], digest)
+
+	return etag
+}
+
 // Modifies an existing database transaction to safely increment an existing file reference count, or create a new one.
 // Returns the ID of the existing or newly created file, a boolean indicating whether a file was reused or created, and an error.
 // Does not commit nor rollback on error or success.
@@ -27,9 +158,17 @@ func (FileHandler) DeduplicateOrCreateFile(tx *sql.Conn, ctx context.Context, bu
 	var isNew bool = false
 
 	// Attempt to update the refcount on an existing file with this digest.
-	err = tx.QueryRowContext(
-		ctx, "UPDATE files SET ref_count = ref_count + 1 WHERE id = (SELECT id FROM files WHERE digest = ? AND size = ? LIMIT 1) RETURNING id", digest, size,
-	).Scan(&fileId)
+	// Buckets using shared storage deduplicate against every shared file, other buckets only against their own files, as that's where the file must live on disk.
+	// Corrupted files are never reused, the new upload gets a file of its own instead.
+	if bucket.SharedStorage {
+		err = tx.QueryRowContext(
+			ctx, "UPDATE files SET ref_count = ref_count + 1 WHERE id = (SELECT id FROM files WHERE digest = ? AND size = ? AND shared = 1 AND corrupted = 0 LIMIT 1) RETURNING id", digest, size,
+		).Scan(&fileId)
+	} else {
+		err = tx.QueryRowContext(
+			ctx, "UPDATE files SET ref_count = ref_count + 1 WHERE id = (SELECT id FROM files WHERE digest = ? AND size = ? AND bucket_id = ? AND shared = 0 AND corrupted = 0 LIMIT 1) RETURNING id", digest, size, bucket.id,
+		).Scan(&fileId)
+	}
 	if err != nil && err != sql.ErrNoRows {
 		log.Println("Problem while updating file refcount ", err)
 		return 0, false, err
@@ -39,8 +178,8 @@ func (FileHandler) DeduplicateOrCreateFile(tx *sql.Conn, ctx context.Context, bu
 	if err == sql.ErrNoRows {
 		// Attempt to create a new file.
 		err = tx.QueryRowContext(
-			ctx, "INSERT INTO files(bucket_id,created_ms,digest,size,ref_count,uid) VALUES(?,?,?,?,?,?) RETURNING id",
-			bucket.id, time.Now().UnixMilli(), digest, size, 1, objectUid,
+			ctx, "INSERT INTO files(bucket_id,created_ms,digest,size,ref_count,uid,shared,sharded) VALUES(?,?,?,?,?,?,?,?) RETURNING id",
+			bucket.id, time.Now().UnixMilli(), digest, size, 1, objectUid, bucket.SharedStorage, true,
 		).Scan(&fileId)
 		if err != nil {
 			log.Println("Problem while inserting new file ", err)
@@ -53,34 +192,30 @@ func (FileHandler) DeduplicateOrCreateFile(tx *sql.Conn, ctx context.Context, bu
 	return fileId, isNew, nil
 }
 
-func (FileHandler) InitDBTables() {
-	var err error
-
-	_, err = DB.Exec(`
-		CREATE TABLE IF NOT EXISTS files (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			bucket_id INTEGER NOT NULL,
-			created_ms UNSIGNED BIGINT NOT NULL,
-
-			digest BLOB(32) NOT NULL,
-			size UNSIGNED INTEGER NOT NULL,
-			ref_count UNSIGNED INTEGER NOT NULL,
-			
-			uid VARCHAR(22) UNIQUE NOT NULL,
-
-			FOREIGN KEY (bucket_id) REFERENCES buckets (id) ON DELETE CASCADE,
-			UNIQUE (bucket_id, uid)
-		)
-	`)
+// Modifies an existing database transaction to decrement the reference count of a file, deleting the file row if it reaches zero.
+// Returns the path of the disk file if the file row was deleted (meaning it should be removed from disk after commit), otherwise an empty string, and an error.
+// Does not commit nor rollback on error or success.
+// MUST BE EXECUTED IN EITHER AN IMMEDIATE OR EXCLUSIVE TRANSACTION FOR SAFE ATOMIC OPERATION!
+func (FileHandler) DereferenceFile(tx *sql.Conn, ctx context.Context, fileId int64) (string, error) {
+	var refCount int64
+	if err := tx.QueryRowContext(ctx, "UPDATE files SET ref_count = ref_count - 1 WHERE id = ? RETURNING ref_count", fileId).Scan(&refCount); err != nil {
+		log.Println("Problem while decrementing file refcount ", err)
+		return "", err
+	}
 
-	if err != nil {
-		log.Fatal("Error while creating objects table ", err)
+	// The file is still referenced by other objects.
+	if refCount > 0 {
+		return "", nil
 	}
 
-	_, err = DB.Exec("CREATE INDEX idx_files_digest ON files(digest)")
-	if err != nil {
-		log.Fatal("Error while creating files digest index ", err)
+	// If the reference count reached 0, we can remove it entirely.
+	var orphanedFile CachedFile
+	if err := tx.QueryRowContext(ctx, "DELETE FROM files WHERE id = ? RETURNING bucket_id,uid,shared,sharded", fileId).Scan(&orphanedFile.bucketId, &orphanedFile.UID, &orphanedFile.Shared, &orphanedFile.sharded); err != nil {
+		log.Println("Problem while deleting zero-reference file ", err)
+		return "", err
 	}
+
+	return orphanedFile.GetPath(), nil
 }
 
 type FileHandler struct{}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"io"
+	"testing"
+)
+
+// Fetches the object under the key, failing the test if it doesn't exist.
+func getTestObject(t *testing.T, bucket *CachedBucket, key string) *CachedObject {
+	t.Helper()
+
+	object, err := Object.GetObjectByKey(bucket, []byte(key))
+	if err != nil || object == nil {
+		t.Fatalf("fetching object %s: %v", key, err)
+	}
+
+	return object
+}
+
+// Reads the whole file the object is served from.
+func readTestObject(t *testing.T, object *CachedObject) string {
+	t.Helper()
+
+	file, err := object.File.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+func TestDeduplicateFiles(t *testing.T) {
+	const content = "deduplicated content"
+
+	// Buckets without shared storage only deduplicate against their own files.
+	isolatedFirst := createTestBucket(t, "isolated-first", false)
+	isolatedSecond := createTestBucket(t, "isolated-second", false)
+	putTestObject(t, isolatedFirst, "/dedup", content)
+	putTestObject(t, isolatedFirst, "/dedup-again", content)
+	putTestObject(t, isolatedSecond, "/dedup", content)
+
+	isolated := getTestObject(t, isolatedFirst, "/dedup")
+	if getTestObject(t, isolatedFirst, "/dedup-again").File.id != isolated.File.id {
+		t.Error("identical content in the same bucket was stored twice")
+	}
+	if getTestObject(t, isolatedSecond, "/dedup").File.id == isolated.File.id {
+		t.Error("identical content was shared between buckets without shared storage")
+	}
+
+	// Buckets with shared storage deduplicate against each other.
+	uploader := createTestBucket(t, "shared-uploader", true)
+	sharer := createTestBucket(t, "shared-sharer", true)
+	putTestObject(t, uploader, "/dedup", content)
+	putTestObject(t, sharer, "/dedup", content)
+
+	shared := getTestObject(t, uploader, "/dedup")
+	if shared.File.id == isolated.File.id {
+		t.Error("identical content was shared between a shared and an isolated bucket")
+	}
+	if getTestObject(t, sharer, "/dedup").File.id != shared.File.id {
+		t.Fatal("identical content in shared buckets was stored twice")
+	}
+
+	// The file is handed over to the other bucket when the one it was uploaded through is deleted.
+	if err := Admin.DeleteBucket("shared-uploader"); err != nil {
+		t.Fatal(err)
+	}
+
+	remaining := getTestObject(t, sharer, "/dedup")
+	if remaining.File.id != shared.File.id || remaining.File.bucketId != sharer.id {
+		t.Errorf("shared file %d of bucket %d after deleting the uploading bucket, want file %d of bucket %d", remaining.File.id, remaining.File.bucketId, shared.File.id, sharer.id)
+	}
+	if readTestObject(t, remaining) != content {
+		t.Error("shared file content changed after deleting the uploading bucket")
+	}
+
+	var refCount int64
+	if err := DB.QueryRow("SELECT ref_count FROM files WHERE id = ?", shared.File.id).Scan(&refCount); err != nil || refCount != 1 {
+		t.Errorf("shared file has reference count %d (%v), want 1", refCount, err)
+	}
+
+	// Corrupted files are never reused, whether shared or not.
+	for _, corrupted := range []struct {
+		bucket *CachedBucket
+		fileId int64
+	}{{sharer, shared.File.id}, {isolatedFirst, isolated.File.id}} {
+		if _, err := DB.Exec("UPDATE files SET corrupted = 1 WHERE id = ?", corrupted.fileId); err != nil {
+			t.Fatal(err)
+		}
+
+		putTestObject(t, corrupted.bucket, "/dedup-after-corruption", content)
+
+		replacement := getTestObject(t, corrupted.bucket, "/dedup-after-corruption")
+		if replacement.File.id == corrupted.fileId || replacement.File.Corrupted {
+			t.Errorf("upload to bucket %d reused corrupted file %d", corrupted.bucket.id, corrupted.fileId)
+		}
+		if readTestObject(t, replacement) != content {
+			t.Errorf("upload to bucket %d replacing a corrupted file has the wrong content", corrupted.bucket.id)
+		}
+	}
+}
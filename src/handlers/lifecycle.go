@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Uploads currently in progress, which fasthttp can't clean up after if the server is forced to exit before they finish.
+// Downloads are streamed as response bodies, which fasthttp already waits on when shutting down.
+var activeTransfers sync.WaitGroup
+
+// Files which are still being written to, and would be left incomplete on disk if the server were to exit.
+var partialFilesLock sync.Mutex
+var partialFiles = make(map[string]struct{})
+
+// Background tasks (such as the garbage collector) still running, which need to stop before the database can be closed.
+var backgroundTasks sync.WaitGroup
+var backgroundTasksStop = make(chan struct{})
+var backgroundTasksStopOnce sync.Once
+
+// Returned by long running maintenance tasks that returned early because the server is shutting down.
+var BackgroundTaskStoppedError = errors.New("Background task was stopped")
+
+// Marks the start of an upload which should be allowed to finish before shutting down.
+// Every call MUST be followed by a call to EndTransfer once the transfer has finished.
+func (LifecycleHandler) BeginTransfer() {
+	activeTransfers.Add(1)
+}
+
+func (LifecycleHandler) EndTransfer() {
+	activeTransfers.Done()
+}
+
+// Marks a file as being written to, so that it can be removed if the server is forced to exit before it is complete.
+func (LifecycleHandler) TrackPartialFile(filePath string) {
+	partialFilesLock.Lock()
+	partialFiles[filePath] = struct{}{}
+	partialFilesLock.Unlock()
+}
+
+// Marks a file as complete (or already removed), undoing TrackPartialFile.
+func (LifecycleHandler) UntrackPartialFile(filePath string) {
+	partialFilesLock.Lock()
+	delete(partialFiles, filePath)
+	partialFilesLock.Unlock()
+}
+
+// Determines whether a file is still being written to.
+func (LifecycleHandler) IsPartialFile(filePath string) bool {
+	partialFilesLock.Lock()
+	_, isPartial := partialFiles[filePath]
+	partialFilesLock.Unlock()
+
+	return isPartial
+}
+
+// Waits for all active transfers to finish, returning false if they didn't finish before the timeout.
+func (LifecycleHandler) WaitForTransfers(timeout time.Duration) bool {
+	return waitWithTimeout(&activeTransfers, timeout)
+}
+
+// Runs the task in a background goroutine, which is expected to return once the stop channel is closed.
+func (LifecycleHandler) RunBackgroundTask(task func(stop <-chan struct{})) {
+	backgroundTasks.Add(1)
+	go func() {
+		defer backgroundTasks.Done()
+		task(backgroundTasksStop)
+	}()
+}
+
+// Determines whether background tasks have been asked to stop, so long running ones can return early.
+func (LifecycleHandler) IsStopping() bool {
+	select {
+	case <-backgroundTasksStop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Asks every background task to stop, without waiting for them to return.
+func (LifecycleHandler) StopBackgroundTasks() {
+	backgroundTasksStopOnce.Do(func() { close(backgroundTasksStop) })
+}
+
+// Waits for all background tasks to return after being stopped, returning false if they didn't return before the timeout.
+func (LifecycleHandler) WaitForBackgroundTasks(timeout time.Duration) bool {
+	return waitWithTimeout(&backgroundTasks, timeout)
+}
+
+func waitWithTimeout(group *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Removes every file which is still being written to, only to be used right before a forced exit.
+func (LifecycleHandler) RemovePartialFiles() {
+	partialFilesLock.Lock()
+	defer partialFilesLock.Unlock()
+
+	for filePath := range partialFiles {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Println("Problem while removing partial file "+filePath+" ", err)
+		}
+
+		delete(partialFiles, filePath)
+	}
+}
+
+type LifecycleHandler struct{}
+
+var Lifecycle = LifecycleHandler{}
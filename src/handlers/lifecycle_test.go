@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWaitForTransfers(t *testing.T) {
+	Lifecycle.BeginTransfer()
+	if Lifecycle.WaitForTransfers(10 * time.Millisecond) {
+		t.Error("waiting returned true while a transfer was active")
+	}
+
+	finished := make(chan bool)
+	go func() { finished <- Lifecycle.WaitForTransfers(time.Second) }()
+
+	Lifecycle.EndTransfer()
+	if !<-finished {
+		t.Error("waiting returned false after the transfer ended")
+	}
+
+	if !Lifecycle.WaitForTransfers(time.Second) {
+		t.Error("waiting returned false without any transfers")
+	}
+}
+
+// Stops the background tasks for the rest of the test, letting them be started again afterwards.
+func stopTestBackgroundTasks(t *testing.T) {
+	t.Cleanup(func() {
+		backgroundTasksStop = make(chan struct{})
+		backgroundTasksStopOnce = sync.Once{}
+	})
+
+	Lifecycle.StopBackgroundTasks()
+}
+
+func TestBackgroundTasks(t *testing.T) {
+	// Ticker based tasks only notice being stopped in-between runs.
+	release := make(chan struct{})
+	returned := make(chan struct{})
+	Lifecycle.RunBackgroundTask(func(stop <-chan struct{}) {
+		<-release
+		<-stop
+		close(returned)
+	})
+
+	putScrubTestFile(t, getTestBucket(t), "/lifecycle/scrubbed")
+
+	stopTestBackgroundTasks(t)
+	if !Lifecycle.IsStopping() {
+		t.Error("not stopping after stopping background tasks")
+	}
+
+	// Stopping again is harmless.
+	Lifecycle.StopBackgroundTasks()
+
+	if Lifecycle.WaitForBackgroundTasks(10 * time.Millisecond) {
+		t.Error("waiting returned true while a task was still running")
+	}
+
+	close(release)
+	if !Lifecycle.WaitForBackgroundTasks(time.Second) {
+		t.Fatal("waiting returned false after the task was stopped")
+	}
+
+	select {
+	case <-returned:
+	default:
+		t.Error("task didn't see the stop channel close")
+	}
+
+	// Long running maintenance returns early rather than holding up the shutdown.
+	if _, err := Maintenance.ScrubFiles(true); err != BackgroundTaskStoppedError {
+		t.Errorf("scrubbing while stopping gave %v, want BackgroundTaskStoppedError", err)
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"path"
+	"speedyvault/src/config"
+	"testing"
+
+	"github.com/zeebo/blake3"
+)
+
+// Every test runs against the debug database (in memory, with the test bucket) and a temporary data directory.
+func TestMain(m *testing.M) {
+	dataDirectory, err := os.MkdirTemp("", "speedyvault-handlers-")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config.AppConfig.DataDirectory = dataDirectory
+	config.AppConfig.DebugMode = true
+	config.AppConfig.UploadDurability = config.DurabilityNone
+	Database.InitDatabase()
+
+	code := m.Run()
+	os.RemoveAll(dataDirectory)
+	os.Exit(code)
+}
+
+// Returns the bucket inserted with the debug rows.
+func getTestBucket(t testing.TB) *CachedBucket {
+	t.Helper()
+
+	bucket, err := Bucket.GetBucketByName("test-bucket")
+	if err != nil || bucket == nil {
+		t.Fatalf("fetching test bucket: %v", err)
+	}
+
+	return bucket
+}
+
+// Creates a bucket through the admin handler, returning it as served to requests.
+func createTestBucket(t testing.TB, name string, sharedStorage bool) *CachedBucket {
+	t.Helper()
+
+	if _, err := Admin.CreateBucket(name, sharedStorage); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket, err := Bucket.GetBucketByName(name)
+	if err != nil || bucket == nil {
+		t.Fatalf("fetching bucket %s: %v", name, err)
+	}
+
+	return bucket
+}
+
+// Stores the content under the key the same way an upload does, creating or replacing the object.
+func putTestObject(t testing.TB, bucket *CachedBucket, key string, content string) {
+	t.Helper()
+
+	objectUid := Misc.NewRandomUID()
+	if err := os.MkdirAll(path.Dir(getStagingPath(objectUid)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(File.GetStagingPath(objectUid), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := blake3.Sum256([]byte(content))
+	if _, err := Object.PutObject(bucket, objectUid, sql.NullString{}, digest[:], Checksums{}, uint64(len(content)), []byte(key), true, true, Preconditions{}); err != nil {
+		t.Fatalf("storing object %s: %v", key, err)
+	}
+}
@@ -0,0 +1,898 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"os"
+	"path"
+	"speedyvault/src/config"
+	"time"
+
+	"github.com/zeebo/blake3"
+)
+
+type GarbageReport struct {
+	DryRun             bool
+	RemovedFiles       []string      // Paths of untracked files which were removed (or would be in a dry run).
+	SkippedRecentFiles int           // Untracked files which were left alone as they are younger than the grace period and could still be in use.
+	MissingFiles       []MissingFile // Files which are tracked in the database but don't exist on disk.
+}
+
+type MissingFile struct {
+	FileId   int64
+	BucketId int64
+	Path     string
+}
+
+// Runs a query returning a single string column, collecting the values into a set.
+func queryStringSet(query string, args ...any) (map[string]struct{}, error) {
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	set := make(map[string]struct{})
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+
+		set[value] = struct{}{}
+	}
+
+	return set, rows.Err()
+}
+
+// Removes every file in the directory (and its subdirectories) which isn't in the tracked set and is older than the grace period, recording the outcome in the report.
+func collectUntrackedFiles(directory string, tracked map[string]struct{}, report *GarbageReport) error {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		// A bucket which never had anything uploaded to it may not have the directory at all.
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	graceCutoff := time.Now().Add(-time.Duration(config.AppConfig.GarbageCollectionGraceMs) * time.Millisecond)
+	for _, entry := range entries {
+		// Object files are spread over fan-out directories.
+		if entry.IsDir() {
+			if err := collectUntrackedFiles(path.Join(directory, entry.Name()), tracked, report); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if _, isTracked := tracked[entry.Name()]; isTracked {
+			continue
+		}
+
+		filePath := path.Join(directory, entry.Name())
+
+		// Uploads write their file before it is tracked in the database, so recent files are given time to be committed.
+		info, err := entry.Info()
+		if err != nil {
+			log.Println("Problem while reading untracked file info ", err)
+			continue
+		}
+
+		if info.ModTime().After(graceCutoff) || Lifecycle.IsPartialFile(filePath) {
+			report.SkippedRecentFiles++
+			continue
+		}
+
+		if !report.DryRun {
+			if err := os.Remove(filePath); err != nil {
+				log.Println("Problem while removing untracked file ", err)
+				continue
+			}
+		}
+
+		report.RemovedFiles = append(report.RemovedFiles, filePath)
+	}
+
+	return nil
+}
+
+// Compares the data directory of every bucket against the database, removing files on disk which aren't tracked by anything
+// and reporting files tracked in the database which are missing on disk. Nothing is removed in a dry run.
+func (MaintenanceHandler) CollectGarbage(dryRun bool) (*GarbageReport, error) {
+	report := GarbageReport{DryRun: dryRun, RemovedFiles: []string{}, MissingFiles: []MissingFile{}}
+
+	bucketIds := []int64{}
+	rows, err := DB.Query("SELECT id FROM buckets")
+	if err != nil {
+		log.Println("Problem while fetching buckets from database ", err)
+		return nil, err
+	}
+
+	for rows.Next() {
+		var bucketId int64
+		if err := rows.Scan(&bucketId); err != nil {
+			rows.Close()
+			log.Println("Problem while reading buckets from database ", err)
+			return nil, err
+		}
+
+		bucketIds = append(bucketIds, bucketId)
+	}
+
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		log.Println("Problem while reading buckets from database ", err)
+		return nil, err
+	}
+
+	rows.Close()
+
+	for _, bucketId := range bucketIds {
+		bucket := CachedBucket{id: bucketId}
+
+		fileUids, err := queryStringSet("SELECT uid FROM files WHERE bucket_id = ? AND shared = 0", bucketId)
+		if err != nil {
+			log.Println("Problem while fetching files from database ", err)
+			return nil, err
+		}
+
+		if err := collectUntrackedFiles(path.Dir(getBucketObjectPath(bucketId, "_")), fileUids, &report); err != nil {
+			log.Println("Problem while collecting untracked object files ", err)
+			return nil, err
+		}
+
+		partUids, err := queryStringSet(
+			"SELECT multipart_upload_parts.uid FROM multipart_upload_parts INNER JOIN multipart_uploads ON multipart_upload_parts.upload_id = multipart_uploads.id WHERE multipart_uploads.bucket_id = ?", bucketId,
+		)
+		if err != nil {
+			log.Println("Problem while fetching multipart parts from database ", err)
+			return nil, err
+		}
+
+		if err := collectUntrackedFiles(path.Dir(bucket.GetPartPath("_")), partUids, &report); err != nil {
+			log.Println("Problem while collecting untracked part files ", err)
+			return nil, err
+		}
+	}
+
+	sharedFileUids, err := queryStringSet("SELECT uid FROM files WHERE shared = 1")
+	if err != nil {
+		log.Println("Problem while fetching shared files from database ", err)
+		return nil, err
+	}
+
+	if err := collectUntrackedFiles(getSharedObjectDirectory(), sharedFileUids, &report); err != nil {
+		log.Println("Problem while collecting untracked shared files ", err)
+		return nil, err
+	}
+
+	// Staged files which were committed are kept, as they are moved into place on the next start.
+	allFileUids, err := queryStringSet("SELECT uid FROM files")
+	if err != nil {
+		log.Println("Problem while fetching files from database ", err)
+		return nil, err
+	}
+
+	if err := collectUntrackedFiles(path.Dir(getStagingPath("_")), allFileUids, &report); err != nil {
+		log.Println("Problem while collecting untracked staged files ", err)
+		return nil, err
+	}
+
+	// Look for the opposite, files which the database expects to exist but don't.
+	fileRows, err := DB.Query("SELECT id,bucket_id,uid,shared,sharded FROM files")
+	if err != nil {
+		log.Println("Problem while fetching files from database ", err)
+		return nil, err
+	}
+	defer fileRows.Close()
+
+	for fileRows.Next() {
+		var missing MissingFile
+		var uid string
+		var shared, sharded bool
+		if err := fileRows.Scan(&missing.FileId, &missing.BucketId, &uid, &shared, &sharded); err != nil {
+			log.Println("Problem while reading files from database ", err)
+			return nil, err
+		}
+
+		missing.Path = getFilePath(missing.BucketId, shared, sharded, uid)
+		if _, err := os.Stat(missing.Path); os.IsNotExist(err) {
+			report.MissingFiles = append(report.MissingFiles, missing)
+		}
+	}
+
+	if err := fileRows.Err(); err != nil {
+		log.Println("Problem while reading files from database ", err)
+		return nil, err
+	}
+
+	return &report, nil
+}
+
+// Logs the outcome of a garbage collection, listing every affected file if verbose.
+func (report GarbageReport) Log(verbose bool) {
+	action := "Removed"
+	if report.DryRun {
+		action = "Would remove"
+	}
+
+	if verbose {
+		for _, filePath := range report.RemovedFiles {
+			log.Println(action, "untracked file", filePath)
+		}
+	}
+
+	// Missing files are always listed as they indicate data loss that needs looking into.
+	for _, missing := range report.MissingFiles {
+		log.Printf("File %d of bucket %d is tracked in the database but missing on disk at %s", missing.FileId, missing.BucketId, missing.Path)
+	}
+
+	log.Printf("Garbage collection finished: %s %d untracked files, skipped %d recent files, found %d missing files", action, len(report.RemovedFiles), report.SkippedRecentFiles, len(report.MissingFiles))
+}
+
+// Starts a background goroutine which periodically collects garbage from the data directory.
+func (MaintenanceHandler) StartGarbageCollector() {
+	Lifecycle.RunBackgroundTask(func(stop <-chan struct{}) {
+		ticker := time.NewTicker(time.Duration(config.AppConfig.GarbageCollectionIntervalMs) * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			report, err := Maintenance.CollectGarbage(false)
+			if err != nil {
+				log.Println("Problem while collecting garbage ", err)
+				continue
+			}
+
+			if len(report.RemovedFiles) != 0 || len(report.MissingFiles) != 0 {
+				report.Log(false)
+			}
+		}
+	})
+}
+
+type ScrubReport struct {
+	VerifiedFiles  int
+	VerifiedBytes  uint64
+	CorruptedFiles int // Files whose contents were found to no longer match their digest during this scrub.
+	MissingFiles   int // Files which are still tracked by the database but no longer exist on disk.
+}
+
+type CorruptedFile struct {
+	FileId         int64                 `json:"file_id"`
+	BucketId       int64                 `json:"bucket_id"`
+	Path           string                `json:"path"`
+	LastVerifiedMs int64                 `json:"last_verified_ms"`
+	Objects        []CorruptedFileObject `json:"objects"` // The objects served from this file, ordered by bucket and then key.
+}
+
+// An object served from a corrupted file, which can be in any bucket sharing the file.
+type CorruptedFileObject struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// Limits the rate at which the scrubber reads, by sleeping whenever it gets ahead of the configured rate.
+type scrubRateLimiter struct {
+	start     time.Time
+	bytesRead uint64
+}
+
+func (limiter *scrubRateLimiter) wait(bytesRead int) {
+	if config.AppConfig.ScrubBytesPerSecond == 0 {
+		return
+	}
+
+	limiter.bytesRead += uint64(bytesRead)
+
+	expected := time.Duration(float64(limiter.bytesRead) / float64(config.AppConfig.ScrubBytesPerSecond) * float64(time.Second))
+	if elapsed := time.Since(limiter.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+// Reads the file and determines whether its contents still match the digest.
+// Returns an error only if the file couldn't be checked for reasons other than corruption, which is one satisfying os.IsNotExist if the file doesn't exist,
+// or BackgroundTaskStoppedError if the server is shutting down.
+func verifyFileDigest(f CachedFile, limiter *scrubRateLimiter, buffer []byte) (bool, error) {
+	file, err := f.Open()
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	hasher := blake3.New()
+	for {
+		// Large files can take a while to read at the scrub rate.
+		if Lifecycle.IsStopping() {
+			return false, BackgroundTaskStoppedError
+		}
+
+		bytesRead, err := file.Read(buffer)
+		hasher.Write(buffer[:bytesRead])
+		limiter.wait(bytesRead)
+
+		if err == io.EOF {
+			break
+		}
+
+		// Read errors may well be temporary, so the file is only flagged once its contents are known not to match.
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return bytes.Equal(hasher.Sum(nil), f.Digest), nil
+}
+
+// Re-reads files and checks them against their digest, recording the outcome on the file rows.
+// Only files which haven't been verified within the scrub interval are checked, unless 'all' is set.
+func (MaintenanceHandler) ScrubFiles(all bool) (*ScrubReport, error) {
+	report := ScrubReport{}
+	limiter := scrubRateLimiter{start: time.Now()}
+	buffer := make([]byte, config.AppConfig.DownloadStreamingChunkSize)
+
+	dueBeforeMs := time.Now().UnixMilli() - config.AppConfig.ScrubIntervalMs
+	if all {
+		dueBeforeMs = time.Now().UnixMilli()
+	}
+
+	// Files are fetched in pages so the database isn't held up while files are being read.
+	var lastFileId int64 = 0
+	for {
+		rows, err := DB.Query(
+			"SELECT id,bucket_id,uid,shared,sharded,digest FROM files WHERE id > ? AND (last_verified_ms IS NULL OR last_verified_ms < ?) ORDER BY id ASC LIMIT 256",
+			lastFileId, dueBeforeMs,
+		)
+		if err != nil {
+			log.Println("Problem while fetching files to scrub from database ", err)
+			return nil, err
+		}
+
+		page := []CachedFile{}
+		for rows.Next() {
+			var file CachedFile
+			if err := rows.Scan(&file.id, &file.bucketId, &file.UID, &file.Shared, &file.sharded, &file.Digest); err != nil {
+				rows.Close()
+				log.Println("Problem while reading files to scrub from database ", err)
+				return nil, err
+			}
+
+			page = append(page, file)
+		}
+
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			log.Println("Problem while reading files to scrub from database ", err)
+			return nil, err
+		}
+
+		rows.Close()
+
+		if len(page) == 0 {
+			break
+		}
+
+		for _, file := range page {
+			if Lifecycle.IsStopping() {
+				return nil, BackgroundTaskStoppedError
+			}
+
+			lastFileId = file.id
+
+			intact, err := verifyFileDigest(file, &limiter, buffer)
+			if os.IsNotExist(err) {
+				// The file may have been moved or deleted since the page was fetched, so it's only missing if the row still says it should exist.
+				currentFile, lookupErr := getScrubbedFile(file.id)
+				if lookupErr != nil {
+					return nil, lookupErr
+				}
+
+				if currentFile == nil {
+					continue
+				}
+
+				file = *currentFile
+				intact, err = verifyFileDigest(file, &limiter, buffer)
+			}
+
+			if err == BackgroundTaskStoppedError {
+				return nil, err
+			}
+
+			missing := os.IsNotExist(err)
+			if err != nil && !missing {
+				log.Println("Problem while verifying file "+file.GetPath()+", skipping until the next scrub ", err)
+				continue
+			}
+
+			// Missing files are flagged alongside corrupted ones as neither can be served.
+			// The file may have been deleted in the meantime, in which case this simply doesn't update anything.
+			if _, err := DB.Exec("UPDATE files SET last_verified_ms = ?, corrupted = ? WHERE id = ?", time.Now().UnixMilli(), !intact, file.id); err != nil {
+				log.Println("Problem while recording file verification in database ", err)
+				return nil, err
+			}
+
+			report.VerifiedFiles++
+			if missing {
+				report.MissingFiles++
+				log.Printf("File %d of bucket %d is missing from %s", file.id, file.bucketId, file.GetPath())
+			} else if !intact {
+				report.CorruptedFiles++
+				log.Printf("File %d of bucket %d failed integrity verification at %s", file.id, file.bucketId, file.GetPath())
+			}
+		}
+	}
+
+	report.VerifiedBytes = limiter.bytesRead
+	return &report, nil
+}
+
+// Fetches the current state of a file being scrubbed, returning nil if it has been deleted.
+func getScrubbedFile(fileId int64) (*CachedFile, error) {
+	file := CachedFile{id: fileId}
+	if err := DB.QueryRow("SELECT bucket_id,uid,shared,sharded,digest FROM files WHERE id = ?", fileId).Scan(&file.bucketId, &file.UID, &file.Shared, &file.sharded, &file.Digest); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		log.Println("Problem while fetching scrubbed file from database ", err)
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// Fetches every file currently flagged as corrupted alongside the keys of the objects affected.
+func (MaintenanceHandler) GetCorruptedFiles() ([]CorruptedFile, error) {
+	rows, err := DB.Query("SELECT id,bucket_id,uid,shared,sharded,last_verified_ms FROM files WHERE corrupted = 1 ORDER BY id ASC")
+	if err != nil {
+		log.Println("Problem while fetching corrupted files from database ", err)
+		return nil, err
+	}
+
+	corruptedFiles := []CorruptedFile{}
+	for rows.Next() {
+		var file CorruptedFile
+		var uid string
+		var shared, sharded bool
+		var lastVerifiedMs sql.NullInt64
+		if err := rows.Scan(&file.FileId, &file.BucketId, &uid, &shared, &sharded, &lastVerifiedMs); err != nil {
+			rows.Close()
+			log.Println("Problem while reading corrupted files from database ", err)
+			return nil, err
+		}
+
+		file.Path = getFilePath(file.BucketId, shared, sharded, uid)
+		file.LastVerifiedMs = lastVerifiedMs.Int64
+		corruptedFiles = append(corruptedFiles, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		log.Println("Problem while reading corrupted files from database ", err)
+		return nil, err
+	}
+
+	rows.Close()
+
+	for i := range corruptedFiles {
+		objects, err := getCorruptedFileObjects(corruptedFiles[i].FileId)
+		if err != nil {
+			log.Println("Problem while fetching objects of corrupted file from database ", err)
+			return nil, err
+		}
+
+		corruptedFiles[i].Objects = objects
+	}
+
+	return corruptedFiles, nil
+}
+
+func getCorruptedFileObjects(fileId int64) ([]CorruptedFileObject, error) {
+	rows, err := DB.Query(
+		"SELECT buckets.name,CAST(objects.key AS TEXT) FROM objects INNER JOIN buckets ON objects.bucket_id = buckets.id WHERE objects.file_id = ? ORDER BY buckets.name ASC, objects.key ASC",
+		fileId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects := []CorruptedFileObject{}
+	for rows.Next() {
+		var object CorruptedFileObject
+		if err := rows.Scan(&object.Bucket, &object.Key); err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, object)
+	}
+
+	return objects, rows.Err()
+}
+
+// Starts a background goroutine which periodically verifies files that are due for verification.
+func (MaintenanceHandler) StartScrubber() {
+	Lifecycle.RunBackgroundTask(func(stop <-chan struct{}) {
+		// Files are checked far more often than the interval itself, so that each file is verified close to when it becomes due.
+		ticker := time.NewTicker(time.Duration(min(config.AppConfig.ScrubIntervalMs, 3600000)) * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			report, err := Maintenance.ScrubFiles(false)
+			if err == BackgroundTaskStoppedError {
+				return
+			}
+
+			if err != nil {
+				log.Println("Problem while scrubbing files ", err)
+				continue
+			}
+
+			if report.VerifiedFiles != 0 {
+				report.Log()
+			}
+		}
+	})
+}
+
+func (report ScrubReport) Log() {
+	log.Printf("Scrub finished: verified %d files (%d bytes), %d failed verification, %d missing", report.VerifiedFiles, report.VerifiedBytes, report.CorruptedFiles, report.MissingFiles)
+}
+
+type RefCountReport struct {
+	DryRun       bool
+	Mismatches   []RefCountMismatch
+	RemovedFiles int // Files which were removed as nothing references them (or would be in a dry run).
+}
+
+type RefCountMismatch struct {
+	FileId   int64
+	BucketId int64
+	Path     string
+	Stored   int64 // The reference count stored on the file row.
+	Actual   int64 // The amount of objects actually referencing the file.
+}
+
+// Recomputes the reference count of every file from the objects referencing it, correcting any that have drifted
+// and removing files which nothing references anymore. Nothing is changed in a dry run.
+func (MaintenanceHandler) AuditReferenceCounts(dryRun bool) (report *RefCountReport, errReturn error) {
+	report = &RefCountReport{DryRun: dryRun, Mismatches: []RefCountMismatch{}}
+
+	dbCtx := context.Background()
+	dbConn, err := DB.Conn(dbCtx)
+	if err != nil {
+		log.Println("Problem while acquiring scoped database session ", err)
+		return nil, err
+	}
+	defer dbConn.Close()
+
+	// We need to acquire an immediate lock here so that no uploads or deletions change the counts while they're being fixed.
+	if _, err := dbConn.ExecContext(dbCtx, "BEGIN IMMEDIATE TRANSACTION"); err != nil {
+		log.Println("Problem while acquiring immediate transaction lock ", err)
+		return nil, err
+	}
+
+	rollback := func() {
+		if _, err := dbConn.ExecContext(dbCtx, "ROLLBACK"); err != nil {
+			log.Println("Problem while rolling back database transaction ", err)
+		}
+	}
+
+	rows, err := dbConn.QueryContext(dbCtx, `
+		SELECT id, bucket_id, uid, shared, sharded, ref_count, actual_ref_count FROM (
+			SELECT files.id, files.bucket_id, files.uid, files.shared, files.sharded, files.ref_count, (SELECT COUNT(*) FROM objects WHERE objects.file_id = files.id) AS actual_ref_count FROM files
+		) WHERE ref_count != actual_ref_count
+	`)
+	if err != nil {
+		rollback()
+		log.Println("Problem while computing file reference counts ", err)
+		return nil, err
+	}
+
+	for rows.Next() {
+		var mismatch RefCountMismatch
+		var uid string
+		var shared, sharded bool
+		if err := rows.Scan(&mismatch.FileId, &mismatch.BucketId, &uid, &shared, &sharded, &mismatch.Stored, &mismatch.Actual); err != nil {
+			rows.Close()
+			rollback()
+			log.Println("Problem while reading file reference counts ", err)
+			return nil, err
+		}
+
+		mismatch.Path = getFilePath(mismatch.BucketId, shared, sharded, uid)
+		report.Mismatches = append(report.Mismatches, mismatch)
+	}
+
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		rollback()
+		log.Println("Problem while reading file reference counts ", err)
+		return nil, err
+	}
+
+	rows.Close()
+
+	orphanedFilePaths := []string{}
+	for _, mismatch := range report.Mismatches {
+		if mismatch.Actual == 0 {
+			report.RemovedFiles++
+			orphanedFilePaths = append(orphanedFilePaths, mismatch.Path)
+		}
+
+		if dryRun {
+			continue
+		}
+
+		if mismatch.Actual == 0 {
+			_, err = dbConn.ExecContext(dbCtx, "DELETE FROM files WHERE id = ?", mismatch.FileId)
+		} else {
+			_, err = dbConn.ExecContext(dbCtx, "UPDATE files SET ref_count = ? WHERE id = ?", mismatch.Actual, mismatch.FileId)
+		}
+
+		if err != nil {
+			rollback()
+			log.Println("Problem while repairing file reference count ", err)
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		rollback()
+		return report, nil
+	}
+
+	// We're clear!
+	if _, err := dbConn.ExecContext(dbCtx, "COMMIT"); err != nil {
+		// Any errors are ignored here since there's not much we can do about it.
+		dbConn.ExecContext(dbCtx, "ROLLBACK")
+
+		log.Println("Problem while committing database transaction ", err)
+		return nil, err
+	}
+
+	// We don't want to do potentially expensive IO operations while keeping the tables locked, so we do it after.
+	for _, filePath := range orphanedFilePaths {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Println("Problem while deleting unreferenced file ", err)
+		}
+	}
+
+	return report, nil
+}
+
+func (report RefCountReport) Log() {
+	action, removedAction := "Repaired", "removed"
+	if report.DryRun {
+		action, removedAction = "Would repair", "would be removed"
+	}
+
+	for _, mismatch := range report.Mismatches {
+		log.Printf("%s file %d of bucket %d: stored reference count %d, actual %d", action, mismatch.FileId, mismatch.BucketId, mismatch.Stored, mismatch.Actual)
+	}
+
+	log.Printf("Reference count audit finished: %d mismatched files, %d unreferenced files %s", len(report.Mismatches), report.RemovedFiles, removedAction)
+}
+
+// Finishes moving files which were committed to the database but still staged when the server stopped, and removes
+// the staged files of uploads which never got committed. Must be run before any uploads are accepted.
+// Files modified within the garbage collection grace period are left alone, as they may belong to uploads still in progress
+// on another process using the same data directory (uncommitted ones are removed by the garbage collector once they expire).
+func (MaintenanceHandler) RecoverStagedFiles() error {
+	entries, err := os.ReadDir(path.Dir(getStagingPath("_")))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		log.Println("Problem while reading staging directory ", err)
+		return err
+	}
+
+	graceCutoff := time.Now().Add(-time.Duration(config.AppConfig.GarbageCollectionGraceMs) * time.Millisecond)
+	movedFiles, removedFiles := 0, 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		// The file may have been committed and moved since the directory was read.
+		info, err := entry.Info()
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println("Problem while reading staged file information ", err)
+			}
+
+			continue
+		}
+
+		if info.ModTime().After(graceCutoff) {
+			continue
+		}
+
+		file := CachedFile{UID: entry.Name()}
+		if err := DB.QueryRow("SELECT bucket_id,shared,sharded FROM files WHERE uid = ?", file.UID).Scan(&file.bucketId, &file.Shared, &file.sharded); err != nil {
+			if err != sql.ErrNoRows {
+				log.Println("Problem while fetching staged file from database ", err)
+				return err
+			}
+
+			if err := os.Remove(getStagingPath(file.UID)); err != nil {
+				log.Println("Problem while removing uncommitted staged file ", err)
+				continue
+			}
+
+			removedFiles++
+			continue
+		}
+
+		if err := File.CommitStagedFile(file.UID, file.GetPath()); err != nil {
+			continue
+		}
+
+		movedFiles++
+	}
+
+	if movedFiles != 0 || removedFiles != 0 {
+		log.Printf("Recovered staging directory: moved %d committed files into place, removed %d uncommitted files", movedFiles, removedFiles)
+	}
+
+	return nil
+}
+
+type LayoutMigrationReport struct {
+	MovedFiles   int
+	MissingFiles int // Files which were at neither their old nor their new location.
+}
+
+// Moves every file predating the fan-out directory layout into it, one file at a time so the server can keep running meanwhile.
+// Requests which looked up a file before it was moved fall back to its new location when opening it.
+func (MaintenanceHandler) MigrateFileLayout() (*LayoutMigrationReport, error) {
+	report := LayoutMigrationReport{}
+
+	type pendingFile struct {
+		id       int64
+		bucketId int64
+		uid      string
+		shared   bool
+	}
+
+	// Files are fetched in pages so the database isn't held up while files are being moved.
+	var lastFileId int64 = 0
+	for {
+		rows, err := DB.Query("SELECT id,bucket_id,uid,shared FROM files WHERE id > ? AND sharded = 0 ORDER BY id ASC LIMIT 256", lastFileId)
+		if err != nil {
+			log.Println("Problem while fetching files to migrate from database ", err)
+			return nil, err
+		}
+
+		page := []pendingFile{}
+		for rows.Next() {
+			var file pendingFile
+			if err := rows.Scan(&file.id, &file.bucketId, &file.uid, &file.shared); err != nil {
+				rows.Close()
+				log.Println("Problem while reading files to migrate from database ", err)
+				return nil, err
+			}
+
+			page = append(page, file)
+		}
+
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			log.Println("Problem while reading files to migrate from database ", err)
+			return nil, err
+		}
+
+		rows.Close()
+
+		if len(page) == 0 {
+			break
+		}
+
+		for _, file := range page {
+			if Lifecycle.IsStopping() {
+				return nil, BackgroundTaskStoppedError
+			}
+
+			lastFileId = file.id
+			oldPath := getFilePath(file.bucketId, file.shared, false, file.uid)
+			newPath := getFilePath(file.bucketId, file.shared, true, file.uid)
+
+			if err := os.MkdirAll(path.Dir(newPath), 0o755); err != nil {
+				log.Println("Problem while creating fan-out directory ", err)
+				return nil, err
+			}
+
+			if err := os.Rename(oldPath, newPath); err != nil {
+				if !os.IsNotExist(err) {
+					log.Println("Problem while moving file into fan-out directory ", err)
+					return nil, err
+				}
+
+				// A previous migration may have been interrupted after moving the file, in which case only the database needs updating.
+				if _, err := os.Stat(newPath); err != nil {
+					report.MissingFiles++
+					log.Printf("File %d of bucket %d is missing from %s, skipping", file.id, file.bucketId, oldPath)
+					continue
+				}
+			}
+
+			result, err := DB.Exec("UPDATE files SET sharded = 1 WHERE id = ?", file.id)
+			if err != nil {
+				log.Println("Problem while recording file layout in database ", err)
+				return nil, err
+			}
+
+			// The file was deleted while it was being moved, so its removal looked for it at the old location.
+			if affected, _ := result.RowsAffected(); affected == 0 {
+				if err := os.Remove(newPath); err != nil && !os.IsNotExist(err) {
+					log.Println("Problem while deleting moved file which was deleted meanwhile ", err)
+				}
+
+				continue
+			}
+
+			report.MovedFiles++
+		}
+	}
+
+	return &report, nil
+}
+
+// Migrates files predating the fan-out directory layout in the background, if there are any.
+func (MaintenanceHandler) StartLayoutMigration() {
+	var pending bool
+	if err := DB.QueryRow("SELECT EXISTS(SELECT 1 FROM files WHERE sharded = 0)").Scan(&pending); err != nil {
+		log.Println("Problem while checking for files to migrate ", err)
+		return
+	}
+
+	if !pending {
+		return
+	}
+
+	Lifecycle.RunBackgroundTask(func(<-chan struct{}) {
+		log.Println("Moving existing files into the fan-out directory layout in the background")
+
+		report, err := Maintenance.MigrateFileLayout()
+		if err == BackgroundTaskStoppedError {
+			log.Println("File layout migration stopped by shutdown, it will be resumed on the next start")
+			return
+		}
+
+		if err != nil {
+			log.Println("Problem while migrating file layout, it will be resumed on the next start ", err)
+			return
+		}
+
+		report.Log()
+	})
+}
+
+func (report LayoutMigrationReport) Log() {
+	log.Printf("File layout migration finished: moved %d files, %d were missing", report.MovedFiles, report.MissingFiles)
+}
+
+type MaintenanceHandler struct{}
+
+var Maintenance = MaintenanceHandler{}
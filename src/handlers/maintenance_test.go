@@ -0,0 +1,535 @@
+package handlers
+
+import (
+	"database/sql"
+	"os"
+	"path"
+	"slices"
+	"speedyvault/src/config"
+	"testing"
+	"time"
+)
+
+// Stores an object and returns the file it is served from.
+func putScrubTestFile(t *testing.T, bucket *CachedBucket, key string) CachedFile {
+	t.Helper()
+
+	putTestObject(t, bucket, key, "scrub test "+key)
+	object, err := Object.GetObjectByKey(bucket, []byte(key))
+	if err != nil || object == nil {
+		t.Fatalf("fetching object %s: %v", key, err)
+	}
+
+	return object.File
+}
+
+func TestScrubFiles(t *testing.T) {
+	bucket := getTestBucket(t)
+
+	// Anything left behind by other tests is verified first, so only the files below are checked afterwards.
+	if _, err := Maintenance.ScrubFiles(true); err != nil {
+		t.Fatal(err)
+	}
+
+	intact := putScrubTestFile(t, bucket, "/scrub/intact")
+	missing := putScrubTestFile(t, bucket, "/scrub/missing")
+	corrupted := putScrubTestFile(t, bucket, "/scrub/corrupted")
+	staged := putScrubTestFile(t, bucket, "/scrub/staged")
+
+	if err := os.Remove(missing.GetPath()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(corrupted.GetPath(), []byte("scrub test /scrub/corrupteD"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A committed file which hasn't been moved out of staging yet is still found.
+	if err := os.Rename(staged.GetPath(), getStagingPath(staged.UID)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files which were never verified are due regardless of the interval, unlike the ones verified above.
+	report, err := Maintenance.ScrubFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.VerifiedFiles != 4 || report.CorruptedFiles != 1 || report.MissingFiles != 1 {
+		t.Errorf("scrub reported %d verified, %d corrupted and %d missing, want 4, 1 and 1", report.VerifiedFiles, report.CorruptedFiles, report.MissingFiles)
+	}
+
+	for _, file := range []struct {
+		file      CachedFile
+		corrupted bool
+	}{{intact, false}, {missing, true}, {corrupted, true}, {staged, false}} {
+		var flagged bool
+		if err := DB.QueryRow("SELECT corrupted FROM files WHERE id = ?", file.file.id).Scan(&flagged); err != nil {
+			t.Fatal(err)
+		}
+
+		if flagged != file.corrupted {
+			t.Errorf("file %s flagged as corrupted %v, want %v", file.file.UID, flagged, file.corrupted)
+		}
+	}
+}
+
+func TestScrubFilesReadError(t *testing.T) {
+	bucket := getTestBucket(t)
+	if _, err := Maintenance.ScrubFiles(true); err != nil {
+		t.Fatal(err)
+	}
+
+	file := putScrubTestFile(t, bucket, "/scrub/unreadable")
+	content, err := os.ReadFile(file.GetPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening a directory works, but reading from it doesn't.
+	if err := os.Remove(file.GetPath()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(file.GetPath(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Maintenance.ScrubFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var corrupted bool
+	var lastVerifiedMs sql.NullInt64
+	if err := DB.QueryRow("SELECT corrupted,last_verified_ms FROM files WHERE id = ?", file.id).Scan(&corrupted, &lastVerifiedMs); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.VerifiedFiles != 0 || corrupted || lastVerifiedMs.Valid {
+		t.Errorf("unreadable file was recorded as verified (%d verified, corrupted %v, last verified %v)", report.VerifiedFiles, corrupted, lastVerifiedMs)
+	}
+
+	// Once readable again, the file is verified on the next scrub.
+	if err := os.Remove(file.GetPath()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file.GetPath(), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Maintenance.ScrubFiles(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.VerifiedFiles != 1 || report.CorruptedFiles != 0 {
+		t.Errorf("scrub reported %d verified and %d corrupted, want 1 and 0", report.VerifiedFiles, report.CorruptedFiles)
+	}
+}
+
+func TestGetCorruptedFiles(t *testing.T) {
+	// Objects under the same key in different buckets can share a corrupted file.
+	first := createTestBucket(t, "corrupted-first", true)
+	second := createTestBucket(t, "corrupted-second", true)
+	for _, object := range []struct {
+		bucket *CachedBucket
+		key    string
+	}{{second, "/same"}, {first, "/same"}, {first, "/other"}, {second, "/another"}} {
+		putTestObject(t, object.bucket, object.key, "shared corrupted content")
+	}
+
+	shared, err := Object.GetObjectByKey(first, []byte("/same"))
+	if err != nil || shared == nil {
+		t.Fatalf("fetching object: %v", err)
+	}
+
+	if _, err := DB.Exec("UPDATE files SET corrupted = 1 WHERE id = ?", shared.File.id); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Exec("UPDATE files SET corrupted = 0 WHERE id = ?", shared.File.id) })
+
+	corruptedFiles, err := Maintenance.GetCorruptedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found *CorruptedFile
+	for i := range corruptedFiles {
+		if corruptedFiles[i].FileId == shared.File.id {
+			found = &corruptedFiles[i]
+		}
+	}
+	if found == nil {
+		t.Fatal("corrupted file not listed")
+	}
+
+	expected := []CorruptedFileObject{
+		{Bucket: "corrupted-first", Key: "/other"},
+		{Bucket: "corrupted-first", Key: "/same"},
+		{Bucket: "corrupted-second", Key: "/another"},
+		{Bucket: "corrupted-second", Key: "/same"},
+	}
+	if !slices.Equal(found.Objects, expected) {
+		t.Errorf("corrupted file lists objects %+v, want %+v", found.Objects, expected)
+	}
+}
+
+// Writes a file (alongside its directory), last modified the given time ago.
+func writeAgedTestFile(t *testing.T, filePath string, age time.Duration) {
+	t.Helper()
+
+	if err := os.MkdirAll(path.Dir(filePath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte("aged"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	modified := time.Now().Add(-age)
+	if err := os.Chtimes(filePath, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Writes an uncommitted file into the staging directory, last modified the given time ago.
+func putStagedTestFile(t *testing.T, age time.Duration) string {
+	t.Helper()
+
+	fileUid := Misc.NewRandomUID()
+	writeAgedTestFile(t, getStagingPath(fileUid), age)
+
+	return fileUid
+}
+
+func TestRecoverStagedFiles(t *testing.T) {
+	grace := time.Duration(config.AppConfig.GarbageCollectionGraceMs) * time.Millisecond
+	inFlight := putStagedTestFile(t, time.Second)
+	t.Cleanup(func() { os.Remove(getStagingPath(inFlight)) })
+	abandoned := putStagedTestFile(t, grace+time.Hour)
+
+	// A committed file which never got moved into place.
+	bucket := getTestBucket(t)
+	committed := putScrubTestFile(t, bucket, "/recover/committed")
+	if err := os.Rename(committed.GetPath(), getStagingPath(committed.UID)); err != nil {
+		t.Fatal(err)
+	}
+
+	modified := time.Now().Add(-grace - time.Hour)
+	if err := os.Chtimes(getStagingPath(committed.UID), modified, modified); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Maintenance.RecoverStagedFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(getStagingPath(inFlight)); err != nil {
+		t.Errorf("in-flight upload was not left alone: %v", err)
+	}
+	if _, err := os.Stat(getStagingPath(abandoned)); !os.IsNotExist(err) {
+		t.Errorf("abandoned upload was not removed: %v", err)
+	}
+	if _, err := os.Stat(committed.GetPath()); err != nil {
+		t.Errorf("committed file was not moved into place: %v", err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	gracePeriodMs := config.AppConfig.GarbageCollectionGraceMs
+	config.AppConfig.GarbageCollectionGraceMs = 60000
+	t.Cleanup(func() { config.AppConfig.GarbageCollectionGraceMs = gracePeriodMs })
+
+	bucket := getTestBucket(t)
+	aged := time.Hour
+
+	// Files which nothing in the database knows about, spread over every directory the collector looks through.
+	orphans := []string{
+		getFilePath(bucket.id, false, true, Misc.NewRandomUID()),
+		getFilePath(bucket.id, false, false, Misc.NewRandomUID()),
+		getFilePath(bucket.id, true, true, Misc.NewRandomUID()),
+		getBucketPartPath(bucket.id, Misc.NewRandomUID()),
+		getStagingPath(Misc.NewRandomUID()),
+	}
+	for _, orphan := range orphans {
+		writeAgedTestFile(t, orphan, aged)
+	}
+
+	// Untracked files which may still belong to an upload in progress.
+	recent := getFilePath(bucket.id, false, true, Misc.NewRandomUID())
+	writeAgedTestFile(t, recent, time.Second)
+
+	partial := getStagingPath(Misc.NewRandomUID())
+	writeAgedTestFile(t, partial, aged)
+	Lifecycle.TrackPartialFile(partial)
+	t.Cleanup(func() {
+		Lifecycle.UntrackPartialFile(partial)
+		os.Remove(partial)
+		os.Remove(recent)
+	})
+
+	// Tracked files are kept regardless of their age, including one which nothing references (the reference count audit removes those).
+	referenced := putScrubTestFile(t, bucket, "/gc/referenced")
+	unreferenced := putScrubTestFile(t, bucket, "/gc/unreferenced")
+	if _, err := DB.Exec("DELETE FROM objects WHERE file_id = ?", unreferenced.id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec("UPDATE files SET ref_count = 0 WHERE id = ?", unreferenced.id); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Exec("DELETE FROM files WHERE id = ?", unreferenced.id) })
+
+	for _, file := range []CachedFile{referenced, unreferenced} {
+		writeAgedTestFile(t, file.GetPath(), aged)
+	}
+
+	missing := putScrubTestFile(t, bucket, "/gc/missing")
+	if err := os.Remove(missing.GetPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	kept := []string{recent, partial, referenced.GetPath(), unreferenced.GetPath()}
+	check := func(report *GarbageReport, removed bool) {
+		t.Helper()
+
+		removedFiles := map[string]struct{}{}
+		for _, filePath := range report.RemovedFiles {
+			removedFiles[filePath] = struct{}{}
+		}
+
+		for _, orphan := range orphans {
+			if _, ok := removedFiles[orphan]; !ok {
+				t.Errorf("orphaned file %s not reported as removed", orphan)
+			}
+
+			if _, err := os.Stat(orphan); os.IsNotExist(err) != removed {
+				t.Errorf("orphaned file %s exists %v after collecting", orphan, !removed)
+			}
+		}
+
+		for _, filePath := range kept {
+			if _, ok := removedFiles[filePath]; ok {
+				t.Errorf("file %s reported as removed", filePath)
+			}
+
+			if _, err := os.Stat(filePath); err != nil {
+				t.Errorf("file %s not kept: %v", filePath, err)
+			}
+		}
+
+		if report.SkippedRecentFiles < 2 {
+			t.Errorf("reported %d recent files skipped, want at least 2", report.SkippedRecentFiles)
+		}
+
+		foundMissing := false
+		for _, missingFile := range report.MissingFiles {
+			foundMissing = foundMissing || missingFile.FileId == missing.id
+		}
+		if !foundMissing {
+			t.Errorf("missing file %s not reported", missing.GetPath())
+		}
+	}
+
+	// A dry run only reports what would be removed.
+	report, err := Maintenance.CollectGarbage(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(report, false)
+
+	report, err = Maintenance.CollectGarbage(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(report, true)
+}
+
+func TestAuditReferenceCounts(t *testing.T) {
+	bucket := getTestBucket(t)
+
+	// Leave any drift from other tests behind, so only the files below are mismatched.
+	if _, err := Maintenance.AuditReferenceCounts(false); err != nil {
+		t.Fatal(err)
+	}
+
+	putTestObject(t, bucket, "/fsck/first", "audited content")
+	putTestObject(t, bucket, "/fsck/second", "audited content")
+	drifted, err := Object.GetObjectByKey(bucket, []byte("/fsck/first"))
+	if err != nil || drifted == nil {
+		t.Fatalf("fetching object: %v", err)
+	}
+
+	unreferenced := putScrubTestFile(t, bucket, "/fsck/unreferenced")
+	if _, err := DB.Exec("DELETE FROM objects WHERE file_id = ?", unreferenced.id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := DB.Exec("UPDATE files SET ref_count = 5 WHERE id = ?", drifted.File.id); err != nil {
+		t.Fatal(err)
+	}
+
+	refCount := func(fileId int64) int64 {
+		t.Helper()
+
+		var count int64
+		if err := DB.QueryRow("SELECT ref_count FROM files WHERE id = ?", fileId).Scan(&count); err != nil {
+			if err == sql.ErrNoRows {
+				return -1
+			}
+
+			t.Fatal(err)
+		}
+
+		return count
+	}
+
+	check := func(report *RefCountReport) {
+		t.Helper()
+
+		expected := map[int64][2]int64{drifted.File.id: {5, 2}, unreferenced.id: {1, 0}}
+		if len(report.Mismatches) != len(expected) || report.RemovedFiles != 1 {
+			t.Fatalf("audit reported %+v with %d removed files, want 2 mismatches and 1 removed file", report.Mismatches, report.RemovedFiles)
+		}
+
+		for _, mismatch := range report.Mismatches {
+			if counts, ok := expected[mismatch.FileId]; !ok || mismatch.Stored != counts[0] || mismatch.Actual != counts[1] {
+				t.Errorf("audit reported mismatch %+v", mismatch)
+			}
+		}
+	}
+
+	// A dry run reports the mismatches without changing anything.
+	report, err := Maintenance.AuditReferenceCounts(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(report)
+
+	if count := refCount(drifted.File.id); count != 5 {
+		t.Errorf("dry run changed reference count to %d", count)
+	}
+	if count := refCount(unreferenced.id); count != 1 {
+		t.Errorf("dry run changed unreferenced file reference count to %d", count)
+	}
+	if _, err := os.Stat(unreferenced.GetPath()); err != nil {
+		t.Errorf("dry run removed unreferenced file: %v", err)
+	}
+
+	report, err = Maintenance.AuditReferenceCounts(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(report)
+
+	if count := refCount(drifted.File.id); count != 2 {
+		t.Errorf("repaired reference count is %d, want 2", count)
+	}
+	if count := refCount(unreferenced.id); count != -1 {
+		t.Errorf("unreferenced file row kept with reference count %d", count)
+	}
+	if _, err := os.Stat(unreferenced.GetPath()); !os.IsNotExist(err) {
+		t.Errorf("unreferenced file was not removed: %v", err)
+	}
+
+	// Nothing is left to repair.
+	if report, err := Maintenance.AuditReferenceCounts(false); err != nil || len(report.Mismatches) != 0 {
+		t.Errorf("second audit reported %+v with error %v", report, err)
+	}
+}
+
+// Moves the file of the object back to where it was stored before the fan-out directory layout.
+func unshardTestFile(t *testing.T, file CachedFile) CachedFile {
+	t.Helper()
+
+	oldPath := getFilePath(file.bucketId, file.Shared, false, file.UID)
+	if err := os.Rename(file.GetPath(), oldPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.Exec("UPDATE files SET sharded = 0 WHERE id = ?", file.id); err != nil {
+		t.Fatal(err)
+	}
+
+	file.sharded = false
+	return file
+}
+
+func TestMigrateFileLayout(t *testing.T) {
+	isolated := getTestBucket(t)
+	shared := createTestBucket(t, "migrated-shared", true)
+
+	keys := map[string]*CachedBucket{"/migrate/isolated": isolated, "/migrate/shared": shared, "/migrate/early": isolated, "/migrate/missing": isolated}
+	for key, bucket := range keys {
+		putTestObject(t, bucket, key, "migrated "+key)
+		unshardTestFile(t, getTestObject(t, bucket, key).File)
+	}
+
+	// Files are served from their old location until moved.
+	for key, bucket := range keys {
+		if key == "/migrate/missing" {
+			continue
+		}
+
+		object := getTestObject(t, bucket, key)
+		if object.File.sharded {
+			t.Fatalf("file of %s is recorded as sharded", key)
+		}
+		if content := readTestObject(t, object); content != "migrated "+key {
+			t.Errorf("file of %s read %q before migrating", key, content)
+		}
+	}
+
+	// A file moved after its object was looked up is found at the new location.
+	early := getTestObject(t, isolated, "/migrate/early")
+	if err := os.MkdirAll(path.Dir(getFilePath(early.File.bucketId, false, true, early.File.UID)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(early.File.GetPath(), getFilePath(early.File.bucketId, false, true, early.File.UID)); err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestObject(t, early); content != "migrated /migrate/early" {
+		t.Errorf("file moved after lookup read %q", content)
+	}
+
+	missing := getTestObject(t, isolated, "/migrate/missing")
+	if err := os.Remove(missing.File.GetPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Objects looked up before the migration keep working afterwards.
+	stale := getTestObject(t, shared, "/migrate/shared")
+
+	report, err := Maintenance.MigrateFileLayout()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file which was already moved only needs its row updating, but counts as moved all the same.
+	if report.MovedFiles != 3 || report.MissingFiles != 1 {
+		t.Errorf("migration reported %d moved and %d missing, want 3 and 1", report.MovedFiles, report.MissingFiles)
+	}
+
+	for key, bucket := range keys {
+		if key == "/migrate/missing" {
+			continue
+		}
+
+		object := getTestObject(t, bucket, key)
+		if !object.File.sharded || object.File.GetPath() != getFilePath(object.File.bucketId, object.File.Shared, true, object.File.UID) {
+			t.Errorf("file of %s is at %s (sharded %v) after migrating", key, object.File.GetPath(), object.File.sharded)
+		}
+		if _, err := os.Stat(getFilePath(object.File.bucketId, object.File.Shared, false, object.File.UID)); !os.IsNotExist(err) {
+			t.Errorf("file of %s left at its old location: %v", key, err)
+		}
+		if content := readTestObject(t, object); content != "migrated "+key {
+			t.Errorf("file of %s read %q after migrating", key, content)
+		}
+	}
+
+	if content := readTestObject(t, stale); content != "migrated /migrate/shared" {
+		t.Errorf("file looked up before migrating read %q", content)
+	}
+
+	// The missing file is left for the garbage collector to report, and tried again on the next migration.
+	var sharded bool
+	if err := DB.QueryRow("SELECT sharded FROM files WHERE id = ?", missing.File.id).Scan(&sharded); err != nil || sharded {
+		t.Errorf("missing file recorded as sharded %v (%v)", sharded, err)
+	}
+}
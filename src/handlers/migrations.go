@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"log"
+	"time"
+)
+
+type migration struct {
+	description string
+	statements  []string
+}
+
+// Every change to the schema, applied in order, with the version of the schema being the amount of migrations applied.
+// Migrations MUST NEVER be modified or reordered once released, changes are made by appending a new migration.
+var migrations = []migration{
+	{
+		// Uses 'IF NOT EXISTS' throughout as databases created before migrations existed already contain these.
+		description: "create initial tables",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS buckets (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name VARCHAR(64) UNIQUE NOT NULL,
+				created_ms UNSIGNED BIGINT NOT NULL
+			)`,
+
+			`CREATE TABLE IF NOT EXISTS bucket_auth_api_keys (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				bucket_id INTEGER NOT NULL,
+				name VARCHAR(64) UNIQUE NOT NULL,
+				created_ms UNSIGNED BIGINT NOT NULL,
+				key_hashed BLOB(64) NOT NULL,
+
+				FOREIGN KEY (bucket_id) REFERENCES buckets (id) ON DELETE CASCADE
+			)`,
+
+			"CREATE INDEX IF NOT EXISTS idx_bucket_auth_api_keys_bucket_id ON bucket_auth_api_keys(bucket_id)",
+
+			`CREATE TABLE IF NOT EXISTS bucket_access_rules (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				bucket_id INTEGER NOT NULL,
+				priority UNSIGNED INTEGER NOT NULL,
+
+				regex TEXT NOT NULL,
+				action UNSIGNED TINYINT NOT NULL,
+
+				FOREIGN KEY (bucket_id) REFERENCES buckets (id) ON DELETE CASCADE
+			)`,
+
+			"CREATE INDEX IF NOT EXISTS idx_bucket_access_rules_bucket_id ON bucket_access_rules(bucket_id)",
+
+			`CREATE TABLE IF NOT EXISTS bucket_object_auth_mac (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				bucket_id INTEGER NOT NULL,
+
+				created_ms UNSIGNED BIGINT NOT NULL,
+				selector UNSIGNED INTEGER NOT NULL,
+				secret BLOB(32) NOT NULL,
+
+				FOREIGN KEY (bucket_id) REFERENCES buckets (id) ON DELETE CASCADE,
+				UNIQUE (bucket_id, selector)
+			)`,
+
+			`CREATE TABLE IF NOT EXISTS files (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				bucket_id INTEGER NOT NULL,
+				created_ms UNSIGNED BIGINT NOT NULL,
+
+				digest BLOB(32) NOT NULL,
+				size UNSIGNED INTEGER NOT NULL,
+				ref_count UNSIGNED INTEGER NOT NULL,
+
+				uid VARCHAR(22) UNIQUE NOT NULL,
+
+				FOREIGN KEY (bucket_id) REFERENCES buckets (id) ON DELETE CASCADE,
+				UNIQUE (bucket_id, uid)
+			)`,
+
+			"CREATE INDEX IF NOT EXISTS idx_files_digest ON files(digest)",
+
+			`CREATE TABLE IF NOT EXISTS objects (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				bucket_id INTEGER NOT NULL,
+				file_id INTEGER NOT NULL,
+				created_ms UNSIGNED BIGINT NOT NULL,
+
+				key BLOB NOT NULL, -- <- this is a blob on purpose so that we can search the key directly without converting fasthttp's path to a string first.
+				content_type_mime TEXT,
+
+				FOREIGN KEY (bucket_id) REFERENCES buckets (id) ON DELETE CASCADE,
+				FOREIGN KEY (file_id) REFERENCES files (id),
+				UNIQUE (bucket_id, key)
+			)`,
+
+			"CREATE INDEX IF NOT EXISTS idx_objects_file_id ON objects(file_id)",
+		},
+	},
+	{
+		description: "create multipart upload tables",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS multipart_uploads (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				bucket_id INTEGER NOT NULL,
+				uid VARCHAR(22) UNIQUE NOT NULL,
+
+				key BLOB NOT NULL,
+				content_type_mime TEXT,
+
+				created_ms UNSIGNED BIGINT NOT NULL,
+				expires_ms UNSIGNED BIGINT NOT NULL,
+
+				FOREIGN KEY (bucket_id) REFERENCES buckets (id) ON DELETE CASCADE
+			)`,
+
+			"CREATE INDEX IF NOT EXISTS idx_multipart_uploads_expires_ms ON multipart_uploads(expires_ms)",
+
+			`CREATE TABLE IF NOT EXISTS multipart_upload_parts (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				upload_id INTEGER NOT NULL,
+				part_number UNSIGNED INTEGER NOT NULL,
+				created_ms UNSIGNED BIGINT NOT NULL,
+
+				digest BLOB(32) NOT NULL,
+				size UNSIGNED INTEGER NOT NULL,
+
+				uid VARCHAR(22) UNIQUE NOT NULL,
+
+				FOREIGN KEY (upload_id) REFERENCES multipart_uploads (id) ON DELETE CASCADE,
+				UNIQUE (upload_id, part_number)
+			)`,
+		},
+	},
+	{
+		description: "track file integrity verification",
+		statements: []string{
+			"ALTER TABLE files ADD COLUMN last_verified_ms UNSIGNED BIGINT",
+			"ALTER TABLE files ADD COLUMN corrupted BOOLEAN NOT NULL DEFAULT 0",
+			"CREATE INDEX IF NOT EXISTS idx_files_corrupted ON files(corrupted) WHERE corrupted = 1",
+		},
+	},
+	{
+		description: "add shared content-addressed storage",
+		statements: []string{
+			"ALTER TABLE buckets ADD COLUMN shared_storage BOOLEAN NOT NULL DEFAULT 0",
+			"ALTER TABLE files ADD COLUMN shared BOOLEAN NOT NULL DEFAULT 0",
+		},
+	},
+	{
+		description: "track fan-out directory layout of files",
+		statements: []string{
+			"ALTER TABLE files ADD COLUMN sharded BOOLEAN NOT NULL DEFAULT 0",
+			"CREATE INDEX IF NOT EXISTS idx_files_unsharded ON files(id) WHERE sharded = 0",
+		},
+	},
+	{
+		description: "store client supplied object checksums",
+		statements: []string{
+			"ALTER TABLE objects ADD COLUMN checksum_sha256 BLOB",
+			"ALTER TABLE objects ADD COLUMN checksum_crc32c BLOB",
+		},
+	},
+	{
+		description: "lock multipart uploads while completing",
+		statements: []string{
+			"ALTER TABLE multipart_uploads ADD COLUMN completing BOOLEAN NOT NULL DEFAULT 0",
+		},
+	},
+}
+
+// Brings the schema up to date by applying every migration which hasn't been applied yet, each in its own transaction.
+func (DatabaseHandler) RunMigrations() {
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			description TEXT NOT NULL,
+			applied_ms UNSIGNED BIGINT NOT NULL
+		)
+	`)
+
+	if err != nil {
+		log.Fatal("Error while creating schema version table ", err)
+	}
+
+	var currentVersion int
+	if err := DB.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&currentVersion); err != nil {
+		log.Fatal("Error while fetching schema version ", err)
+	}
+
+	if currentVersion > len(migrations) {
+		log.Fatalf("Database schema version %d is newer than the latest known version %d, refusing to start with a database from a newer build", currentVersion, len(migrations))
+	}
+
+	for version := currentVersion + 1; version <= len(migrations); version++ {
+		migration := migrations[version-1]
+
+		tx, err := DB.Begin()
+		if err != nil {
+			log.Fatal("Error while starting migration transaction ", err)
+		}
+
+		for _, statement := range migration.statements {
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				log.Fatalf("Error while applying migration %d (%s): %s", version, migration.description, err)
+			}
+		}
+
+		if _, err := tx.Exec("INSERT INTO schema_version(version,description,applied_ms) VALUES(?,?,?)", version, migration.description, time.Now().UnixMilli()); err != nil {
+			tx.Rollback()
+			log.Fatalf("Error while recording migration %d (%s): %s", version, migration.description, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Fatalf("Error while committing migration %d (%s): %s", version, migration.description, err)
+		}
+
+		log.Printf("Applied database migration %d (%s)", version, migration.description)
+	}
+}
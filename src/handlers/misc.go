@@ -2,11 +2,13 @@ package handlers
 
 import (
 	"bytes"
+	"cmp"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"net"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -35,44 +37,40 @@ type ParsedRangeHeader struct {
 	ContentRangeHeader string
 }
 
-// TODO: support multiple ranges?
+// The most ranges a single "Range" header may ask for once overlapping ranges have been merged.
+// Requests for more are served the entire file instead, as answering them costs more than it saves.
+const MaxRangesPerRequest = 16
+
 var ParseRangeUnsatisfiableError error = errors.New("Range cannot be satisfied")
 
-// Parses a "Range" header from the client and transforms it into a starting index and length of what should be read from the file.
-// If the header is invalid, an error will be returned which means the header should be ignored.
-// If the header's range cannot be satisfied, an error of type ParseRangeUnsatisfiableError will be returned, which can be relayed to the client as a 416 status code.
-// The struct also contains a "ContentRangeHeader" value which contains the "Content-Range" header that should be set; this is zero-initialized on error EXCEPT for an error of type ParseRangeUnsatisfiableError.
-func (MiscHandler) ParseRangeHeader(header []byte, size uint64) (ParsedRangeHeader, error) {
-	GenerateUnsatisfiableRangedHeader := func(size uint64) string {
-		var b strings.Builder
-		b.Grow(28)
-		b.WriteString("bytes */")
-		b.WriteString(strconv.FormatUint(size, 10))
-
-		return b.String()
-	}
+func generateUnsatisfiableRangedHeader(size uint64) string {
+	var b strings.Builder
+	b.Grow(28)
+	b.WriteString("bytes */")
+	b.WriteString(strconv.FormatUint(size, 10))
 
-	GenerateRangedHeader := func(size uint64, startByte uint64, length uint64) string {
-		var b strings.Builder
-		b.Grow(40)
-		b.WriteString("bytes ")
-		b.WriteString(strconv.FormatUint(startByte, 10))
-		b.WriteRune('-')
-		b.WriteString(strconv.FormatUint(startByte+length-1, 10))
-		b.WriteRune('/')
-		b.WriteString(strconv.FormatUint(size, 10))
-
-		return b.String()
-	}
+	return b.String()
+}
 
-	if !bytes.HasPrefix(header, []byte("bytes=")) {
-		return ParsedRangeHeader{}, errors.New("Unexpected prefix")
-	}
+func generateRangedHeader(size uint64, startByte uint64, length uint64) string {
+	var b strings.Builder
+	b.Grow(40)
+	b.WriteString("bytes ")
+	b.WriteString(strconv.FormatUint(startByte, 10))
+	b.WriteRune('-')
+	b.WriteString(strconv.FormatUint(startByte+length-1, 10))
+	b.WriteRune('/')
+	b.WriteString(strconv.FormatUint(size, 10))
+
+	return b.String()
+}
 
-	// Header is guaranteed to at least be 6 bytes from the above prefix check, hence won't panic.
-	values := bytes.Split(header[6:], []byte("-"))
+// Parses a single range of a "Range" header into a starting index and length.
+// Returns ParseRangeUnsatisfiableError if the range lies outside of the file, or another error if the range is invalid.
+func parseSingleRange(value []byte, size uint64) (uint64, uint64, error) {
+	values := bytes.Split(value, []byte("-"))
 	if len(values) != 2 {
-		return ParsedRangeHeader{}, errors.New("Invalid range format")
+		return 0, 0, errors.New("Invalid range format")
 	}
 
 	startIncluded := len(values[0]) != 0
@@ -82,57 +80,129 @@ func (MiscHandler) ParseRangeHeader(header []byte, size uint64) (ParsedRangeHead
 	if startIncluded && endIncluded {
 		startIndex, err := Misc.Btoui64(values[0])
 		if err != nil {
-			return ParsedRangeHeader{}, err
+			return 0, 0, err
 		}
 
 		endIndex, err := Misc.Btoui64(values[1])
 		if err != nil {
-			return ParsedRangeHeader{}, err
+			return 0, 0, err
+		}
+
+		if startIndex > endIndex {
+			return 0, 0, errors.New("Invalid range format")
 		}
 
 		// If this range is impossible to fulfil.
-		if startIndex > endIndex || startIndex >= size || endIndex >= size {
-			return ParsedRangeHeader{ContentRangeHeader: GenerateUnsatisfiableRangedHeader(size)}, ParseRangeUnsatisfiableError
+		if startIndex >= size {
+			return 0, 0, ParseRangeUnsatisfiableError
 		}
 
-		length := 1 + endIndex - startIndex
-		return ParsedRangeHeader{Start: startIndex, Length: length, ContentRangeHeader: GenerateRangedHeader(size, startIndex, length)}, nil
+		// An end past the file is satisfiable, it is simply cut short at the end of the file.
+		return startIndex, 1 + min(endIndex, size-1) - startIndex, nil
 	}
 
 	// If only the start is included, this means we need to read all bytes starting at that index to the end.
 	if startIncluded {
 		startIndex, err := Misc.Btoui64(values[0])
 		if err != nil {
-			return ParsedRangeHeader{}, err
+			return 0, 0, err
 		}
 
 		// If this range is impossible to fulfil.
 		if startIndex >= size {
-			return ParsedRangeHeader{ContentRangeHeader: GenerateUnsatisfiableRangedHeader(size)}, ParseRangeUnsatisfiableError
+			return 0, 0, ParseRangeUnsatisfiableError
 		}
 
-		length := size - startIndex
-		return ParsedRangeHeader{Start: startIndex, Length: length, ContentRangeHeader: GenerateRangedHeader(size, startIndex, length)}, nil
+		return startIndex, size - startIndex, nil
 	}
 
 	// If only the end is included, this means we need to read the last X bytes.
 	if endIncluded {
 		endIndex, err := Misc.Btoui64(values[1])
 		if err != nil {
-			return ParsedRangeHeader{}, err
+			return 0, 0, err
 		}
 
 		// If this range is impossible to fulfil.
-		if endIndex == 0 || endIndex > size {
-			return ParsedRangeHeader{ContentRangeHeader: GenerateUnsatisfiableRangedHeader(size)}, ParseRangeUnsatisfiableError
+		if endIndex == 0 || size == 0 {
+			return 0, 0, ParseRangeUnsatisfiableError
 		}
 
-		startByte := size - endIndex
-		return ParsedRangeHeader{Start: startByte, Length: endIndex, ContentRangeHeader: GenerateRangedHeader(size, startByte, endIndex)}, nil
+		// Asking for more than the file holds simply gives the whole file.
+		length := min(endIndex, size)
+		return size - length, length, nil
 	}
 
 	// Both the start and the end weren't specified, which isn't allowed.
-	return ParsedRangeHeader{}, errors.New("Invalid range format")
+	return 0, 0, errors.New("Invalid range format")
+}
+
+// Parses a "Range" header from the client and transforms it into the starting indexes and lengths of what should be read from the file.
+// The ranges are sorted, with any overlapping or adjacent ranges merged together, and each contains the "Content-Range" header that describes it.
+// If the header is invalid or asks for more than MaxRangesPerRequest ranges, an error will be returned which means the header should be ignored.
+// If none of the header's ranges can be satisfied, an error of type ParseRangeUnsatisfiableError will be returned, which can be relayed to the client as a 416 status code.
+// In that case a single range is returned which only contains the "Content-Range" header that should be set.
+func (MiscHandler) ParseRangeHeader(header []byte, size uint64) ([]ParsedRangeHeader, error) {
+	if !bytes.HasPrefix(header, []byte("bytes=")) {
+		return nil, errors.New("Unexpected prefix")
+	}
+
+	// Header is guaranteed to at least be 6 bytes from the above prefix check, hence won't panic.
+	var ranges []ParsedRangeHeader
+	unsatisfiable := false
+	for _, value := range bytes.Split(header[6:], []byte(",")) {
+		value = bytes.TrimSpace(value)
+
+		// Empty list elements are allowed and simply skipped.
+		if len(value) == 0 {
+			continue
+		}
+
+		startIndex, length, err := parseSingleRange(value, size)
+		if err == ParseRangeUnsatisfiableError {
+			// Unsatisfiable ranges are left out as long as any of the others can be satisfied.
+			unsatisfiable = true
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		ranges = append(ranges, ParsedRangeHeader{Start: startIndex, Length: length})
+	}
+
+	if len(ranges) == 0 {
+		if !unsatisfiable {
+			return nil, errors.New("Invalid range format")
+		}
+
+		return []ParsedRangeHeader{{ContentRangeHeader: generateUnsatisfiableRangedHeader(size)}}, ParseRangeUnsatisfiableError
+	}
+
+	// Merge the ranges which overlap or directly follow each other, so no byte is sent twice.
+	slices.SortFunc(ranges, func(a, b ParsedRangeHeader) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+
+	merged := ranges[:1]
+	for _, next := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if next.Start <= last.Start+last.Length {
+			last.Length = max(last.Start+last.Length, next.Start+next.Length) - last.Start
+			continue
+		}
+
+		merged = append(merged, next)
+	}
+
+	if len(merged) > MaxRangesPerRequest {
+		return nil, errors.New("Too many ranges")
+	}
+
+	for i := range merged {
+		merged[i].ContentRangeHeader = generateRangedHeader(size, merged[i].Start, merged[i].Length)
+	}
+
+	return merged, nil
 }
 
 // Inside of a hijacked request, FastHTTP returns an annoying interface wrapper around the actual connection.
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Builds a "Range" header asking for count disjoint single byte ranges, or overlapping ones if overlap is set.
+func manyRanges(count int, overlap bool) string {
+	ranges := make([]string, count)
+	for i := range ranges {
+		if overlap {
+			ranges[i] = fmt.Sprintf("%d-%d", i, i+1)
+		} else {
+			ranges[i] = fmt.Sprintf("%d-%d", i*2, i*2)
+		}
+	}
+
+	return "bytes=" + strings.Join(ranges, ",")
+}
+
+func TestParseRangeHeader(t *testing.T) {
+	const (
+		satisfiable = iota
+		unsatisfiable
+		invalid
+	)
+
+	tests := []struct {
+		name    string
+		header  string
+		size    uint64
+		outcome int
+		ranges  []string // The "Content-Range" headers of the expected ranges.
+	}{
+		{name: "single", header: "bytes=0-99", size: 1000, ranges: []string{"bytes 0-99/1000"}},
+		{name: "open ended", header: "bytes=900-", size: 1000, ranges: []string{"bytes 900-999/1000"}},
+		{name: "suffix", header: "bytes=-100", size: 1000, ranges: []string{"bytes 900-999/1000"}},
+		{name: "suffix longer than file", header: "bytes=-5000", size: 1000, ranges: []string{"bytes 0-999/1000"}},
+		{name: "end past file clamped", header: "bytes=990-5000", size: 1000, ranges: []string{"bytes 990-999/1000"}},
+		{name: "whitespace", header: "bytes= 0-9 , 20-29", size: 1000, ranges: []string{"bytes 0-9/1000", "bytes 20-29/1000"}},
+		{name: "empty elements skipped", header: "bytes=0-9,, ,20-29", size: 1000, ranges: []string{"bytes 0-9/1000", "bytes 20-29/1000"}},
+		{name: "sorted", header: "bytes=500-599,0-99", size: 1000, ranges: []string{"bytes 0-99/1000", "bytes 500-599/1000"}},
+		{name: "overlapping merged", header: "bytes=0-99,50-149", size: 1000, ranges: []string{"bytes 0-149/1000"}},
+		{name: "adjacent merged", header: "bytes=0-99,100-199", size: 1000, ranges: []string{"bytes 0-199/1000"}},
+		{name: "contained merged", header: "bytes=10-20,0-999", size: 1000, ranges: []string{"bytes 0-999/1000"}},
+		{name: "suffix merged with start", header: "bytes=-100,850-949", size: 1000, ranges: []string{"bytes 850-999/1000"}},
+		{name: "gap of one byte kept apart", header: "bytes=0-9,11-19", size: 1000, ranges: []string{"bytes 0-9/1000", "bytes 11-19/1000"}},
+		{name: "unsatisfiable ranges left out", header: "bytes=0-9,2000-3000,-0", size: 1000, ranges: []string{"bytes 0-9/1000"}},
+		{name: "at the cap", header: manyRanges(MaxRangesPerRequest, false), size: 1000, ranges: func() []string {
+			ranges := make([]string, MaxRangesPerRequest)
+			for i := range ranges {
+				ranges[i] = fmt.Sprintf("bytes %d-%d/1000", i*2, i*2)
+			}
+			return ranges
+		}()},
+		{name: "over the cap once merged", header: manyRanges(MaxRangesPerRequest+1, false), size: 1000, outcome: invalid},
+		{name: "under the cap once merged", header: manyRanges(100, true), size: 1000, ranges: []string{"bytes 0-100/1000"}},
+
+		{name: "start past file", header: "bytes=1000-", size: 1000, outcome: unsatisfiable, ranges: []string{"bytes */1000"}},
+		{name: "every range unsatisfiable", header: "bytes=1000-1001,2000-", size: 1000, outcome: unsatisfiable, ranges: []string{"bytes */1000"}},
+		{name: "empty suffix", header: "bytes=-0", size: 1000, outcome: unsatisfiable, ranges: []string{"bytes */1000"}},
+		{name: "empty file", header: "bytes=0-", size: 0, outcome: unsatisfiable, ranges: []string{"bytes */0"}},
+		{name: "suffix of empty file", header: "bytes=-10", size: 0, outcome: unsatisfiable, ranges: []string{"bytes */0"}},
+
+		{name: "other unit", header: "items=0-9", size: 1000, outcome: invalid},
+		{name: "no ranges", header: "bytes=", size: 1000, outcome: invalid},
+		{name: "only separators", header: "bytes=,,", size: 1000, outcome: invalid},
+		{name: "not digits", header: "bytes=a-b", size: 1000, outcome: invalid},
+		{name: "negative", header: "bytes=-5-10", size: 1000, outcome: invalid},
+		{name: "end before start", header: "bytes=10-5", size: 1000, outcome: invalid},
+		{name: "no bounds", header: "bytes=-", size: 1000, outcome: invalid},
+		{name: "invalid among valid", header: "bytes=0-9,x", size: 1000, outcome: invalid},
+		{name: "invalid among unsatisfiable", header: "bytes=2000-,x", size: 1000, outcome: invalid},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ranges, err := Misc.ParseRangeHeader([]byte(test.header), test.size)
+
+			switch test.outcome {
+			case satisfiable:
+				if err != nil {
+					t.Fatalf("parsing gave error %v", err)
+				}
+			case unsatisfiable:
+				if err != ParseRangeUnsatisfiableError {
+					t.Fatalf("parsing gave error %v, want ParseRangeUnsatisfiableError", err)
+				}
+			case invalid:
+				if err == nil || err == ParseRangeUnsatisfiableError {
+					t.Fatalf("parsing gave error %v, want the header to be ignored", err)
+				}
+
+				return
+			}
+
+			headers := make([]string, len(ranges))
+			for i, parsedRange := range ranges {
+				headers[i] = parsedRange.ContentRangeHeader
+
+				// The header must describe the range that is actually read.
+				if test.outcome == satisfiable {
+					if described := fmt.Sprintf("bytes %d-%d/%d", parsedRange.Start, parsedRange.Start+parsedRange.Length-1, test.size); described != parsedRange.ContentRangeHeader {
+						t.Errorf("range %d reads %s but has Content-Range %s", i, described, parsedRange.ContentRangeHeader)
+					}
+				}
+			}
+
+			if !slices.Equal(headers, test.ranges) {
+				t.Errorf("parsing gave ranges %q, want %q", headers, test.ranges)
+			}
+		})
+	}
+}
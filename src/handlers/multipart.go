@@ -0,0 +1,525 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"speedyvault/src/config"
+	"time"
+
+	"github.com/zeebo/blake3"
+)
+
+type MultipartUpload struct {
+	id              int64
+	UID             string // The identifier of the upload handed out to clients.
+	Key             []byte
+	ContentTypeMime sql.NullString // The mime type that was specified in the "Content-Type" header when the upload was initiated (if at all).
+	CreatedMs       uint64
+	ExpiresMs       uint64
+}
+
+type MultipartPart struct {
+	id     int64
+	Number uint32
+	Digest []byte // BLAKE3 digest of the part.
+	Size   uint64
+	UID    string // The UID of the disk file that this part is housed under.
+}
+
+var MultipartUploadNotFoundError = errors.New("Multipart upload does not exist or has expired")
+var MultipartUploadCompletingError = errors.New("Multipart upload is already being completed")
+var MultipartPartListInvalidError = errors.New("Multipart part list does not match the uploaded parts")
+
+// The highest part number that can be uploaded to a multipart upload.
+const MaxMultipartPartNumber = 10000
+
+// Creates a new multipart upload for the key, returning its UID.
+func (MultipartHandler) CreateUpload(bucket *CachedBucket, key []byte, contentTypeMime sql.NullString) (string, error) {
+	// Make sure there is somewhere to put the parts.
+	if err := os.MkdirAll(path.Dir(bucket.GetPartPath("_")), 0o755); err != nil {
+		log.Println("Problem while creating bucket parts directory ", err)
+		return "", err
+	}
+
+	uploadUid := Misc.NewRandomUID()
+	currentMs := time.Now().UnixMilli()
+
+	if _, err := DB.Exec(
+		"INSERT INTO multipart_uploads(bucket_id,uid,key,content_type_mime,created_ms,expires_ms) VALUES(?,?,?,?,?,?)",
+		bucket.id, uploadUid, key, contentTypeMime, currentMs, currentMs+config.AppConfig.MultipartUploadExpiryMs,
+	); err != nil {
+		log.Println("Problem while inserting multipart upload to database ", err)
+		return "", err
+	}
+
+	return uploadUid, nil
+}
+
+// Fetches an unexpired multipart upload for the key, returning nil if it doesn't exist.
+func (MultipartHandler) GetUpload(bucket *CachedBucket, uploadUid []byte, key []byte) (*MultipartUpload, error) {
+	var upload MultipartUpload
+	if err := DB.QueryRow(
+		"SELECT id,uid,key,content_type_mime,created_ms,expires_ms FROM multipart_uploads WHERE bucket_id = ? AND uid = ? AND key = ? AND expires_ms > ?",
+		bucket.id, string(uploadUid), key, time.Now().UnixMilli(),
+	).Scan(&upload.id, &upload.UID, &upload.Key, &upload.ContentTypeMime, &upload.CreatedMs, &upload.ExpiresMs); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		log.Println("Problem while fetching multipart upload from database ", err)
+		return nil, err
+	}
+
+	return &upload, nil
+}
+
+// Records a part of a multipart upload, replacing any part previously uploaded under the same number.
+// Returns MultipartUploadNotFoundError if the upload was removed in the meantime, or MultipartUploadCompletingError if it is being completed.
+// In-case of an error, the part file under partUid is not consumed and should be removed by the caller.
+func (MultipartHandler) PutPart(bucket *CachedBucket, upload *MultipartUpload, partNumber uint32, partUid string, digest []byte, size uint64) (errReturn error) {
+	dbCtx := context.Background()
+	dbConn, err := DB.Conn(dbCtx)
+	if err != nil {
+		log.Println("Problem while acquiring scoped database session ", err)
+		return err
+	}
+	defer dbConn.Close()
+
+	// We need to acquire an immediate lock here to prevent the upload from disappearing between the checks.
+	if _, err := dbConn.ExecContext(dbCtx, "BEGIN IMMEDIATE TRANSACTION"); err != nil {
+		log.Println("Problem while acquiring immediate transaction lock ", err)
+		return err
+	}
+
+	rollback := func() {
+		if _, err := dbConn.ExecContext(dbCtx, "ROLLBACK"); err != nil {
+			log.Println("Problem while rolling back database transaction ", err)
+		}
+	}
+
+	// Make sure the upload still exists, and isn't being completed.
+	var completing bool
+	if err := dbConn.QueryRowContext(dbCtx, "SELECT completing FROM multipart_uploads WHERE id = ?", upload.id).Scan(&completing); err != nil {
+		rollback()
+
+		if err == sql.ErrNoRows {
+			return MultipartUploadNotFoundError
+		}
+
+		log.Println("Problem while fetching multipart upload from database ", err)
+		return err
+	}
+
+	if completing {
+		rollback()
+		return MultipartUploadCompletingError
+	}
+
+	// Remove the part previously uploaded under this number (if any).
+	var replacedPartUid string
+	if err := dbConn.QueryRowContext(dbCtx, "DELETE FROM multipart_upload_parts WHERE upload_id = ? AND part_number = ? RETURNING uid", upload.id, partNumber).Scan(&replacedPartUid); err != nil && err != sql.ErrNoRows {
+		rollback()
+
+		log.Println("Problem while deleting replaced multipart part from database ", err)
+		return err
+	}
+
+	if _, err := dbConn.ExecContext(dbCtx,
+		"INSERT INTO multipart_upload_parts(upload_id,part_number,created_ms,digest,size,uid) VALUES(?,?,?,?,?,?)",
+		upload.id, partNumber, time.Now().UnixMilli(), digest, size, partUid,
+	); err != nil {
+		rollback()
+
+		log.Println("Problem while inserting multipart part to database ", err)
+		return err
+	}
+
+	// We're clear!
+	if _, err := dbConn.ExecContext(dbCtx, "COMMIT"); err != nil {
+		// Any errors are ignored here since there's not much we can do about it.
+		dbConn.ExecContext(dbCtx, "ROLLBACK")
+
+		log.Println("Problem while committing database transaction ", err)
+		return err
+	}
+
+	// The replaced part's file is no longer needed.
+	if replacedPartUid != "" {
+		if err := os.Remove(bucket.GetPartPath(replacedPartUid)); err != nil {
+			log.Println("Problem while deleting replaced multipart part file ", err)
+		}
+	}
+
+	return nil
+}
+
+// A part the client wants included in the completed object, identified by its number and the ETag it was given when uploaded.
+type MultipartCompletedPart struct {
+	PartNumber uint32 `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// Locks the multipart upload for completion, returning the parts listed by the client in order.
+// The list must be in strictly ascending part number order, and every part must exist with the ETag given, otherwise MultipartPartListInvalidError is returned.
+// While locked, parts can no longer be uploaded and any other attempt at completing returns MultipartUploadCompletingError.
+// The lock is released by EndComplete if completing fails, otherwise the upload is expected to be removed.
+func (MultipartHandler) BeginComplete(upload *MultipartUpload, completedParts []MultipartCompletedPart) ([]MultipartPart, error) {
+	if len(completedParts) == 0 {
+		return nil, MultipartPartListInvalidError
+	}
+
+	dbCtx := context.Background()
+	dbConn, err := DB.Conn(dbCtx)
+	if err != nil {
+		log.Println("Problem while acquiring scoped database session ", err)
+		return nil, err
+	}
+	defer dbConn.Close()
+
+	// We need to acquire an immediate lock here so no part can be uploaded between being checked and the upload being locked.
+	if _, err := dbConn.ExecContext(dbCtx, "BEGIN IMMEDIATE TRANSACTION"); err != nil {
+		log.Println("Problem while acquiring immediate transaction lock ", err)
+		return nil, err
+	}
+
+	rollback := func() {
+		if _, err := dbConn.ExecContext(dbCtx, "ROLLBACK"); err != nil {
+			log.Println("Problem while rolling back database transaction ", err)
+		}
+	}
+
+	var completing bool
+	if err := dbConn.QueryRowContext(dbCtx, "SELECT completing FROM multipart_uploads WHERE id = ?", upload.id).Scan(&completing); err != nil {
+		rollback()
+
+		if err == sql.ErrNoRows {
+			return nil, MultipartUploadNotFoundError
+		}
+
+		log.Println("Problem while fetching multipart upload from database ", err)
+		return nil, err
+	}
+
+	if completing {
+		rollback()
+		return nil, MultipartUploadCompletingError
+	}
+
+	rows, err := dbConn.QueryContext(dbCtx, "SELECT id,part_number,digest,size,uid FROM multipart_upload_parts WHERE upload_id = ?", upload.id)
+	if err != nil {
+		rollback()
+		log.Println("Problem while fetching multipart parts from database ", err)
+		return nil, err
+	}
+
+	storedParts := map[uint32]MultipartPart{}
+	for rows.Next() {
+		var part MultipartPart
+		if err := rows.Scan(&part.id, &part.Number, &part.Digest, &part.Size, &part.UID); err != nil {
+			rows.Close()
+			rollback()
+			log.Println("Problem while reading multipart parts from database ", err)
+			return nil, err
+		}
+
+		storedParts[part.Number] = part
+	}
+
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		rollback()
+		log.Println("Problem while reading multipart parts from database ", err)
+		return nil, err
+	}
+
+	rows.Close()
+
+	// Only the parts the client knows about make it into the object, so a part uploaded in the meantime can't slip in unnoticed.
+	parts := make([]MultipartPart, 0, len(completedParts))
+	for i, completedPart := range completedParts {
+		part, ok := storedParts[completedPart.PartNumber]
+		if !ok || (i != 0 && completedPart.PartNumber <= completedParts[i-1].PartNumber) || completedPart.ETag != string(File.FormatETag(part.Digest)) {
+			rollback()
+			return nil, MultipartPartListInvalidError
+		}
+
+		parts = append(parts, part)
+	}
+
+	if _, err := dbConn.ExecContext(dbCtx, "UPDATE multipart_uploads SET completing = 1 WHERE id = ?", upload.id); err != nil {
+		rollback()
+		log.Println("Problem while locking multipart upload in database ", err)
+		return nil, err
+	}
+
+	// We're clear!
+	if _, err := dbConn.ExecContext(dbCtx, "COMMIT"); err != nil {
+		// Any errors are ignored here since there's not much we can do about it.
+		dbConn.ExecContext(dbCtx, "ROLLBACK")
+
+		log.Println("Problem while committing database transaction ", err)
+		return nil, err
+	}
+
+	return parts, nil
+}
+
+// Releases the lock taken by BeginComplete after completing failed, so parts can be uploaded and completing retried.
+func (MultipartHandler) EndComplete(upload *MultipartUpload) error {
+	if _, err := DB.Exec("UPDATE multipart_uploads SET completing = 0 WHERE id = ?", upload.id); err != nil {
+		log.Println("Problem while unlocking multipart upload in database ", err)
+		return err
+	}
+
+	return nil
+}
+
+// Releases the locks of every multipart upload, which can only have been left behind by completing being interrupted by the server stopping.
+// Must be called before any requests are served.
+func (MultipartHandler) UnlockInterruptedUploads() error {
+	if _, err := DB.Exec("UPDATE multipart_uploads SET completing = 0 WHERE completing = 1"); err != nil {
+		log.Println("Problem while unlocking multipart uploads in database ", err)
+		return err
+	}
+
+	return nil
+}
+
+// Concatenates the parts into a single new staged object file under objectUid, returning the BLAKE3 digest and size of the result.
+// In-case of an error, the object file is removed.
+func (MultipartHandler) ConcatenateParts(bucket *CachedBucket, parts []MultipartPart, objectUid string) ([]byte, uint64, error) {
+	objectFilePath := File.GetStagingPath(objectUid)
+
+	file, err := File.CreateDiskFile(objectFilePath)
+	if err != nil {
+		log.Println("Problem while creating concatenated object file ", err)
+		return nil, 0, err
+	}
+
+	// The file is incomplete until every part has been copied, so it needs removing if the server is forced to exit before then.
+	Lifecycle.TrackPartialFile(objectFilePath)
+	defer Lifecycle.UntrackPartialFile(objectFilePath)
+
+	hasher := blake3.New()
+	writer := io.MultiWriter(file, hasher)
+	buffer := make([]byte, config.AppConfig.UploadStreamingChunkSize)
+
+	var size uint64 = 0
+	for _, part := range parts {
+		partFile, err := os.Open(bucket.GetPartPath(part.UID))
+		if err != nil {
+			file.Close()
+			os.Remove(objectFilePath)
+			log.Println("Problem while opening multipart part file ", err)
+			return nil, 0, err
+		}
+
+		written, err := io.CopyBuffer(writer, partFile, buffer)
+		partFile.Close()
+		if err != nil {
+			file.Close()
+			os.Remove(objectFilePath)
+			log.Println("Problem while concatenating multipart part file ", err)
+			return nil, 0, err
+		}
+
+		size += uint64(written)
+	}
+
+	if err := File.SyncDiskFile(file); err != nil {
+		file.Close()
+		os.Remove(objectFilePath)
+		log.Println("Problem while flushing concatenated object file ", err)
+		return nil, 0, err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(objectFilePath)
+		log.Println("Problem while closing concatenated object file ", err)
+		return nil, 0, err
+	}
+
+	return hasher.Sum(nil), size, nil
+}
+
+// Removes a multipart upload alongside all of its parts, both from the database and disk.
+func (MultipartHandler) RemoveUpload(bucket *CachedBucket, upload *MultipartUpload) error {
+	return removeMultipartUpload(bucket.id, upload.id, false)
+}
+
+// Removes the multipart upload and its parts, unless skipCompleting is set and the upload is locked for completing.
+// Returns MultipartUploadCompletingError if the upload was left in place.
+func removeMultipartUpload(bucketId int64, uploadId int64, skipCompleting bool) error {
+	dbCtx := context.Background()
+	dbConn, err := DB.Conn(dbCtx)
+	if err != nil {
+		log.Println("Problem while acquiring scoped database session ", err)
+		return err
+	}
+	defer dbConn.Close()
+
+	if _, err := dbConn.ExecContext(dbCtx, "BEGIN IMMEDIATE TRANSACTION"); err != nil {
+		log.Println("Problem while acquiring immediate transaction lock ", err)
+		return err
+	}
+
+	rollback := func() {
+		if _, err := dbConn.ExecContext(dbCtx, "ROLLBACK"); err != nil {
+			log.Println("Problem while rolling back database transaction ", err)
+		}
+	}
+
+	// A completion may have started since the upload was picked out, in which case the parts are still needed.
+	if skipCompleting {
+		var completing bool
+		if err := dbConn.QueryRowContext(dbCtx, "SELECT completing FROM multipart_uploads WHERE id = ?", uploadId).Scan(&completing); err != nil && err != sql.ErrNoRows {
+			rollback()
+			log.Println("Problem while fetching multipart upload from database ", err)
+			return err
+		}
+
+		if completing {
+			rollback()
+			return MultipartUploadCompletingError
+		}
+	}
+
+	// Collect the part files that need removing from disk.
+	partUids := []string{}
+	rows, err := dbConn.QueryContext(dbCtx, "DELETE FROM multipart_upload_parts WHERE upload_id = ? RETURNING uid", uploadId)
+	if err != nil {
+		rollback()
+		log.Println("Problem while deleting multipart parts from database ", err)
+		return err
+	}
+
+	for rows.Next() {
+		var partUid string
+		if err := rows.Scan(&partUid); err != nil {
+			rows.Close()
+			rollback()
+			log.Println("Problem while reading deleted multipart parts from database ", err)
+			return err
+		}
+
+		partUids = append(partUids, partUid)
+	}
+
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		rollback()
+		log.Println("Problem while reading deleted multipart parts from database ", err)
+		return err
+	}
+
+	rows.Close()
+
+	if _, err := dbConn.ExecContext(dbCtx, "DELETE FROM multipart_uploads WHERE id = ?", uploadId); err != nil {
+		rollback()
+		log.Println("Problem while deleting multipart upload from database ", err)
+		return err
+	}
+
+	if _, err := dbConn.ExecContext(dbCtx, "COMMIT"); err != nil {
+		// Any errors are ignored here since there's not much we can do about it.
+		dbConn.ExecContext(dbCtx, "ROLLBACK")
+
+		log.Println("Problem while committing database transaction ", err)
+		return err
+	}
+
+	// We don't want to do potentially expensive IO operations while keeping the tables locked, so we do it after.
+	for _, partUid := range partUids {
+		if err := os.Remove(getBucketPartPath(bucketId, partUid)); err != nil {
+			log.Println("Problem while deleting multipart part file ", err)
+		}
+	}
+
+	return nil
+}
+
+// Removes every multipart upload that has expired, returning the amount removed.
+// Uploads which are being completed are left alone, even once expired.
+func (MultipartHandler) SweepExpiredUploads() (int, error) {
+	rows, err := DB.Query("SELECT id,bucket_id FROM multipart_uploads WHERE expires_ms <= ? AND completing = 0", time.Now().UnixMilli())
+	if err != nil {
+		log.Println("Problem while fetching expired multipart uploads from database ", err)
+		return 0, err
+	}
+
+	type expiredUpload struct {
+		id       int64
+		bucketId int64
+	}
+
+	// The rows are collected first as the connection can't be shared with the removal transactions.
+	expired := []expiredUpload{}
+	for rows.Next() {
+		var upload expiredUpload
+		if err := rows.Scan(&upload.id, &upload.bucketId); err != nil {
+			rows.Close()
+			log.Println("Problem while reading expired multipart uploads from database ", err)
+			return 0, err
+		}
+
+		expired = append(expired, upload)
+	}
+
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		log.Println("Problem while reading expired multipart uploads from database ", err)
+		return 0, err
+	}
+
+	rows.Close()
+
+	removed := 0
+	for _, upload := range expired {
+		if err := removeMultipartUpload(upload.bucketId, upload.id, true); err != nil {
+			if err == MultipartUploadCompletingError {
+				continue
+			}
+
+			return removed, err
+		}
+
+		removed++
+	}
+
+	return removed, nil
+}
+
+// Starts a background goroutine which periodically removes abandoned multipart uploads.
+func (MultipartHandler) StartExpirySweeper() {
+	Lifecycle.RunBackgroundTask(func(stop <-chan struct{}) {
+		ticker := time.NewTicker(time.Duration(config.AppConfig.MultipartSweepIntervalMs) * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			removed, err := Multipart.SweepExpiredUploads()
+			if err != nil {
+				log.Println("Problem while sweeping expired multipart uploads ", err)
+				continue
+			}
+
+			if removed != 0 {
+				log.Println("Removed", removed, "expired multipart uploads")
+			}
+		}
+	})
+}
+
+type MultipartHandler struct{}
+
+var Multipart = MultipartHandler{}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestMultipartCompleteLock(t *testing.T) {
+	bucket := getTestBucket(t)
+
+	uploadUid, err := Multipart.CreateUpload(bucket, []byte("/multipart"), sql.NullString{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload, err := Multipart.GetUpload(bucket, []byte(uploadUid), []byte("/multipart"))
+	if err != nil || upload == nil {
+		t.Fatalf("fetching upload: %v", err)
+	}
+
+	digests := map[uint32][]byte{1: make([]byte, 32), 2: make([]byte, 32)}
+	digests[2][0] = 1
+	for number, digest := range digests {
+		if err := Multipart.PutPart(bucket, upload, number, Misc.NewRandomUID(), digest, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	etag := func(number uint32) string {
+		return string(File.FormatETag(digests[number]))
+	}
+
+	invalidLists := map[string][]MultipartCompletedPart{
+		"empty":           {},
+		"unknown part":    {{PartNumber: 3, ETag: etag(1)}},
+		"wrong etag":      {{PartNumber: 1, ETag: etag(2)}},
+		"descending":      {{PartNumber: 2, ETag: etag(2)}, {PartNumber: 1, ETag: etag(1)}},
+		"duplicated part": {{PartNumber: 1, ETag: etag(1)}, {PartNumber: 1, ETag: etag(1)}},
+	}
+
+	for name, list := range invalidLists {
+		if _, err := Multipart.BeginComplete(upload, list); err != MultipartPartListInvalidError {
+			t.Errorf("%s: got %v, want MultipartPartListInvalidError", name, err)
+		}
+	}
+
+	// Parts left out of the list are not part of the object.
+	parts, err := Multipart.BeginComplete(upload, []MultipartCompletedPart{{PartNumber: 2, ETag: etag(2)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parts) != 1 || parts[0].Number != 2 {
+		t.Errorf("got parts %+v, want only part 2", parts)
+	}
+
+	// While completing, the upload can't change nor be completed again.
+	if err := Multipart.PutPart(bucket, upload, 3, Misc.NewRandomUID(), digests[1], 1); err != MultipartUploadCompletingError {
+		t.Errorf("uploading part while completing gave %v", err)
+	}
+
+	if _, err := Multipart.BeginComplete(upload, []MultipartCompletedPart{{PartNumber: 2, ETag: etag(2)}}); err != MultipartUploadCompletingError {
+		t.Errorf("completing twice gave %v", err)
+	}
+
+	// Once unlocked after a failure, parts can be uploaded again.
+	if err := Multipart.EndComplete(upload); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Multipart.PutPart(bucket, upload, 3, Misc.NewRandomUID(), digests[1], 1); err != nil {
+		t.Errorf("uploading part after unlocking gave %v", err)
+	}
+}
+
+func TestSweepExpiredUploads(t *testing.T) {
+	bucket := getTestBucket(t)
+
+	uploads := map[string]*MultipartUpload{}
+	for _, key := range []string{"/sweep/idle", "/sweep/completing", "/sweep/unexpired"} {
+		uploadUid, err := Multipart.CreateUpload(bucket, []byte(key), sql.NullString{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		upload, err := Multipart.GetUpload(bucket, []byte(uploadUid), []byte(key))
+		if err != nil || upload == nil {
+			t.Fatalf("fetching upload: %v", err)
+		}
+
+		if err := Multipart.PutPart(bucket, upload, 1, Misc.NewRandomUID(), make([]byte, 32), 1); err != nil {
+			t.Fatal(err)
+		}
+
+		if key != "/sweep/unexpired" {
+			if _, err := DB.Exec("UPDATE multipart_uploads SET expires_ms = 0 WHERE id = ?", upload.id); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		uploads[key] = upload
+	}
+
+	completing := uploads["/sweep/completing"]
+	if _, err := Multipart.BeginComplete(completing, []MultipartCompletedPart{{PartNumber: 1, ETag: string(File.FormatETag(make([]byte, 32)))}}); err != nil {
+		t.Fatal(err)
+	}
+
+	exists := func(key string) bool {
+		t.Helper()
+
+		// Expired uploads can no longer be fetched, so the table is checked directly.
+		var count int
+		if err := DB.QueryRow("SELECT COUNT(*) FROM multipart_uploads WHERE id = ?", uploads[key].id).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+
+		return count != 0
+	}
+
+	// Only the expired upload that isn't being completed is removed.
+	if removed, err := Multipart.SweepExpiredUploads(); err != nil || removed != 1 {
+		t.Fatalf("sweep removed %d uploads with error %v, want 1", removed, err)
+	}
+	if exists("/sweep/idle") {
+		t.Error("expired upload was not removed")
+	}
+	if !exists("/sweep/completing") || !exists("/sweep/unexpired") {
+		t.Error("upload being completed or not yet expired was removed")
+	}
+
+	// A completion started after the sweep picked the upload out still keeps it in place.
+	if err := removeMultipartUpload(bucket.id, completing.id, true); err != MultipartUploadCompletingError {
+		t.Errorf("removing upload being completed gave %v, want MultipartUploadCompletingError", err)
+	}
+
+	// Once the lock left behind is released, the upload expires like any other.
+	if err := Multipart.UnlockInterruptedUploads(); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := Multipart.SweepExpiredUploads(); err != nil || removed != 1 {
+		t.Fatalf("sweep removed %d uploads with error %v, want 1", removed, err)
+	}
+	if exists("/sweep/completing") {
+		t.Error("expired upload was not removed after unlocking")
+	}
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/base64"
@@ -8,8 +9,6 @@ import (
 	"log"
 	"os"
 	"time"
-
-	"github.com/mattn/go-sqlite3"
 )
 
 type CachedObject struct {
@@ -17,59 +16,127 @@ type CachedObject struct {
 	CreatedMs       uint64
 	ContentTypeMime sql.NullString // The mime type that was specified in the "Content-Type" header (if at all).
 	Key             []byte
+	Checksums       Checksums // The checksums supplied by the client when the object was stored.
 
 	File CachedFile
 }
 
-var ObjectOperationConflictError = errors.New("Object under specified key already exists")
-
-// Attempts to create an object, returning ObjectOperationConflictError if an object under this key already exists.
-// In-case of an error, the file object under objectUid is not consumed and should either be retried or removed by the caller.
-func (ObjectHandler) CreateObject(bucket *CachedBucket, objectUid string, contentTypeMime sql.NullString, digest []byte, size uint64, key []byte) error {
-	var err error
+// Returns the time the object's current contents were stored, which is served as the "Last-Modified" header.
+func (object *CachedObject) LastModified() time.Time {
+	return time.UnixMilli(int64(object.CreatedMs)).UTC()
+}
 
+var ObjectOperationConflictError = errors.New("Object under specified key already exists")
+var ObjectNotFoundError = errors.New("Object under specified key does not exist")
+var ObjectPreconditionFailedError = errors.New("Object under specified key does not satisfy the preconditions")
+var ObjectNotDurableError = errors.New("Object was stored but its file could not be moved into place")
+
+// Creates an object under the key, or replaces the object already stored under it, in a single transaction.
+// Whether an object may be created or replaced is decided by allowCreate and allowReplace, returning ObjectNotFoundError if creating is required but not allowed, or ObjectOperationConflictError if replacing is required but not allowed.
+// The preconditions are evaluated against the object currently under the key (if any), returning ObjectPreconditionFailedError if they don't hold.
+// The checksums are stored alongside the object, replacing those of a previous object.
+// The object file under objectUid is expected in the staging directory, and is moved into place once committed.
+// In-case of an error, the file object under objectUid is not consumed and should either be retried or removed by the caller,
+// except for ObjectNotDurableError where the object is already committed and the staged file is the only copy of its contents.
+// Returns a boolean indicating whether a new object was created, or if an existing object was replaced (false).
+func (ObjectHandler) PutObject(bucket *CachedBucket, objectUid string, contentTypeMime sql.NullString, digest []byte, checksums Checksums, size uint64, key []byte, allowCreate bool, allowReplace bool, preconditions Preconditions) (isCreated bool, errReturn error) {
 	dbCtx := context.Background()
 	dbConn, err := DB.Conn(dbCtx)
 	if err != nil {
 		log.Println("Problem while acquiring scoped database session ", err)
-		return err
+		return false, err
 	}
 	defer dbConn.Close()
 
-	// We need to acquire an immediate lock here to prevent duplicate files.
+	// We need to acquire an immediate lock here to prevent duplicate files, and so the object can't change between being checked and written.
 	if _, err := dbConn.ExecContext(dbCtx, "BEGIN IMMEDIATE TRANSACTION"); err != nil {
 		log.Println("Problem while acquiring immediate transaction lock ", err)
-		return err
+		return false, err
 	}
 
-	fileId, isNew, err := File.DeduplicateOrCreateFile(dbConn, dbCtx, bucket, objectUid, digest, size)
-	if err != nil {
+	rollback := func() {
 		if _, err := dbConn.ExecContext(dbCtx, "ROLLBACK"); err != nil {
 			log.Println("Problem while rolling back database transaction ", err)
 		}
+	}
 
-		return err
+	// Fetch the object currently under the key, if there is one.
+	var prevFileId int64
+	var prevObject CachedObject
+	err = dbConn.QueryRowContext(dbCtx,
+		"SELECT objects.file_id, objects.created_ms, files.digest FROM objects INNER JOIN files ON objects.file_id = files.id WHERE objects.key = ? AND objects.bucket_id = ?",
+		key, bucket.id,
+	).Scan(&prevFileId, &prevObject.CreatedMs, &prevObject.File.Digest)
+	if err != nil && err != sql.ErrNoRows {
+		rollback()
+
+		log.Println("Problem while finding object by key for put ", err)
+		return false, err
 	}
 
-	// Past this point, we have the fileId of either an existing file with the refcount incremented, or a new file.
+	exists := err == nil
+	if exists && !allowReplace {
+		rollback()
+		return false, ObjectOperationConflictError
+	} else if !exists && !allowCreate {
+		rollback()
+		return false, ObjectNotFoundError
+	}
+
+	// Checking the object is still the version the client expects while holding the lock means no other writer can slip in between.
+	var currentObject *CachedObject
+	if exists {
+		prevObject.File.ETag = File.FormatETag(prevObject.File.Digest)
+		currentObject = &prevObject
+	}
 
-	// Try add the new object to the database.
-	_, err = dbConn.ExecContext(dbCtx,
-		"INSERT INTO objects(bucket_id,file_id,created_ms,key,content_type_mime) VALUES(?,?,?,?,?)",
-		bucket.id, fileId, time.Now().UnixMilli(), key, contentTypeMime, digest,
-	)
+	if Conditional.Evaluate(preconditions, currentObject, false) != PreconditionPassed {
+		rollback()
+		return false, ObjectPreconditionFailedError
+	}
+
+	fileId, isFileNew, err := File.DeduplicateOrCreateFile(dbConn, dbCtx, bucket, objectUid, digest, size)
 	if err != nil {
-		if _, err := dbConn.ExecContext(dbCtx, "ROLLBACK"); err != nil {
-			log.Println("Problem while rolling back database transaction ", err)
-		}
+		rollback()
+		return false, err
+	}
 
-		// If this was a SQLite error indicating that this key already exists.
-		if sqliteError, ok := err.(sqlite3.Error); ok && sqliteError.Code == sqlite3.ErrNo(sqlite3.ErrConstraint) {
-			return ObjectOperationConflictError
+	// Past this point, we have the fileId of either an existing file with the refcount incremented, or a new file.
+
+	// Insert the object, or point the existing object at the new file.
+	// The creation time is reset on replace too, as it is what the object reports as when it was last modified.
+	if _, err := dbConn.ExecContext(dbCtx,
+		`INSERT INTO objects(bucket_id,file_id,created_ms,key,content_type_mime,checksum_sha256,checksum_crc32c) VALUES(?,?,?,?,?,?,?)
+		ON CONFLICT(bucket_id,key) DO UPDATE SET
+			file_id = excluded.file_id, created_ms = excluded.created_ms, content_type_mime = excluded.content_type_mime,
+			checksum_sha256 = excluded.checksum_sha256, checksum_crc32c = excluded.checksum_crc32c`,
+		bucket.id, fileId, time.Now().UnixMilli(), key, contentTypeMime, checksums.SHA256, checksums.CRC32C,
+	); err != nil {
+		rollback()
+
+		log.Println("Problem while writing object to database ", err)
+		return false, err
+	}
+
+	// Decrement the replaced file's reference count.
+	if exists {
+		orphanedFilePath, err := File.DereferenceFile(dbConn, dbCtx, prevFileId)
+		if err != nil {
+			rollback()
+			return false, err
 		}
 
-		log.Println("Problem while inserting object to database ", err)
-		return err
+		// If the reference count for the former file reached 0, it was removed and the disk file can go too.
+		if orphanedFilePath != "" {
+			// We don't want to do a potentially expensive IO operation while keeping the table locked, so we can do it after.
+			defer func() {
+				if errReturn == nil {
+					if err := os.Remove(orphanedFilePath); err != nil {
+						log.Println("Problem while deleting orphaned object file ", err)
+					}
+				}
+			}()
+		}
 	}
 
 	// We're clear!
@@ -78,22 +145,25 @@ func (ObjectHandler) CreateObject(bucket *CachedBucket, objectUid string, conten
 		dbConn.ExecContext(dbCtx, "ROLLBACK")
 
 		log.Println("Problem while committing database transaction ", err)
-		return err
+		return false, err
 	}
 
-	// If we've incremented an existing file reference count, delete the one that was provided.
-	if !isNew {
-		if err := os.Remove(bucket.GetObjectPath(objectUid)); err != nil {
+	// If the uploaded new object wasn't used due to deduplication, remove it, otherwise move it into place.
+	if !isFileNew {
+		if err := os.Remove(File.GetStagingPath(objectUid)); err != nil {
 			log.Println("Problem while removing redundant objectUid "+objectUid+" from disk ", err)
 		}
+	} else if err := File.CommitStagedFile(objectUid, bucket.GetObjectPath(objectUid)); err != nil {
+		// The object is committed and served from the staging directory until the file is moved on the next start, but the write isn't acknowledged as it may not be durable.
+		return false, ObjectNotDurableError
 	}
 
-	return err
+	return !exists, nil
 }
 
-// Attempts to replace an existing object, returning ObjectOperationConflictError if an object under this key doesn't exist.
-// In-case of an error, the file object under objectUid is not consumed and should either be retried or removed by the caller.
-func (ObjectHandler) ReplaceObject(bucket *CachedBucket, objectUid string, contentTypeMime sql.NullString, digest []byte, size uint64, key []byte) (errReturn error) {
+// Attempts to delete an existing object, returning ObjectNotFoundError if an object under this key doesn't exist.
+// The file backing the object is removed from disk if this was its last reference.
+func (ObjectHandler) DeleteObject(bucket *CachedBucket, key []byte) (errReturn error) {
 	dbCtx := context.Background()
 	dbConn, err := DB.Conn(dbCtx)
 	if err != nil {
@@ -102,29 +172,28 @@ func (ObjectHandler) ReplaceObject(bucket *CachedBucket, objectUid string, conte
 	}
 	defer dbConn.Close()
 
-	// We need to acquire an immediate lock here to prevent duplicate files.
+	// We need to acquire an immediate lock here to keep the file reference counts consistent.
 	if _, err := dbConn.ExecContext(dbCtx, "BEGIN IMMEDIATE TRANSACTION"); err != nil {
 		log.Println("Problem while acquiring immediate transaction lock ", err)
 		return err
 	}
 
-	var objectId, prevFileId int64
-
-	// Try fetch the object referenced.
-	if err := dbConn.QueryRowContext(dbCtx, "SELECT id,file_id FROM objects WHERE key = ?", key).Scan(&objectId, &prevFileId); err != nil {
+	// Remove the object, retrieving the file it pointed to.
+	var fileId int64
+	if err := dbConn.QueryRowContext(dbCtx, "DELETE FROM objects WHERE bucket_id = ? AND key = ? RETURNING file_id", bucket.id, key).Scan(&fileId); err != nil {
 		if _, err := dbConn.ExecContext(dbCtx, "ROLLBACK"); err != nil {
 			log.Println("Problem while rolling back database transaction ", err)
 		}
 
 		if err == sql.ErrNoRows {
-			return ObjectOperationConflictError
+			return ObjectNotFoundError
 		}
 
-		log.Println("Problem while finding object by key for replace ", err)
+		log.Println("Problem while deleting object from database ", err)
 		return err
 	}
 
-	fileId, isFileNew, err := File.DeduplicateOrCreateFile(dbConn, dbCtx, bucket, objectUid, digest, size)
+	orphanedFilePath, err := File.DereferenceFile(dbConn, dbCtx, fileId)
 	if err != nil {
 		if _, err := dbConn.ExecContext(dbCtx, "ROLLBACK"); err != nil {
 			log.Println("Problem while rolling back database transaction ", err)
@@ -133,43 +202,11 @@ func (ObjectHandler) ReplaceObject(bucket *CachedBucket, objectUid string, conte
 		return err
 	}
 
-	// Swap the file pointer in the object with the updated one, as well as other parameters.
-	if _, err := dbConn.ExecContext(dbCtx, "UPDATE objects SET file_id = ?, content_type_mime = ? WHERE id = ?", fileId, contentTypeMime, objectId); err != nil {
-		if _, err := dbConn.ExecContext(dbCtx, "ROLLBACK"); err != nil {
-			log.Println("Problem while rolling back database transaction ", err)
-		}
-
-		log.Println("Problem while updating object in database ", err)
-		return err
-	}
-
-	// Decrement the previous file's reference count.
-	var prevRefCount int64
-	if err := dbConn.QueryRowContext(dbCtx, "UPDATE files SET ref_count = ref_count - 1 WHERE id = ? RETURNING ref_count", prevFileId).Scan(&prevRefCount); err != nil {
-		if _, err := dbConn.ExecContext(dbCtx, "ROLLBACK"); err != nil {
-			log.Println("Problem while rolling back database transaction ", err)
-		}
-
-		log.Println("Problem while decrementing ref count for object in database ", err)
-		return err
-	}
-
-	// If the reference count for the former file reached 0, we can remove it entirely.
-	if prevRefCount == 0 {
-		var orphanedFileUid string
-		if err := dbConn.QueryRowContext(dbCtx, "DELETE FROM files WHERE id = ? RETURNING uid", prevFileId).Scan(&orphanedFileUid); err != nil {
-			if _, err := dbConn.ExecContext(dbCtx, "ROLLBACK"); err != nil {
-				log.Println("Problem while rolling back database transaction ", err)
-			}
-
-			log.Println("Problem while deleting zero-reference file in database ", err)
-			return err
-		}
-
-		// We don't want to do a potentially expensive IO operation while keeping the table locked, so we can do it after.
+	// If the file is no longer referenced by anything, remove it from disk once the transaction has been committed.
+	if orphanedFilePath != "" {
 		defer func() {
 			if errReturn == nil {
-				if err := os.Remove(bucket.GetObjectPath(orphanedFileUid)); err != nil {
+				if err := os.Remove(orphanedFilePath); err != nil {
 					log.Println("Problem while deleting orphaned object file ", err)
 				}
 			}
@@ -185,39 +222,173 @@ func (ObjectHandler) ReplaceObject(bucket *CachedBucket, objectUid string, conte
 		return err
 	}
 
-	// If the uploaded new object wasn't used due to deduplication, remove it.
-	if !isFileNew {
-		if err := os.Remove(bucket.GetObjectPath(objectUid)); err != nil {
-			log.Println("Problem while deleting redundant object file ", err)
+	return nil
+}
+
+type ObjectListEntry struct {
+	Key       []byte
+	Size      uint64
+	ETag      []byte
+	CreatedMs uint64
+}
+
+// The position in a bucket's key space to resume a listing from.
+type ObjectListCursor struct {
+	Key       []byte
+	Inclusive bool // Whether the key itself should be included in the listing, otherwise the listing starts after it.
+}
+
+type ObjectListing struct {
+	Objects        []ObjectListEntry
+	CommonPrefixes [][]byte
+	NextCursor     *ObjectListCursor // Where the next page starts, nil if the listing is complete.
+}
+
+var ObjectListCursorInvalidError = errors.New("Invalid listing cursor")
+
+// Encodes the cursor into an opaque URL-safe token that can be handed to a client.
+func (cursor ObjectListCursor) Encode() string {
+	raw := make([]byte, 1, 1+len(cursor.Key))
+	if cursor.Inclusive {
+		raw[0] = 1
+	}
+
+	return base64.RawURLEncoding.EncodeToString(append(raw, cursor.Key...))
+}
+
+// Decodes a token previously created by ObjectListCursor.Encode, returning ObjectListCursorInvalidError if the token is malformed.
+func (ObjectHandler) DecodeListCursor(token []byte) (ObjectListCursor, error) {
+	raw := make([]byte, base64.RawURLEncoding.DecodedLen(len(token)))
+	if _, err := base64.RawURLEncoding.Decode(raw, token); err != nil || len(raw) == 0 || raw[0] > 1 {
+		return ObjectListCursor{}, ObjectListCursorInvalidError
+	}
+
+	return ObjectListCursor{Key: raw[1:], Inclusive: raw[0] == 1}, nil
+}
+
+// Returns the smallest key which is greater than every key starting with the prefix, or nil if no such key exists.
+func keyPrefixUpperBound(prefix []byte) []byte {
+	bound := bytes.Clone(prefix)
+	for i := len(bound) - 1; i >= 0; i-- {
+		if bound[i] != 0xff {
+			bound[i]++
+			return bound[:i+1]
 		}
 	}
 
 	return nil
 }
 
-// Creates a new object from the key, or replaces the file if an object with the specified key already exists.
-// In-case of an error, the file object under objectUid is not consumed and should either be retried or removed by the caller.
-// Takes in booleans 'allowUpdate' and 'allowCreate' which determines whether to allow replacing an existing object with the same key, if an update is required error COROUpdateRequiredError is returned.
-// Returns a boolean indicating whether a new object was created, or if the object's file was replaced (false).
-func (ObjectHandler) CreateOrReplaceObject(bucket *CachedBucket, objectUid string, contentTypeMime sql.NullString, digest []byte, size uint64, key []byte) (bool, error) {
-	err := Object.CreateObject(bucket, objectUid, contentTypeMime, digest, size, key)
-	if err != nil {
-		// If the object under this key already exists.
-		if err == ObjectOperationConflictError {
-			err := Object.ReplaceObject(bucket, objectUid, contentTypeMime, digest, size, key)
-			if err != nil {
-				return false, err
+// Lists up to 'limit' objects and common prefixes in the bucket in key order, starting from the cursor.
+// Only keys starting with the prefix are listed, and if a delimiter is specified, keys containing the delimiter past the prefix are rolled up into a single common prefix.
+// If visible is set, keys it rejects are passed over as if they didn't exist, so they neither count towards the limit nor reveal a common prefix.
+func (ObjectHandler) ListObjects(bucket *CachedBucket, prefix []byte, delimiter []byte, cursor ObjectListCursor, limit int, visible func(key []byte) bool) (*ObjectListing, error) {
+	listing := ObjectListing{Objects: []ObjectListEntry{}, CommonPrefixes: [][]byte{}}
+
+	// The listing can never start before the prefix.
+	if bytes.Compare(cursor.Key, prefix) < 0 {
+		cursor = ObjectListCursor{Key: prefix, Inclusive: true}
+	}
+
+	upperBound := keyPrefixUpperBound(prefix)
+	listed := 0
+
+	for {
+		query := "SELECT objects.key, objects.created_ms, files.size, files.digest FROM objects INNER JOIN files ON objects.file_id = files.id WHERE objects.bucket_id = ?"
+		args := []any{bucket.id}
+
+		// Keys are compared as blobs, which are ordered byte-wise.
+		if cursor.Inclusive {
+			query += " AND objects.key >= ?"
+		} else {
+			query += " AND objects.key > ?"
+		}
+		args = append(args, append([]byte{}, cursor.Key...))
+
+		if upperBound != nil {
+			query += " AND objects.key < ?"
+			args = append(args, upperBound)
+		}
+
+		// Fetch one more than what is needed to know whether there is a next page.
+		requested := limit - listed + 1
+		query += " ORDER BY objects.key ASC LIMIT ?"
+		args = append(args, requested)
+
+		rows, err := DB.Query(query, args...)
+		if err != nil {
+			log.Println("Problem while listing objects from database ", err)
+			return nil, err
+		}
+
+		rowCount := 0
+		rescan := false
+		for rows.Next() {
+			rowCount++
+
+			var entry ObjectListEntry
+			var digest []byte
+			if err := rows.Scan(&entry.Key, &entry.CreatedMs, &entry.Size, &digest); err != nil {
+				rows.Close()
+				log.Println("Problem while reading listed objects from database ", err)
+				return nil, err
+			}
+
+			if visible != nil && !visible(entry.Key) {
+				cursor = ObjectListCursor{Key: entry.Key, Inclusive: false}
+				continue
+			}
+
+			// Everything that fits has been listed, so the current cursor is where the next page starts.
+			if listed == limit {
+				listing.NextCursor = &cursor
+				break
 			}
 
-			return false, nil
+			listed++
+
+			// Roll the key up into a common prefix if it contains the delimiter, and skip past every other key sharing it.
+			if len(delimiter) != 0 {
+				if index := bytes.Index(entry.Key[len(prefix):], delimiter); index != -1 {
+					commonPrefix := entry.Key[:len(prefix)+index+len(delimiter)]
+					listing.CommonPrefixes = append(listing.CommonPrefixes, commonPrefix)
+
+					cursor = ObjectListCursor{Key: keyPrefixUpperBound(commonPrefix), Inclusive: true}
+					rescan = cursor.Key != nil
+					break
+				}
+			}
+
+			entry.ETag = File.FormatETag(digest)
+			listing.Objects = append(listing.Objects, entry)
+			cursor = ObjectListCursor{Key: entry.Key, Inclusive: false}
 		}
 
-		// Fallback on unexpected error.
-		return false, err
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			log.Println("Problem while reading listed objects from database ", err)
+			return nil, err
+		}
+
+		rows.Close()
+
+		// If every fetched key was passed over without filling the page, there may still be keys past them.
+		if !rescan && listing.NextCursor == nil && rowCount == requested && cursor.Key != nil {
+			rescan = true
+		}
+
+		// Stop once the page is full or there are no keys left, otherwise continue past the common prefix.
+		if !rescan || listing.NextCursor != nil || rowCount == 0 {
+			break
+		}
 	}
 
-	// New object created successfully.
-	return true, nil
+	// A common prefix consisting of only 0xff bytes has nothing past it, so the listing is complete.
+	if listing.NextCursor != nil && listing.NextCursor.Key == nil {
+		listing.NextCursor = nil
+	}
+
+	return &listing, nil
 }
 
 // TODO: cache objects.
@@ -225,14 +396,14 @@ func (ObjectHandler) GetObjectByKey(bucket *CachedBucket, key []byte) (*CachedOb
 	var object CachedObject
 	if err := DB.QueryRow(
 		`SELECT
-			objects.id, objects.created_ms, objects.content_type_mime, objects.key,
-			files.id, files.digest, files.size, files.uid
+			objects.id, objects.created_ms, objects.content_type_mime, objects.key, objects.checksum_sha256, objects.checksum_crc32c,
+			files.id, files.bucket_id, files.digest, files.size, files.uid, files.shared, files.sharded, files.corrupted
 		FROM objects INNER JOIN files ON objects.file_id = files.id 
 		WHERE objects.key = ? AND objects.bucket_id = ?`,
 		key, bucket.id,
 	).Scan(
-		&object.id, &object.CreatedMs, &object.ContentTypeMime, &object.Key,
-		&object.File.id, &object.File.Digest, &object.File.Size, &object.File.UID,
+		&object.id, &object.CreatedMs, &object.ContentTypeMime, &object.Key, &object.Checksums.SHA256, &object.Checksums.CRC32C,
+		&object.File.id, &object.File.bucketId, &object.File.Digest, &object.File.Size, &object.File.UID, &object.File.Shared, &object.File.sharded, &object.File.Corrupted,
 	); err != nil {
 		// No object with this key exists.
 		if err == sql.ErrNoRows {
@@ -244,44 +415,11 @@ func (ObjectHandler) GetObjectByKey(bucket *CachedBucket, key []byte) (*CachedOb
 	}
 
 	// Parse the ETag into a HTTP-ready format.
-	etagSize := base64.RawURLEncoding.EncodedLen(len(object.File.Digest)) + 2
-	object.File.ETag = make([]byte, etagSize)
-	object.File.ETag[0] = '"'
-	object.File.ETag[etagSize-1] = '"'
-	base64.RawURLEncoding.Encode(object.File.ETag[1:etagSize-1], object.File.Digest)
+	object.File.ETag = File.FormatETag(object.File.Digest)
 
 	return &object, nil
 }
 
-func (ObjectHandler) InitDBTables() {
-	var err error
-
-	_, err = DB.Exec(`
-		CREATE TABLE IF NOT EXISTS objects (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			bucket_id INTEGER NOT NULL,
-			file_id INTEGER NOT NULL,
-			created_ms UNSIGNED BIGINT NOT NULL,
-			
-			key BLOB NOT NULL, -- <- this is a blob on purpose so that we can search the key directly without converting fasthttp's path to a string first.
-			content_type_mime TEXT,
-
-			FOREIGN KEY (bucket_id) REFERENCES buckets (id) ON DELETE CASCADE,
-			FOREIGN KEY (file_id) REFERENCES files (id),
-			UNIQUE (bucket_id, key)
-		)
-	`)
-
-	if err != nil {
-		log.Fatal("Error while creating objects table ", err)
-	}
-
-	_, err = DB.Exec("CREATE INDEX idx_objects_file_id ON objects(file_id)")
-	if err != nil {
-		log.Fatal("Error while creating files digest index ", err)
-	}
-}
-
 type ObjectHandler struct{}
 
 var Object = ObjectHandler{}
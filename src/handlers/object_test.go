@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/zeebo/blake3"
+)
+
+func TestListObjects(t *testing.T) {
+	bucket := getTestBucket(t)
+	for _, key := range []string{"/list/a", "/list/dir/b", "/list/dir/c", "/list/hidden/d", "/list/other/e", "/list/z"} {
+		putTestObject(t, bucket, key, key)
+	}
+
+	hidden := func(key []byte) bool {
+		return !bytes.HasPrefix(key, []byte("/list/hidden/"))
+	}
+
+	tests := []struct {
+		name      string
+		prefix    string
+		delimiter string
+		limit     int
+		visible   func(key []byte) bool
+		objects   []string
+		prefixes  []string
+		truncated bool
+	}{
+		{name: "everything", prefix: "/list/", limit: 10, objects: []string{"/list/a", "/list/dir/b", "/list/dir/c", "/list/hidden/d", "/list/other/e", "/list/z"}},
+		{name: "limit leaves next page", prefix: "/list/", limit: 2, objects: []string{"/list/a", "/list/dir/b"}, truncated: true},
+		{name: "limit exactly fits", prefix: "/list/dir/", limit: 2, objects: []string{"/list/dir/b", "/list/dir/c"}},
+		{name: "delimiter rollup", prefix: "/list/", delimiter: "/", limit: 10, objects: []string{"/list/a", "/list/z"}, prefixes: []string{"/list/dir/", "/list/hidden/", "/list/other/"}},
+		{name: "rolled up prefixes count towards limit", prefix: "/list/", delimiter: "/", limit: 2, objects: []string{"/list/a"}, prefixes: []string{"/list/dir/"}, truncated: true},
+		{name: "hidden keys reveal no prefix", prefix: "/list/", delimiter: "/", limit: 10, visible: hidden, objects: []string{"/list/a", "/list/z"}, prefixes: []string{"/list/dir/", "/list/other/"}},
+		{name: "hidden keys take no slot", prefix: "/list/hidden/", limit: 1, visible: hidden},
+		{name: "prefix without matches", prefix: "/nothing/", limit: 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listing, err := Object.ListObjects(bucket, []byte(test.prefix), []byte(test.delimiter), ObjectListCursor{}, test.limit, test.visible)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var objects, prefixes []string
+			for _, object := range listing.Objects {
+				objects = append(objects, string(object.Key))
+			}
+			for _, prefix := range listing.CommonPrefixes {
+				prefixes = append(prefixes, string(prefix))
+			}
+
+			if !slices.Equal(objects, test.objects) || !slices.Equal(prefixes, test.prefixes) || (listing.NextCursor != nil) != test.truncated {
+				t.Errorf("got objects %v, prefixes %v, truncated %v; want %v, %v, %v", objects, prefixes, listing.NextCursor != nil, test.objects, test.prefixes, test.truncated)
+			}
+		})
+	}
+}
+
+func TestListObjectsPagination(t *testing.T) {
+	bucket := getTestBucket(t)
+	for _, key := range []string{"/page/1", "/page/2", "/page/3", "/page/4", "/page/5"} {
+		putTestObject(t, bucket, key, key)
+	}
+
+	// Walking the pages through encoded cursors must list every key exactly once, in order.
+	var keys []string
+	cursor := ObjectListCursor{}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("listing never completed")
+		}
+
+		listing, err := Object.ListObjects(bucket, []byte("/page/"), nil, cursor, 2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, object := range listing.Objects {
+			keys = append(keys, string(object.Key))
+		}
+
+		if listing.NextCursor == nil {
+			break
+		}
+
+		if cursor, err = Object.DecodeListCursor([]byte(listing.NextCursor.Encode())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"/page/1", "/page/2", "/page/3", "/page/4", "/page/5"}; !slices.Equal(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+
+	if _, err := Object.DecodeListCursor([]byte("!!")); err != ObjectListCursorInvalidError {
+		t.Errorf("invalid cursor gave %v", err)
+	}
+}
+
+func TestPutObjectUnmovableFile(t *testing.T) {
+	bucket := getTestBucket(t)
+
+	content := []byte("unmovable")
+	objectUid := Misc.NewRandomUID()
+	if err := os.MkdirAll(path.Dir(getStagingPath(objectUid)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(getStagingPath(objectUid), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory in the way of the final location stops the file from being moved there.
+	if err := os.MkdirAll(path.Join(bucket.GetObjectPath(objectUid), "blocker"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := blake3.Sum256(content)
+	if _, err := Object.PutObject(bucket, objectUid, sql.NullString{}, digest[:], Checksums{}, uint64(len(content)), []byte("/unmovable"), true, true, Preconditions{}); err != ObjectNotDurableError {
+		t.Fatalf("storing an object whose file couldn't be moved into place gave %v, want ObjectNotDurableError", err)
+	}
+
+	// The row is kept so the file can still be served from staging and moved on the next start.
+	object, err := Object.GetObjectByKey(bucket, []byte("/unmovable"))
+	if err != nil || object == nil {
+		t.Fatalf("fetching object: %v", err)
+	}
+
+	file, err := object.File.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+}
@@ -0,0 +1,15 @@
+//go:build cgo
+
+package handlers
+
+import (
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Determines whether the error is SQLite refusing a statement which would violate a constraint (e.g. a unique index).
+func isConstraintError(err error) bool {
+	var sqliteError sqlite3.Error
+	return errors.As(err, &sqliteError) && sqliteError.Code == sqlite3.ErrConstraint
+}
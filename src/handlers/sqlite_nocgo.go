@@ -0,0 +1,8 @@
+//go:build !cgo
+
+package handlers
+
+// The SQLite driver only exists with cgo, without it no statement can fail on a constraint.
+func isConstraintError(err error) bool {
+	return false
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import "sync/atomic"
+
+// How a download ended.
+type DownloadOutcome uint8
+
+const (
+	DownloadCompleted  DownloadOutcome = iota
+	DownloadClientGone                 // The connection failed while writing, usually as the client disconnected.
+	DownloadTimedOut                   // The client stopped reading for longer than the write timeout.
+	DownloadTooSlow                    // The client read slower than the minimum transfer rate.
+	DownloadReadFailed                 // The object file couldn't be read.
+)
+
+type DownloadStats struct {
+	Completed          uint64 `json:"completed"`
+	AbortedClientGone  uint64 `json:"aborted_client_gone"`
+	AbortedTimedOut    uint64 `json:"aborted_timed_out"`
+	AbortedTooSlow     uint64 `json:"aborted_too_slow"`
+	AbortedReadFailure uint64 `json:"aborted_read_failure"`
+}
+
+// Counted since the server started.
+var downloadOutcomes [DownloadReadFailed + 1]atomic.Uint64
+
+func (StatsHandler) RecordDownload(outcome DownloadOutcome) {
+	downloadOutcomes[outcome].Add(1)
+}
+
+func (StatsHandler) GetDownloadStats() DownloadStats {
+	return DownloadStats{
+		Completed:          downloadOutcomes[DownloadCompleted].Load(),
+		AbortedClientGone:  downloadOutcomes[DownloadClientGone].Load(),
+		AbortedTimedOut:    downloadOutcomes[DownloadTimedOut].Load(),
+		AbortedTooSlow:     downloadOutcomes[DownloadTooSlow].Load(),
+		AbortedReadFailure: downloadOutcomes[DownloadReadFailed].Load(),
+	}
+}
+
+type StatsHandler struct{}
+
+var Stats = StatsHandler{}
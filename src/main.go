@@ -1,47 +1,210 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"os"
+	"os/signal"
 	"speedyvault/src/config"
 	"speedyvault/src/handlers"
 	"speedyvault/src/routes"
+	"syscall"
+	"time"
 
 	"github.com/valyala/fasthttp"
 )
 
 var server *fasthttp.Server
+var adminServer *fasthttp.Server
 
 func main() {
+	configPath := flag.String("config", "", "path to a JSON config file, any fields not specified use the defaults")
+	debugMode := flag.Bool("debug", false, "run in debug mode (in-memory database with test rows), overrides the config")
+	collectGarbage := flag.Bool("gc", false, "remove untracked files from the data directory and report missing ones, then exit")
+	scrub := flag.Bool("scrub", false, "verify every file against its digest, report the ones which are corrupted, then exit")
+	auditRefCounts := flag.Bool("fsck", false, "recompute file reference counts, repair any that have drifted and remove unreferenced files, then exit")
+	migrateLayout := flag.Bool("migrate-layout", false, "move files predating the fan-out directory layout into it, then exit (also done in the background on start)")
+	dryRun := flag.Bool("dry-run", false, "only report what one-off maintenance commands would do without changing anything")
+	flag.Parse()
+
+	// Load the config before anything else depends on it.
+	if err := config.LoadAppConfig(*configPath); err != nil {
+		log.Fatal(err)
+	}
+
+	if *debugMode {
+		config.AppConfig.DebugMode = true
+	}
+
 	// Initialize the database.
 	handlers.Database.InitDatabase()
 
-	// Create a router to route requests to the correct handler.
-	requestRouter := func(ctx *fasthttp.RequestCtx) {
-		if ctx.IsPut() {
-			routes.BucketUpload(ctx)
-		} else if ctx.IsGet() {
-			if len(ctx.Request.Header.Peek("content-length")) != 0 {
-				ctx.Error("body not allowed in GET requests", 400)
-				ctx.SetConnectionClose()
-				return
-			}
+	// One-off maintenance commands run instead of the server.
+	if *collectGarbage {
+		report, err := handlers.Maintenance.CollectGarbage(*dryRun)
+		if err != nil {
+			log.Fatal("Garbage collection failed ", err)
+		}
+
+		report.Log(true)
+		return
+	}
+
+	if *auditRefCounts {
+		report, err := handlers.Maintenance.AuditReferenceCounts(*dryRun)
+		if err != nil {
+			log.Fatal("Reference count audit failed ", err)
+		}
+
+		report.Log()
+		return
+	}
+
+	if *migrateLayout {
+		report, err := handlers.Maintenance.MigrateFileLayout()
+		if err != nil {
+			log.Fatal("File layout migration failed ", err)
+		}
 
-			routes.ObjectDownload(ctx)
-		} else {
-			ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+		report.Log()
+		return
+	}
+
+	if *scrub {
+		report, err := handlers.Maintenance.ScrubFiles(true)
+		if err != nil {
+			log.Fatal("Scrub failed ", err)
+		}
+
+		report.Log()
+
+		corruptedFiles, err := handlers.Maintenance.GetCorruptedFiles()
+		if err != nil {
+			log.Fatal("Fetching corrupted files failed ", err)
+		}
+
+		for _, file := range corruptedFiles {
+			log.Printf("Corrupted file %d of bucket %d at %s used by %d objects:", file.FileId, file.BucketId, file.Path, len(file.Objects))
+			for _, object := range file.Objects {
+				log.Printf("  %s %q", object.Bucket, object.Key)
+			}
 		}
+
+		return
+	}
+
+	// Uploads interrupted by the server stopping may have left files in the staging directory.
+	if err := handlers.Maintenance.RecoverStagedFiles(); err != nil {
+		log.Fatal("Recovering staged files failed ", err)
+	}
+
+	// Uploads interrupted while completing would otherwise stay locked (and never expire).
+	if err := handlers.Multipart.UnlockInterruptedUploads(); err != nil {
+		log.Fatal("Unlocking interrupted multipart uploads failed ", err)
+	}
+
+	// Move files predating the fan-out directory layout while serving requests.
+	handlers.Maintenance.StartLayoutMigration()
+
+	// Periodically clean up multipart uploads that were never completed.
+	handlers.Multipart.StartExpirySweeper()
+
+	// Periodically clean up files left behind on disk.
+	if config.AppConfig.GarbageCollectionIntervalMs != 0 {
+		handlers.Maintenance.StartGarbageCollector()
+	}
+
+	// Periodically verify files haven't been corrupted at rest.
+	if config.AppConfig.ScrubIntervalMs != 0 {
+		handlers.Maintenance.StartScrubber()
 	}
 
 	server = &fasthttp.Server{
-		Handler:           requestRouter,
+		Handler:           routes.RequestRouter,
 		StreamRequestBody: true,
 		//WriteBufferSize: 2,
 		MaxRequestBodySize: 1, // 100 MB
 	}
 
+	// The admin API runs on its own listener so that it can be kept off the public network.
+	if config.AppConfig.AdminListenInterfacePort != "" {
+		adminServer = &fasthttp.Server{
+			Handler:            routes.AdminRouter,
+			MaxRequestBodySize: 65536,
+		}
+
+		go func() {
+			log.Println("Listening for admin requests on", config.AppConfig.AdminListenInterfacePort)
+			if err := adminServer.ListenAndServe(config.AppConfig.AdminListenInterfacePort); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	// Setup HTTP server and listen for requests.
-	log.Println("Listening for requests on", config.AppConfig.ListenInterfacePort)
-	if err := server.ListenAndServe(config.AppConfig.ListenInterfacePort); err != nil {
-		log.Fatal(err)
+	go func() {
+		log.Println("Listening for requests on", config.AppConfig.ListenInterfacePort)
+		if err := server.ListenAndServe(config.AppConfig.ListenInterfacePort); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait until we're asked to stop.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	shutdown()
+}
+
+// Stops accepting new requests and gives the ones in progress until the deadline to finish, removing incomplete uploads if they don't.
+// Background tasks are stopped alongside, and the database is only closed once they have returned.
+func shutdown() {
+	log.Println("Shutting down, waiting for in-progress requests to finish")
+
+	// Background tasks return at the next opportunity, so they can finish while requests are being drained.
+	handlers.Lifecycle.StopBackgroundTasks()
+
+	deadline := time.Duration(config.AppConfig.ShutdownDeadlineMs) * time.Millisecond
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	if adminServer != nil {
+		if err := adminServer.ShutdownWithContext(shutdownCtx); err != nil {
+			log.Println("Problem while shutting down admin server ", err)
+		}
+	}
+
+	// Waits for requests (including uploads and downloads) to finish.
+	if err := server.ShutdownWithContext(shutdownCtx); err != nil {
+		log.Println("Problem while shutting down server ", err)
+	}
+
+	// Uploads are also tracked separately, so that the incomplete ones can be removed if they didn't finish in time.
+	remaining := time.Duration(0)
+	if shutdownDeadline, ok := shutdownCtx.Deadline(); ok {
+		remaining = time.Until(shutdownDeadline)
+	}
+
+	if !handlers.Lifecycle.WaitForTransfers(max(remaining, 0)) {
+		log.Println("Shutdown deadline exceeded, forcefully exiting and removing incomplete uploads")
+		handlers.Lifecycle.RemovePartialFiles()
 	}
+
+	// Closing the database from under a background task would fail it part way, SQLite recovers from not being closed instead.
+	if shutdownDeadline, ok := shutdownCtx.Deadline(); ok {
+		remaining = time.Until(shutdownDeadline)
+	}
+
+	if !handlers.Lifecycle.WaitForBackgroundTasks(max(remaining, 0)) {
+		log.Println("Background tasks didn't stop before the shutdown deadline, exiting without closing database")
+		return
+	}
+
+	if err := handlers.DB.Close(); err != nil {
+		log.Println("Problem while closing database ", err)
+	}
+
+	log.Println("Shutdown complete")
 }
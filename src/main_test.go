@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"os"
+	"speedyvault/src/config"
+	"speedyvault/src/handlers"
+	"speedyvault/src/routes"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	config.AppConfig.DataDirectory = t.TempDir()
+	config.AppConfig.DebugMode = true
+	config.AppConfig.UploadDurability = config.DurabilityNone
+	config.AppConfig.ShutdownDeadlineMs = 5000
+	handlers.Database.InitDatabase()
+
+	listener := fasthttputil.NewInmemoryListener()
+	server = &fasthttp.Server{Handler: routes.RequestRouter, StreamRequestBody: true}
+	go server.Serve(listener)
+
+	// The database must stay open for a background task still finishing up after being asked to stop, even once requests are drained.
+	taskErr := make(chan error, 1)
+	taskRelease := make(chan struct{})
+	handlers.Lifecycle.RunBackgroundTask(func(stop <-chan struct{}) {
+		<-stop
+		<-taskRelease
+		_, err := handlers.DB.Exec("SELECT 1")
+		taskErr <- err
+	})
+
+	// Start an upload whose body is only partly sent when the shutdown begins.
+	content := []byte("uploaded while shutting down")
+	bodyReader, bodyWriter := io.Pipe()
+
+	request := fasthttp.AcquireRequest()
+	request.Header.SetMethod(fasthttp.MethodPut)
+	request.SetRequestURI("http://vault/shutdown/object")
+	request.Header.Set("X-SV-RP-Bucket", "test-bucket")
+	request.Header.Set("X-SV-Auth-Key", base64.RawStdEncoding.EncodeToString([]byte("canttouchthiscanttouchthissomemrcanttouchthiscanttouchthissomemr")))
+	request.SetBodyStream(bodyReader, len(content))
+
+	response := &fasthttp.Response{}
+	uploaded := make(chan error, 1)
+	go func() {
+		client := &fasthttp.Client{Dial: func(string) (net.Conn, error) { return listener.Dial() }}
+		uploaded <- client.Do(request, response)
+	}()
+
+	if _, err := bodyWriter.Write(content[:10]); err != nil {
+		t.Fatal(err)
+	}
+	for handlers.Lifecycle.WaitForTransfers(time.Millisecond) {
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		shutdown()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("shutdown finished while an upload was in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := bodyWriter.Write(content[10:]); err != nil {
+		t.Fatal(err)
+	}
+	bodyWriter.Close()
+
+	if err := <-uploaded; err != nil || response.StatusCode() != 201 {
+		t.Fatalf("upload during shutdown gave status %d with error %v, want 201", response.StatusCode(), err)
+	}
+
+	// Idle connections are only closed periodically, so the shutdown is given a while to finish draining.
+	select {
+	case <-stopped:
+		t.Fatal("shutdown finished while a background task was still running")
+	case <-time.After(time.Second):
+	}
+	close(taskRelease)
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't finish after the upload")
+	}
+
+	if err := <-taskErr; err != nil {
+		t.Errorf("background task couldn't use the database after being stopped: %v", err)
+	}
+
+	// Nothing partial is left behind by an upload which finished in time.
+	entries, err := os.ReadDir(handlers.File.GetStagingPath(""))
+	if err == nil && len(entries) != 0 {
+		t.Errorf("staging directory holds %d files after shutdown", len(entries))
+	}
+}
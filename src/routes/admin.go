@@ -0,0 +1,394 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"regexp"
+	"speedyvault/src/handlers"
+	. "speedyvault/src/handlers/constants"
+	"speedyvault/src/routes/middleware"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Buckets are addressed by subdomain, so their names must be valid DNS labels.
+var bucketNameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+type adminNameRequest struct {
+	Name string `json:"name"`
+}
+
+type adminBucketRequest struct {
+	Name          string `json:"name"`
+	SharedStorage bool   `json:"shared_storage"`
+}
+
+type adminAPIKeyResponse struct {
+	*handlers.AdminAPIKey
+	Key string `json:"key"`
+}
+
+type adminMACSelectorRequest struct {
+	Selector uint32 `json:"selector"`
+	Secret   string `json:"secret"` // Base64 encoded, generated if left empty.
+}
+
+type adminMACSelectorResponse struct {
+	*handlers.AdminMACSelector
+	Secret string `json:"secret"`
+}
+
+type adminAccessRuleResponse struct {
+	*handlers.AdminAccessRule
+	Warning string `json:"warning,omitempty"`
+}
+
+// Writes the value as a JSON response with the status code.
+func writeAdminJSON(ctx *fasthttp.RequestCtx, status int, value any) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		log.Println("Problem while encoding admin response ", err)
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+// Converts an error returned by the admin handler into the appropriate response.
+func writeAdminError(ctx *fasthttp.RequestCtx, err error) {
+	switch err {
+	case handlers.AdminNotFoundError:
+		ctx.Error("resource not found", 404)
+	case handlers.AdminConflictError:
+		ctx.Error("resource conflicts with an existing resource", 409)
+	default:
+		ctx.SetStatusCode(500)
+	}
+}
+
+// Decodes the JSON request body into the value.
+// If the body is invalid, false is returned and the response is modified to reflect this.
+func readAdminJSON(ctx *fasthttp.RequestCtx, value any) bool {
+	if err := json.Unmarshal(ctx.PostBody(), value); err != nil {
+		ctx.Error("invalid JSON body", 400)
+		return false
+	}
+
+	return true
+}
+
+// Validates an access rule, returning a warning if the rule is valid but likely not what was intended.
+// If the rule is invalid, false is returned and the response is modified to reflect this.
+func validateAdminAccessRule(ctx *fasthttp.RequestCtx, rule *handlers.AdminAccessRule) (string, bool) {
+	if _, err := regexp.Compile(rule.Regex); err != nil {
+		ctx.Error("invalid rule regex: "+err.Error(), 400)
+		return "", false
+	}
+
+	if rule.Action > DenyAll {
+		ctx.Error("invalid rule action", 400)
+		return "", false
+	}
+
+	// Rules pass with partial matches, which is rarely the intention without anchors.
+	if !strings.HasPrefix(rule.Regex, "^") || !strings.HasSuffix(rule.Regex, "$") {
+		return "regex is not anchored with ^ and $, the rule will also apply to keys which only partially match", true
+	}
+
+	return "", true
+}
+
+func AdminRouter(ctx *fasthttp.RequestCtx) {
+	if !middleware.AuthorizeAdminRequest(ctx) {
+		return
+	}
+
+	// Report of files which failed integrity verification.
+	if string(ctx.Path()) == "/integrity" {
+		if !ctx.IsGet() {
+			ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+			return
+		}
+
+		corruptedFiles, err := handlers.Maintenance.GetCorruptedFiles()
+		if err != nil {
+			writeAdminError(ctx, err)
+			return
+		}
+
+		writeAdminJSON(ctx, 200, corruptedFiles)
+		return
+	}
+
+	// Counters of how downloads ended since the server started.
+	if string(ctx.Path()) == "/stats" {
+		if !ctx.IsGet() {
+			ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+			return
+		}
+
+		writeAdminJSON(ctx, 200, handlers.Stats.GetDownloadStats())
+		return
+	}
+
+	// Paths take the form of /buckets/{bucket}/{resource}/{id}.
+	segments := strings.Split(strings.Trim(string(ctx.Path()), "/"), "/")
+	if segments[0] != "buckets" || len(segments) > 4 {
+		ctx.Error("unknown admin route", 404)
+		return
+	}
+
+	switch len(segments) {
+	case 1:
+		adminBuckets(ctx)
+	case 2:
+		adminBucket(ctx, segments[1])
+	case 3:
+		adminBucketResources(ctx, segments[1], segments[2])
+	case 4:
+		id, err := strconv.ParseInt(segments[3], 10, 64)
+		if err != nil {
+			ctx.Error("invalid resource id", 400)
+			return
+		}
+
+		adminBucketResource(ctx, segments[1], segments[2], id)
+	}
+}
+
+func adminBuckets(ctx *fasthttp.RequestCtx) {
+	switch {
+	case ctx.IsGet():
+		buckets, err := handlers.Admin.ListBuckets()
+		if err != nil {
+			writeAdminError(ctx, err)
+			return
+		}
+
+		writeAdminJSON(ctx, 200, buckets)
+
+	case ctx.IsPost():
+		var request adminBucketRequest
+		if !readAdminJSON(ctx, &request) {
+			return
+		}
+
+		if !bucketNameRegex.MatchString(request.Name) {
+			ctx.Error("invalid bucket name", 400)
+			return
+		}
+
+		bucket, err := handlers.Admin.CreateBucket(request.Name, request.SharedStorage)
+		if err != nil {
+			writeAdminError(ctx, err)
+			return
+		}
+
+		writeAdminJSON(ctx, 201, bucket)
+
+	default:
+		ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+func adminBucket(ctx *fasthttp.RequestCtx, bucketName string) {
+	switch {
+	case ctx.IsPatch():
+		var request adminNameRequest
+		if !readAdminJSON(ctx, &request) {
+			return
+		}
+
+		if !bucketNameRegex.MatchString(request.Name) {
+			ctx.Error("invalid bucket name", 400)
+			return
+		}
+
+		if err := handlers.Admin.RenameBucket(bucketName, request.Name); err != nil {
+			writeAdminError(ctx, err)
+			return
+		}
+
+		ctx.SetStatusCode(204)
+
+	case ctx.IsDelete():
+		if err := handlers.Admin.DeleteBucket(bucketName); err != nil {
+			writeAdminError(ctx, err)
+			return
+		}
+
+		ctx.SetStatusCode(204)
+
+	default:
+		ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+func adminBucketResources(ctx *fasthttp.RequestCtx, bucketName string, resource string) {
+	switch {
+	case ctx.IsGet():
+		var list any
+		var err error
+
+		switch resource {
+		case "api-keys":
+			list, err = handlers.Admin.ListAPIKeys(bucketName)
+		case "mac-selectors":
+			list, err = handlers.Admin.ListMACSelectors(bucketName)
+		case "access-rules":
+			list, err = handlers.Admin.ListAccessRules(bucketName)
+		default:
+			ctx.Error("unknown admin route", 404)
+			return
+		}
+
+		if err != nil {
+			writeAdminError(ctx, err)
+			return
+		}
+
+		writeAdminJSON(ctx, 200, list)
+
+	case ctx.IsPost():
+		switch resource {
+		case "api-keys":
+			var request adminNameRequest
+			if !readAdminJSON(ctx, &request) {
+				return
+			}
+
+			if len(request.Name) == 0 || len(request.Name) > 64 {
+				ctx.Error("invalid API key name", 400)
+				return
+			}
+
+			key, secret, err := handlers.Admin.CreateAPIKey(bucketName, request.Name)
+			if err != nil {
+				writeAdminError(ctx, err)
+				return
+			}
+
+			writeAdminJSON(ctx, 201, adminAPIKeyResponse{AdminAPIKey: key, Key: secret})
+
+		case "mac-selectors":
+			var request adminMACSelectorRequest
+			if !readAdminJSON(ctx, &request) {
+				return
+			}
+
+			var secret []byte
+			if request.Secret != "" {
+				var err error
+				if secret, err = base64.StdEncoding.DecodeString(request.Secret); err != nil || len(secret) != 32 {
+					ctx.Error("MAC secret must be 32 bytes encoded in base64", 400)
+					return
+				}
+			}
+
+			selector, secret, err := handlers.Admin.CreateMACSelector(bucketName, request.Selector, secret)
+			if err != nil {
+				writeAdminError(ctx, err)
+				return
+			}
+
+			writeAdminJSON(ctx, 201, adminMACSelectorResponse{AdminMACSelector: selector, Secret: base64.StdEncoding.EncodeToString(secret)})
+
+		case "access-rules":
+			var request handlers.AdminAccessRule
+			if !readAdminJSON(ctx, &request) {
+				return
+			}
+
+			warning, ok := validateAdminAccessRule(ctx, &request)
+			if !ok {
+				return
+			}
+
+			rule, err := handlers.Admin.CreateAccessRule(bucketName, request)
+			if err != nil {
+				writeAdminError(ctx, err)
+				return
+			}
+
+			writeAdminJSON(ctx, 201, adminAccessRuleResponse{AdminAccessRule: rule, Warning: warning})
+
+		default:
+			ctx.Error("unknown admin route", 404)
+		}
+
+	default:
+		ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+	}
+}
+
+func adminBucketResource(ctx *fasthttp.RequestCtx, bucketName string, resource string, id int64) {
+	switch {
+	case ctx.IsDelete():
+		var err error
+
+		switch resource {
+		case "api-keys":
+			err = handlers.Admin.DeleteAPIKey(bucketName, id)
+		case "mac-selectors":
+			err = handlers.Admin.DeleteMACSelector(bucketName, id)
+		case "access-rules":
+			err = handlers.Admin.DeleteAccessRule(bucketName, id)
+		default:
+			ctx.Error("unknown admin route", 404)
+			return
+		}
+
+		if err != nil {
+			writeAdminError(ctx, err)
+			return
+		}
+
+		ctx.SetStatusCode(204)
+
+	case ctx.IsPatch() && resource == "api-keys":
+		var request adminNameRequest
+		if !readAdminJSON(ctx, &request) {
+			return
+		}
+
+		if len(request.Name) == 0 || len(request.Name) > 64 {
+			ctx.Error("invalid API key name", 400)
+			return
+		}
+
+		if err := handlers.Admin.RenameAPIKey(bucketName, id, request.Name); err != nil {
+			writeAdminError(ctx, err)
+			return
+		}
+
+		ctx.SetStatusCode(204)
+
+	case ctx.IsPut() && resource == "access-rules":
+		var request handlers.AdminAccessRule
+		if !readAdminJSON(ctx, &request) {
+			return
+		}
+
+		warning, ok := validateAdminAccessRule(ctx, &request)
+		if !ok {
+			return
+		}
+
+		request.Id = id
+		if err := handlers.Admin.UpdateAccessRule(bucketName, request); err != nil {
+			writeAdminError(ctx, err)
+			return
+		}
+
+		writeAdminJSON(ctx, 200, adminAccessRuleResponse{AdminAccessRule: &request, Warning: warning})
+
+	default:
+		ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,252 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"speedyvault/src/config"
+	"speedyvault/src/handlers"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+const testAdminKey = "adminrootkeyadminrootkey"
+
+// Serves the admin routes the same way the admin server does, returning a client connected to it.
+func newAdminTestClient(t *testing.T) *fasthttp.Client {
+	t.Helper()
+
+	rootKey := config.AppConfig.AdminRootKey
+	config.AppConfig.AdminRootKey = testAdminKey
+	t.Cleanup(func() { config.AppConfig.AdminRootKey = rootKey })
+
+	return serveTestClient(t, &fasthttp.Server{Handler: AdminRouter, MaxRequestBodySize: 65536})
+}
+
+// Sends an admin request with the admin key, encoding the value (unless nil) as the JSON body.
+func doAdminRequest(t *testing.T, client *fasthttp.Client, method string, path string, value any, adminKey string) *fasthttp.Response {
+	t.Helper()
+
+	request := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(request)
+
+	request.Header.SetMethod(method)
+	request.SetRequestURI("http://admin" + path)
+	request.Header.Set("X-SV-Admin-Key", adminKey)
+	if value != nil {
+		body, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		request.SetBody(body)
+	}
+
+	response := &fasthttp.Response{}
+	if err := client.Do(request, response); err != nil {
+		t.Fatal(err)
+	}
+
+	return response
+}
+
+// Decodes the JSON body of the response into the value, failing the test if the status isn't the one expected.
+func readAdminResponse(t *testing.T, response *fasthttp.Response, status int, value any) {
+	t.Helper()
+
+	if response.StatusCode() != status {
+		t.Fatalf("got status %d, want %d: %s", response.StatusCode(), status, response.Body())
+	}
+
+	if value != nil {
+		if err := json.Unmarshal(response.Body(), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAdminRouterAuthorization(t *testing.T) {
+	client := newAdminTestClient(t)
+
+	for _, adminKey := range []string{"", "wrong", testAdminKey + "x", testAdminKey[:len(testAdminKey)-1]} {
+		for _, path := range []string{"/buckets", "/stats", "/integrity", "/unknown"} {
+			if response := doAdminRequest(t, client, fasthttp.MethodGet, path, nil, adminKey); response.StatusCode() != 401 {
+				t.Errorf("request to %s with key %q gave status %d, want 401", path, adminKey, response.StatusCode())
+			}
+		}
+	}
+
+	if response := doAdminRequest(t, client, fasthttp.MethodGet, "/buckets", nil, testAdminKey); response.StatusCode() != 200 {
+		t.Errorf("request with the admin key gave status %d, want 200", response.StatusCode())
+	}
+}
+
+func TestAdminRouterBuckets(t *testing.T) {
+	client := newAdminTestClient(t)
+
+	var bucket handlers.AdminBucket
+	readAdminResponse(t, doAdminRequest(t, client, fasthttp.MethodPost, "/buckets", adminBucketRequest{Name: "admin-bucket", SharedStorage: true}, testAdminKey), 201, &bucket)
+	if bucket.Name != "admin-bucket" || !bucket.SharedStorage || bucket.Id == 0 {
+		t.Errorf("created bucket %+v", bucket)
+	}
+
+	invalidNames := []string{"", "Upper", "-leading", "trailing-", "under_score", "dot.ted", strings.Repeat("a", 64)}
+	for _, name := range invalidNames {
+		if response := doAdminRequest(t, client, fasthttp.MethodPost, "/buckets", adminBucketRequest{Name: name}, testAdminKey); response.StatusCode() != 400 {
+			t.Errorf("creating bucket %q gave status %d, want 400", name, response.StatusCode())
+		}
+	}
+
+	if response := doAdminRequest(t, client, fasthttp.MethodPost, "/buckets", adminBucketRequest{Name: "admin-bucket"}, testAdminKey); response.StatusCode() != 409 {
+		t.Errorf("creating duplicate bucket gave status %d, want 409", response.StatusCode())
+	}
+
+	// Renaming keeps the bucket, but refuses names which are invalid or taken.
+	if response := doAdminRequest(t, client, fasthttp.MethodPatch, "/buckets/admin-bucket", adminNameRequest{Name: "Invalid"}, testAdminKey); response.StatusCode() != 400 {
+		t.Errorf("renaming to an invalid name gave status %d, want 400", response.StatusCode())
+	}
+	if response := doAdminRequest(t, client, fasthttp.MethodPatch, "/buckets/admin-bucket", adminNameRequest{Name: "test-bucket"}, testAdminKey); response.StatusCode() != 409 {
+		t.Errorf("renaming to a taken name gave status %d, want 409", response.StatusCode())
+	}
+	if response := doAdminRequest(t, client, fasthttp.MethodPatch, "/buckets/admin-bucket", adminNameRequest{Name: "renamed-bucket"}, testAdminKey); response.StatusCode() != 204 {
+		t.Fatalf("renaming gave status %d, want 204", response.StatusCode())
+	}
+
+	var buckets []handlers.AdminBucket
+	readAdminResponse(t, doAdminRequest(t, client, fasthttp.MethodGet, "/buckets", nil, testAdminKey), 200, &buckets)
+
+	names := map[string]int64{}
+	for _, listed := range buckets {
+		names[listed.Name] = listed.Id
+	}
+	if _, ok := names["admin-bucket"]; ok || names["renamed-bucket"] != bucket.Id {
+		t.Errorf("listed buckets %+v after renaming", buckets)
+	}
+
+	if response := doAdminRequest(t, client, fasthttp.MethodDelete, "/buckets/renamed-bucket", nil, testAdminKey); response.StatusCode() != 204 {
+		t.Errorf("deleting gave status %d, want 204", response.StatusCode())
+	}
+
+	for method, path := range map[string]string{fasthttp.MethodDelete: "/buckets/renamed-bucket", fasthttp.MethodPatch: "/buckets/admin-bucket"} {
+		if response := doAdminRequest(t, client, method, path, adminNameRequest{Name: "other-bucket"}, testAdminKey); response.StatusCode() != 404 {
+			t.Errorf("%s of a missing bucket gave status %d, want 404", method, response.StatusCode())
+		}
+	}
+}
+
+func TestAdminRouterSecrets(t *testing.T) {
+	client := newAdminTestClient(t)
+
+	readAdminResponse(t, doAdminRequest(t, client, fasthttp.MethodPost, "/buckets", adminBucketRequest{Name: "secret-bucket"}, testAdminKey), 201, nil)
+
+	// API keys are generated, and only ever handed out when created.
+	var apiKey adminAPIKeyResponse
+	response := doAdminRequest(t, client, fasthttp.MethodPost, "/buckets/secret-bucket/api-keys", adminNameRequest{Name: "uploader"}, testAdminKey)
+	readAdminResponse(t, response, 201, &apiKey)
+	if apiKey.AdminAPIKey == nil || apiKey.Name != "uploader" || len(apiKey.Key) == 0 {
+		t.Fatalf("created API key %s", response.Body())
+	}
+
+	response = doAdminRequest(t, client, fasthttp.MethodGet, "/buckets/secret-bucket/api-keys", nil, testAdminKey)
+	var apiKeys []handlers.AdminAPIKey
+	readAdminResponse(t, response, 200, &apiKeys)
+	if len(apiKeys) != 1 || apiKeys[0].Id != apiKey.Id || strings.Contains(string(response.Body()), apiKey.Key) || strings.Contains(string(response.Body()), `"key"`) {
+		t.Errorf("listed API keys %s", response.Body())
+	}
+
+	// MAC secrets are either given or generated, and likewise only handed out when created.
+	givenSecret := base64.StdEncoding.EncodeToString([]byte("adminmacsecretadminmacsecret1234"))
+	for selector, secret := range map[uint32]string{1: givenSecret, 2: ""} {
+		var created adminMACSelectorResponse
+		readAdminResponse(t, doAdminRequest(t, client, fasthttp.MethodPost, "/buckets/secret-bucket/mac-selectors", adminMACSelectorRequest{Selector: selector, Secret: secret}, testAdminKey), 201, &created)
+
+		decoded, err := base64.StdEncoding.DecodeString(created.Secret)
+		if err != nil || len(decoded) != 32 || (secret != "" && created.Secret != secret) {
+			t.Errorf("created MAC selector %d with secret %q", selector, created.Secret)
+		}
+	}
+
+	for _, secret := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if response := doAdminRequest(t, client, fasthttp.MethodPost, "/buckets/secret-bucket/mac-selectors", adminMACSelectorRequest{Selector: 3, Secret: secret}, testAdminKey); response.StatusCode() != 400 {
+			t.Errorf("creating MAC selector with secret %q gave status %d, want 400", secret, response.StatusCode())
+		}
+	}
+
+	if response := doAdminRequest(t, client, fasthttp.MethodPost, "/buckets/secret-bucket/mac-selectors", adminMACSelectorRequest{Selector: 1}, testAdminKey); response.StatusCode() != 409 {
+		t.Errorf("creating duplicate MAC selector gave status %d, want 409", response.StatusCode())
+	}
+
+	response = doAdminRequest(t, client, fasthttp.MethodGet, "/buckets/secret-bucket/mac-selectors", nil, testAdminKey)
+	var selectors []handlers.AdminMACSelector
+	readAdminResponse(t, response, 200, &selectors)
+	if len(selectors) != 2 || strings.Contains(string(response.Body()), givenSecret) || strings.Contains(string(response.Body()), `"secret"`) {
+		t.Errorf("listed MAC selectors %s", response.Body())
+	}
+}
+
+func TestAdminRouterAccessRules(t *testing.T) {
+	client := newAdminTestClient(t)
+
+	readAdminResponse(t, doAdminRequest(t, client, fasthttp.MethodPost, "/buckets", adminBucketRequest{Name: "rule-bucket"}, testAdminKey), 201, nil)
+
+	var anchored, unanchored adminAccessRuleResponse
+	readAdminResponse(t, doAdminRequest(t, client, fasthttp.MethodPost, "/buckets/rule-bucket/access-rules", handlers.AdminAccessRule{Regex: "^/private/.*$"}, testAdminKey), 201, &anchored)
+	if anchored.Warning != "" {
+		t.Errorf("anchored rule gave warning %q", anchored.Warning)
+	}
+
+	readAdminResponse(t, doAdminRequest(t, client, fasthttp.MethodPost, "/buckets/rule-bucket/access-rules", handlers.AdminAccessRule{Regex: "^/private/"}, testAdminKey), 201, &unanchored)
+	if !strings.Contains(unanchored.Warning, "not anchored") {
+		t.Errorf("unanchored rule gave warning %q", unanchored.Warning)
+	}
+
+	// Updating validates the rule the same way.
+	rulePath := "/buckets/rule-bucket/access-rules/" + strconv.FormatInt(anchored.Id, 10)
+	var updated adminAccessRuleResponse
+	readAdminResponse(t, doAdminRequest(t, client, fasthttp.MethodPut, rulePath, handlers.AdminAccessRule{Regex: "private"}, testAdminKey), 200, &updated)
+	if updated.Warning == "" || updated.Id != anchored.Id {
+		t.Errorf("updated rule %+v", updated)
+	}
+
+	for _, rule := range []handlers.AdminAccessRule{{Regex: "^(unclosed$"}, {Regex: "^/$", Action: 3}} {
+		if response := doAdminRequest(t, client, fasthttp.MethodPost, "/buckets/rule-bucket/access-rules", rule, testAdminKey); response.StatusCode() != 400 {
+			t.Errorf("creating rule %+v gave status %d, want 400", rule, response.StatusCode())
+		}
+	}
+
+	if response := doAdminRequest(t, client, fasthttp.MethodDelete, rulePath, nil, testAdminKey); response.StatusCode() != 204 {
+		t.Errorf("deleting rule gave status %d, want 204", response.StatusCode())
+	}
+	if response := doAdminRequest(t, client, fasthttp.MethodDelete, rulePath, nil, testAdminKey); response.StatusCode() != 404 {
+		t.Errorf("deleting rule again gave status %d, want 404", response.StatusCode())
+	}
+}
+
+func TestAdminRouterUnknownRoutes(t *testing.T) {
+	client := newAdminTestClient(t)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{method: fasthttp.MethodGet, path: "/", status: 404},
+		{method: fasthttp.MethodGet, path: "/unknown", status: 404},
+		{method: fasthttp.MethodGet, path: "/buckets/test-bucket/unknown", status: 404},
+		{method: fasthttp.MethodPost, path: "/buckets/test-bucket/unknown", status: 404},
+		{method: fasthttp.MethodDelete, path: "/buckets/test-bucket/unknown/1", status: 404},
+		{method: fasthttp.MethodGet, path: "/buckets/test-bucket/api-keys/1/extra", status: 404},
+		{method: fasthttp.MethodGet, path: "/buckets/missing-bucket/api-keys", status: 404},
+		{method: fasthttp.MethodDelete, path: "/buckets/test-bucket/api-keys/999", status: 404},
+		{method: fasthttp.MethodDelete, path: "/buckets/test-bucket/api-keys/one", status: 400},
+		{method: fasthttp.MethodPost, path: "/stats", status: 405},
+	}
+
+	for _, test := range tests {
+		if response := doAdminRequest(t, client, test.method, test.path, nil, testAdminKey); response.StatusCode() != test.status {
+			t.Errorf("%s %s gave status %d, want %d", test.method, test.path, response.StatusCode(), test.status)
+		}
+	}
+}
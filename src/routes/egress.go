@@ -2,21 +2,30 @@ package routes
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
 	"speedyvault/src/config"
 	"speedyvault/src/handlers"
 	. "speedyvault/src/handlers/constants"
 	"speedyvault/src/routes/middleware"
+	"speedyvault/src/system"
+	"time"
 
 	"github.com/valyala/fasthttp"
 )
 
-func ObjectDownload(ctx *fasthttp.RequestCtx) {
+// Performs the authorization, access rule, conditional and range checks shared by every request reading an object.
+// Returns the object alongside the parts of the body that should be sent, with the response headers already set.
+// The range checks are skipped (sending the entire object) unless handleRange is set.
+// If the request should not proceed any further, a nil object is returned and the response is modified to reflect this.
+func prepareObjectEgress(ctx *fasthttp.RequestCtx, handleRange bool) (*handlers.CachedObject, objectBody) {
 	bucket, access := middleware.AuthorizeBucketAPIRequest(ctx)
 	if bucket == nil {
-		return
+		return nil, objectBody{}
 	}
 
 	key := ctx.Path()
@@ -29,7 +38,7 @@ func ObjectDownload(ctx *fasthttp.RequestCtx) {
 		{
 			if !access.HasRequired(ObjectAPIKeyAccess) {
 				ctx.Error("permission denied (resource is restricted)", 403)
-				return
+				return nil, objectBody{}
 			}
 		}
 
@@ -38,7 +47,7 @@ func ObjectDownload(ctx *fasthttp.RequestCtx) {
 		{
 			if !access.HasRequired(ObjectRead) {
 				middleware.GeneralPermissionDeniedAccess(ctx)
-				return
+				return nil, objectBody{}
 			}
 		}
 	}
@@ -48,49 +57,70 @@ func ObjectDownload(ctx *fasthttp.RequestCtx) {
 	object, err := handlers.Object.GetObjectByKey(bucket, key)
 	if err != nil {
 		ctx.SetStatusCode(500)
-		return
+		return nil, objectBody{}
 	}
 	if object == nil {
 		ctx.Error("object not found", 404)
-		return
+		return nil, objectBody{}
+	}
+
+	// Files which failed verification are either refused outright or flagged, depending on the config.
+	if object.File.Corrupted {
+		if !config.AppConfig.ServeCorruptedFiles {
+			ctx.Error("object data failed integrity verification", 500)
+			ctx.Response.Header.Set("Cache-Control", "no-store")
+			return nil, objectBody{}
+		}
+
+		ctx.Response.Header.Set("X-SV-Integrity", "corrupted")
 	}
 
 	// Set the mandatory headers that must be present regardless of response.
 	ctx.Response.Header.SetBytesV("ETag", object.File.ETag)
+	ctx.Response.Header.SetLastModified(object.LastModified())
+	ctx.Response.Header.Set("Repr-Digest", handlers.Checksum.FormatReprDigest(object.File.Digest, object.Checksums))
 	if condition == AllowPublic {
 		ctx.Response.Header.Set("Cache-Control", "max-age=360, public")
 	} else {
 		ctx.Response.Header.Set("Cache-Control", "max-age=360, private")
 	}
 
-	// Check if the client only wants us to return a file if it has changed.
-	if etag := ctx.Request.Header.Peek(fasthttp.HeaderIfNoneMatch); len(etag) != 0 && bytes.Equal(etag, object.File.ETag) {
+	// Check if the client only wants the object if it has changed, or only if it is still the version it expects.
+	switch handlers.Conditional.Evaluate(handlers.Conditional.GetPreconditions(&ctx.Request.Header), object, true) {
+	case handlers.PreconditionNotModified:
 		// File has not changed, we can return a not modified status code.
 		ctx.SetStatusCode(304)
-		return
+		return nil, objectBody{}
+	case handlers.PreconditionFailed:
+		ctx.Response.Header.Set("Cache-Control", "no-store")
+		ctx.SetStatusCode(412)
+		return nil, objectBody{}
 	}
 
 	// Setup the read parameters, default to entire file, but otherwise can be overwritten by the "Range" header.
-	var readStartByte uint64 = 0
-	var readLength uint64 = object.File.Size
+	body := objectBody{parts: []objectBodyPart{{offset: 0, length: object.File.Size}}}
 
 	// If the client only wants parts of the file.
-	if rangeHeader := ctx.Request.Header.Peek(fasthttp.HeaderRange); len(rangeHeader) != 0 {
-		// Proceed with the partial upload if no if-range header exists, or the if-range header contains a different etag.
-		if etag := ctx.Request.Header.Peek(fasthttp.HeaderIfRange); len(etag) == 0 || bytes.Equal(etag, object.File.ETag) {
-			parsedRange, err := handlers.Misc.ParseRangeHeader(rangeHeader, object.File.Size)
+	if rangeHeader := ctx.Request.Header.Peek(fasthttp.HeaderRange); handleRange && len(rangeHeader) != 0 {
+		// Proceed with the partial download if no if-range header exists, or the if-range header still matches the object.
+		if handlers.Conditional.RangeApplies(ctx.Request.Header.Peek(fasthttp.HeaderIfRange), object) {
+			parsedRanges, err := handlers.Misc.ParseRangeHeader(rangeHeader, object.File.Size)
 			if err == nil {
-				readStartByte = parsedRange.Start
-				readLength = parsedRange.Length
-				ctx.Response.Header.Set("Content-Range", parsedRange.ContentRangeHeader)
+				if len(parsedRanges) == 1 {
+					body.parts[0] = objectBodyPart{offset: parsedRanges[0].Start, length: parsedRanges[0].Length}
+					ctx.Response.Header.Set("Content-Range", parsedRanges[0].ContentRangeHeader)
+				} else {
+					body = newByteRangesBody(ctx, object, parsedRanges)
+				}
+
 				ctx.SetStatusCode(206)
 			} else {
 				// If there is an error, an unsatisfiable error should be returned to the client if range is out of bounds, otherwise the header should be ignored.
 				if err == handlers.ParseRangeUnsatisfiableError {
-					ctx.Response.Header.Set("Content-Range", parsedRange.ContentRangeHeader)
+					ctx.Response.Header.Set("Content-Range", parsedRanges[0].ContentRangeHeader)
 					ctx.Response.Header.Set("Cache-Control", "no-store") // Errors like this shouldn't be cached.
 					ctx.SetStatusCode(416)
-					return
+					return nil, objectBody{}
 				}
 
 				// Past this point, the range header is ignored.
@@ -98,54 +128,301 @@ func ObjectDownload(ctx *fasthttp.RequestCtx) {
 		}
 	}
 
+	ctx.Response.Header.SetContentLength(int(body.size()))
+	if object.ContentTypeMime.Valid && len(body.parts) == 1 {
+		ctx.Response.Header.SetContentType(object.ContentTypeMime.String)
+	}
+
+	return object, body
+}
+
+// Lays out a multipart/byteranges body for the ranges, each part carrying its own "Content-Range" (and "Content-Type") headers.
+// The content type of the response is set to announce the boundary between the parts.
+func newByteRangesBody(ctx *fasthttp.RequestCtx, object *handlers.CachedObject, ranges []handlers.ParsedRangeHeader) objectBody {
+	boundary := handlers.Misc.NewRandomUID()
+	ctx.Response.Header.SetContentType("multipart/byteranges; boundary=" + boundary)
+
+	body := objectBody{parts: make([]objectBodyPart, 0, len(ranges))}
+	for i, parsedRange := range ranges {
+		var header bytes.Buffer
+
+		// Each part after the first is preceded by the line break ending the previous part's data.
+		if i != 0 {
+			header.WriteString("\r\n")
+		}
+
+		header.WriteString("--" + boundary + "\r\n")
+		if object.ContentTypeMime.Valid {
+			header.WriteString("Content-Type: " + object.ContentTypeMime.String + "\r\n")
+		}
+		header.WriteString("Content-Range: " + parsedRange.ContentRangeHeader + "\r\n\r\n")
+
+		body.parts = append(body.parts, objectBodyPart{header: header.Bytes(), offset: parsedRange.Start, length: parsedRange.Length})
+	}
+
+	body.trailer = []byte("\r\n--" + boundary + "--\r\n")
+	return body
+}
+
+func ObjectHead(ctx *fasthttp.RequestCtx) {
+	// All the headers are set by the shared checks, the body is simply never sent.
+	prepareObjectEgress(ctx, true)
+}
+
+func ObjectDownload(ctx *fasthttp.RequestCtx) {
+	// Nginx handles ranges itself when serving the file.
+	object, body := prepareObjectEgress(ctx, !config.AppConfig.UseNginxStreaming)
+	if object == nil {
+		return
+	}
+
+	if config.AppConfig.UseNginxStreaming {
+		redirectObjectToNginx(ctx, object)
+		return
+	}
+
 	// Try to open the object file.
-	file, err := os.Open(bucket.GetObjectPath(object.File.UID))
+	file, err := object.File.Open()
 	if err != nil {
 		log.Println(err)
 		ctx.SetStatusCode(500)
 		return
 	}
 
-	ctx.Response.Header.SetContentLength(int(readLength))
-	if object.ContentTypeMime.Valid {
-		ctx.Response.Header.SetContentType(object.ContentTypeMime.String)
+	// fasthttp writes the file out once the headers have been sent and closes it afterwards, keeping the connection alive for further requests.
+	ctx.Response.SetBodyStream(&objectBodyStream{objectBody: body, conn: ctx.Conn(), file: file}, int(body.size()))
+}
+
+// Hands the download over to Nginx, which serves the object file from the internal location mapping onto the data directory.
+// The headers already set are kept by Nginx (provided its config passes them on), only the body is left to it.
+func redirectObjectToNginx(ctx *fasthttp.RequestCtx, object *handlers.CachedObject) {
+	// The file is opened rather than simply located, as it may have been moved since it was fetched.
+	file, err := object.File.Open()
+	if err != nil {
+		log.Println(err)
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	filePath := file.Name()
+	file.Close()
+
+	relativePath, err := filepath.Rel(config.AppConfig.DataDirectory, filePath)
+	if err != nil {
+		log.Println("Problem while resolving object file within the data directory ", err)
+		ctx.SetStatusCode(500)
+		return
 	}
 
-	// Stream the file to the connection.
-	// We have to take the request over here as the alternative is to stream the file to fasthttp's internal buffer first which is slow.
-	ctx.HijackSetNoResponse(true)
-	ctx.Hijack(func(fasthttpConn net.Conn) {
-		defer file.Close()
+	ctx.Response.Header.Set("X-Accel-Redirect", config.AppConfig.NginxInternalLocation+filepath.ToSlash(relativePath))
+}
 
-		// Get the actual connection gate-kept by FastHTTP.
-		c := handlers.Misc.ExtractNetTCPFromFastHTTPWrapper(fasthttpConn)
+var errDownloadTooSlow = errors.New("download fell below the minimum transfer rate")
 
-		// Send the headers.
-		c.Write(ctx.Response.Header.Header())
+// Replaced in tests to exercise the fallback taken on systems without sendfile.
+var sendFile = system.SendFile
 
-		buffer := make([]byte, config.AppConfig.DownloadStreamingChunkSize)
-		bytesRemaining := readLength
-		for {
-			bufferSlice := buffer
-			if bytesRemaining < uint64(len(buffer)) {
-				bufferSlice = buffer[:bytesRemaining]
-			}
+// A byte range of an object file, preceded by the part header when sent as one of several ranges.
+type objectBodyPart struct {
+	header []byte
+	offset uint64
+	length uint64
+}
 
-			_, err := file.ReadAt(bufferSlice, int64(readStartByte+(readLength-bytesRemaining)))
-			if err != nil {
-				log.Println("Unexpected failure while reading object file ", err)
-				c.SetLinger(0)
-				return // No error can be returned to the client so we will just reset the connection.
-			}
+// The layout of a response body sending an object, which is either a single byte range or a multipart/byteranges body.
+type objectBody struct {
+	parts   []objectBodyPart
+	trailer []byte
+}
 
-			// Stream to the client.
-			c.Write(bufferSlice)
+// Returns the total length of the body, including any part headers.
+func (b objectBody) size() uint64 {
+	size := uint64(len(b.trailer))
+	for _, part := range b.parts {
+		size += uint64(len(part.header)) + part.length
+	}
+
+	return size
+}
+
+// The byte ranges of an object file being sent as the body of a response.
+// fasthttp writes it out through WriteTo, which lets the kernel send the file straight from disk to the socket where supported.
+type objectBodyStream struct {
+	objectBody
+	conn net.Conn
+	file *os.File
+	sent uint64
 
-			bytesRemaining -= uint64(len(bufferSlice))
+	started             time.Time
+	sendFileUnsupported bool
+	reader              io.Reader
+}
+
+func (s *objectBodyStream) Read(p []byte) (int, error) {
+	if s.reader == nil {
+		readers := make([]io.Reader, 0, 2*len(s.parts)+1)
+		for _, part := range s.parts {
+			readers = append(readers, bytes.NewReader(part.header), io.NewSectionReader(s.file, int64(part.offset), int64(part.length)))
+		}
 
-			if bytesRemaining == 0 {
+		s.reader = io.MultiReader(append(readers, bytes.NewReader(s.trailer))...)
+	}
+
+	n, err := s.reader.Read(p)
+	s.sent += uint64(n)
+
+	return n, err
+}
+
+// Gives the next chunk until the write timeout to be written, so that a stalled client can't hold on to the download forever.
+func (s *objectBodyStream) extendWriteDeadline() {
+	if config.AppConfig.DownloadWriteTimeoutMs != 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(time.Duration(config.AppConfig.DownloadWriteTimeoutMs) * time.Millisecond))
+	}
+}
+
+// Checks the client is keeping up with the minimum transfer rate, which is only enforced once the download has run for longer than the write timeout.
+func (s *objectBodyStream) checkTransferRate() error {
+	elapsed := time.Since(s.started)
+	if config.AppConfig.DownloadMinBytesPerSecond == 0 || elapsed < time.Duration(config.AppConfig.DownloadWriteTimeoutMs)*time.Millisecond {
+		return nil
+	}
+
+	if float64(s.sent)/elapsed.Seconds() < float64(config.AppConfig.DownloadMinBytesPerSecond) {
+		return errDownloadTooSlow
+	}
+
+	return nil
+}
+
+func (s *objectBodyStream) WriteTo(w io.Writer) (int64, error) {
+	s.started = time.Now()
+
+	// The deadlines only apply to this download, not to any further requests on the connection.
+	defer s.conn.SetWriteDeadline(time.Time{})
+
+	outcome, err := s.writeParts(w)
+	handlers.Stats.RecordDownload(outcome)
+
+	switch outcome {
+	case handlers.DownloadReadFailed:
+		log.Println("Unexpected failure while reading object file ", err)
+	case handlers.DownloadTimedOut, handlers.DownloadTooSlow:
+		// Nothing else can be sent to the client, so the connection is reset rather than left for the client to time out.
+		if tcpConn, ok := s.conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+		}
+	}
+
+	return int64(s.sent), err
+}
+
+// Writes each part out in turn, returning how the download ended.
+func (s *objectBodyStream) writeParts(w io.Writer) (handlers.DownloadOutcome, error) {
+	for _, part := range s.parts {
+		if outcome, err := s.writeBytes(w, part.header); err != nil {
+			return outcome, err
+		}
+
+		if outcome, err := s.writeChunks(w, part.offset, part.length); err != nil {
+			return outcome, err
+		}
+	}
+
+	return s.writeBytes(w, s.trailer)
+}
+
+// Writes out the bytes of the body which don't come from the file.
+func (s *objectBodyStream) writeBytes(w io.Writer, value []byte) (handlers.DownloadOutcome, error) {
+	if len(value) == 0 {
+		return handlers.DownloadCompleted, nil
+	}
+
+	s.extendWriteDeadline()
+	n, err := w.Write(value)
+	s.sent += uint64(n)
+	if err != nil {
+		return classifyDownloadWriteError(err), err
+	}
+
+	return handlers.DownloadCompleted, nil
+}
+
+// Writes the byte range of the file out chunk by chunk, returning how the download ended.
+func (s *objectBodyStream) writeChunks(w io.Writer, offset uint64, length uint64) (handlers.DownloadOutcome, error) {
+	chunkSize := uint64(config.AppConfig.DownloadStreamingChunkSize)
+	var written uint64 = 0
+
+	// The headers are still buffered in the writer, so they have to be sent before the file can be sent past it.
+	tcpConn, useSendFile := s.conn.(*net.TCPConn)
+	flusher, canFlush := w.(interface{ Flush() error })
+	if useSendFile && canFlush && !s.sendFileUnsupported {
+		s.extendWriteDeadline()
+		if err := flusher.Flush(); err != nil {
+			return classifyDownloadWriteError(err), err
+		}
+
+		for written != length {
+			s.extendWriteDeadline()
+			n, err := sendFile(tcpConn, s.file, int64(offset+written), int64(min(chunkSize, length-written)))
+			written += uint64(n)
+			s.sent += uint64(n)
+
+			if err == system.ErrSendFileUnsupported {
+				s.sendFileUnsupported = true
 				break
+			} else if err == io.ErrUnexpectedEOF {
+				return handlers.DownloadReadFailed, err
+			} else if err != nil {
+				return classifyDownloadWriteError(err), err
+			}
+
+			if err := s.checkTransferRate(); err != nil {
+				return handlers.DownloadTooSlow, err
 			}
 		}
-	})
+	}
+
+	// Otherwise copy the file through a buffer.
+	buffer := make([]byte, min(chunkSize, length-written))
+	for written != length {
+		chunk := buffer[:min(uint64(len(buffer)), length-written)]
+		n, err := s.file.ReadAt(chunk, int64(offset+written))
+
+		// Reading up to the very end of the file is not an error as long as everything was read, otherwise the file was truncated underneath us.
+		if err == io.EOF && n == len(chunk) {
+			err = nil
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return handlers.DownloadReadFailed, err
+		}
+
+		s.extendWriteDeadline()
+		if _, err := w.Write(chunk); err != nil {
+			return classifyDownloadWriteError(err), err
+		}
+
+		written += uint64(n)
+		s.sent += uint64(n)
+
+		if err := s.checkTransferRate(); err != nil {
+			return handlers.DownloadTooSlow, err
+		}
+	}
+
+	return handlers.DownloadCompleted, nil
+}
+
+func classifyDownloadWriteError(err error) handlers.DownloadOutcome {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return handlers.DownloadTimedOut
+	}
+
+	return handlers.DownloadClientGone
+}
+
+func (s *objectBodyStream) Close() error {
+	return s.file.Close()
 }
@@ -0,0 +1,363 @@
+package routes
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"speedyvault/src/config"
+	"speedyvault/src/handlers"
+	"speedyvault/src/system"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Connects over loopback, returning the server side of the connection and a channel which receives everything the client read once it's closed.
+func newLoopbackConn(t *testing.T) (*net.TCPConn, <-chan []byte) {
+	t.Helper()
+
+	conn, client := newLoopbackPair(t)
+
+	received := make(chan []byte, 1)
+	go func() {
+		defer client.Close()
+		content, _ := io.ReadAll(client)
+		received <- content
+	}()
+
+	return conn, received
+}
+
+// Connects over loopback, returning both sides of the connection, which are closed once the test ends.
+func newLoopbackPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn.(*net.TCPConn), client.(*net.TCPConn)
+}
+
+// Writes random content to a temporary file, returning the opened file alongside its content.
+func newObjectTestFile(t *testing.T, size int) (*os.File, []byte) {
+	t.Helper()
+
+	content := make([]byte, size)
+	rand.Read(content)
+
+	filePath := path.Join(t.TempDir(), "object")
+	if err := os.WriteFile(filePath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file, content
+}
+
+// Makes sendfile report that it's unsupported for the rest of the test.
+func disableSendFile(t *testing.T) {
+	sendFile = func(*net.TCPConn, *os.File, int64, int64) (int64, error) {
+		return 0, system.ErrSendFileUnsupported
+	}
+	t.Cleanup(func() { sendFile = system.SendFile })
+}
+
+func TestObjectBodyStream(t *testing.T) {
+	const fileSize = 5 << 20
+
+	bodies := []struct {
+		name string
+		body objectBody
+	}{
+		{name: "full", body: objectBody{parts: []objectBodyPart{{offset: 0, length: fileSize}}}},
+		{name: "range", body: objectBody{parts: []objectBodyPart{{offset: 1000, length: 3 << 20}}}},
+		{name: "ranges", body: objectBody{
+			parts: []objectBodyPart{
+				{header: []byte("--b\r\nContent-Range: bytes 0-9/5242880\r\n\r\n"), offset: 0, length: 10},
+				{header: []byte("\r\n--b\r\nContent-Range: bytes 4194304-5242879/5242880\r\n\r\n"), offset: 4 << 20, length: 1 << 20},
+			},
+			trailer: []byte("\r\n--b--\r\n"),
+		}},
+	}
+
+	for _, useSendFile := range []bool{true, false} {
+		for _, test := range bodies {
+			name := test.name + "/buffered"
+			if useSendFile {
+				name = test.name + "/sendfile"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				if !useSendFile {
+					disableSendFile(t)
+				}
+
+				file, content := newObjectTestFile(t, fileSize)
+				conn, received := newLoopbackConn(t)
+
+				var expected []byte
+				for _, part := range test.body.parts {
+					expected = append(expected, part.header...)
+					expected = append(expected, content[part.offset:part.offset+part.length]...)
+				}
+				expected = append(expected, test.body.trailer...)
+
+				stream := &objectBodyStream{objectBody: test.body, conn: conn, file: file}
+				defer stream.Close()
+
+				writer := bufio.NewWriter(conn)
+				sent, err := stream.WriteTo(writer)
+				if err != nil || uint64(sent) != test.body.size() {
+					t.Fatalf("sent %d bytes with error %v, want %d", sent, err, test.body.size())
+				}
+
+				if err := writer.Flush(); err != nil {
+					t.Fatal(err)
+				}
+
+				conn.Close()
+				if !bytes.Equal(<-received, expected) {
+					t.Error("received body doesn't match the ranges of the file")
+				}
+
+				if stream.sendFileUnsupported == useSendFile {
+					t.Errorf("stream recorded sendfile as unsupported %v, want %v", stream.sendFileUnsupported, !useSendFile)
+				}
+			})
+		}
+	}
+}
+
+func TestObjectBodyStreamTruncated(t *testing.T) {
+	for _, useSendFile := range []bool{true, false} {
+		name := "buffered"
+		if useSendFile {
+			name = "sendfile"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			if !useSendFile {
+				disableSendFile(t)
+			}
+
+			file, _ := newObjectTestFile(t, 1<<20)
+			conn, _ := newLoopbackConn(t)
+
+			stream := &objectBodyStream{objectBody: objectBody{parts: []objectBodyPart{{offset: 0, length: 4 << 20}}}, conn: conn, file: file}
+			defer stream.Close()
+
+			outcome, err := stream.writeParts(bufio.NewWriter(conn))
+			if outcome != handlers.DownloadReadFailed || err != io.ErrUnexpectedEOF {
+				t.Errorf("download ended with outcome %v and error %v, want DownloadReadFailed and io.ErrUnexpectedEOF", outcome, err)
+			}
+		})
+	}
+}
+
+func TestObjectHead(t *testing.T) {
+	client := newTestClient(t)
+
+	if response := doTestRequest(t, client, fasthttp.MethodPut, "/head/object", []byte("headed content")); response.StatusCode() != 201 {
+		t.Fatalf("upload gave status %d", response.StatusCode())
+	}
+	etag := string(doTestRequest(t, client, fasthttp.MethodGet, "/head/object", nil).Header.Peek("ETag"))
+
+	tests := []struct {
+		name    string
+		key     string
+		headers []string
+		status  int
+	}{
+		{name: "full", key: "/head/object", status: 200},
+		{name: "range", key: "/head/object", headers: []string{"Range", "bytes=2-5"}, status: 206},
+		{name: "not modified", key: "/head/object", headers: []string{"If-None-Match", etag}, status: 304},
+		{name: "precondition failed", key: "/head/object", headers: []string{"If-Match", `"other"`}, status: 412},
+		{name: "missing", key: "/head/missing", status: 404},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			download := doTestRequest(t, client, fasthttp.MethodGet, test.key, nil, test.headers...)
+			head := doTestRequest(t, client, fasthttp.MethodHead, test.key, nil, test.headers...)
+
+			if download.StatusCode() != test.status || head.StatusCode() != test.status {
+				t.Fatalf("download gave status %d and head gave %d, want %d", download.StatusCode(), head.StatusCode(), test.status)
+			}
+			if len(head.Body()) != 0 {
+				t.Errorf("head response has a body %q", head.Body())
+			}
+
+			for _, header := range []string{"ETag", "Content-Length", "Content-Range", "Repr-Digest", "Last-Modified", "Cache-Control"} {
+				// fasthttp leaves out a zero length from head responses.
+				if header == "Content-Length" && len(download.Body()) == 0 {
+					continue
+				}
+
+				if got, want := string(head.Header.Peek(header)), string(download.Header.Peek(header)); got != want {
+					t.Errorf("head has header %s %q, download has %q", header, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Overrides the download limits for the rest of the test.
+func setDownloadLimits(t *testing.T, writeTimeoutMs int64, minBytesPerSecond uint64, chunkSize uint32) {
+	writeTimeout, minRate, streamingChunkSize := config.AppConfig.DownloadWriteTimeoutMs, config.AppConfig.DownloadMinBytesPerSecond, config.AppConfig.DownloadStreamingChunkSize
+	t.Cleanup(func() {
+		config.AppConfig.DownloadWriteTimeoutMs, config.AppConfig.DownloadMinBytesPerSecond, config.AppConfig.DownloadStreamingChunkSize = writeTimeout, minRate, streamingChunkSize
+	})
+
+	config.AppConfig.DownloadWriteTimeoutMs, config.AppConfig.DownloadMinBytesPerSecond, config.AppConfig.DownloadStreamingChunkSize = writeTimeoutMs, minBytesPerSecond, chunkSize
+}
+
+func TestObjectBodyStreamAborted(t *testing.T) {
+	const fileSize = 32 << 20
+
+	tests := []struct {
+		name              string
+		writeTimeoutMs    int64
+		minBytesPerSecond uint64
+		client            func(client *net.TCPConn) error // Returns the error the client stopped reading on, if it reads at all.
+		outcome           handlers.DownloadOutcome
+		reset             bool // Whether the connection is reset once the download is aborted.
+	}{
+		{
+			// The client stops reading, so the writes block until the deadline.
+			name:           "timed out",
+			writeTimeoutMs: 200,
+			client:         func(*net.TCPConn) error { return nil },
+			outcome:        handlers.DownloadTimedOut,
+			reset:          true,
+		},
+		{
+			// The client keeps reading, but far slower than the minimum rate.
+			name:              "too slow",
+			writeTimeoutMs:    500,
+			minBytesPerSecond: 100 << 20,
+			client: func(client *net.TCPConn) error {
+				buffer := make([]byte, 64<<10)
+				for {
+					if _, err := client.Read(buffer); err != nil {
+						return err
+					}
+
+					time.Sleep(5 * time.Millisecond)
+				}
+			},
+			outcome: handlers.DownloadTooSlow,
+			reset:   true,
+		},
+		{
+			name:           "client gone",
+			writeTimeoutMs: 5000,
+			client:         func(client *net.TCPConn) error { return client.Close() },
+			outcome:        handlers.DownloadClientGone,
+		},
+	}
+
+	counters := map[handlers.DownloadOutcome]func(handlers.DownloadStats) uint64{
+		handlers.DownloadTimedOut:   func(stats handlers.DownloadStats) uint64 { return stats.AbortedTimedOut },
+		handlers.DownloadTooSlow:    func(stats handlers.DownloadStats) uint64 { return stats.AbortedTooSlow },
+		handlers.DownloadClientGone: func(stats handlers.DownloadStats) uint64 { return stats.AbortedClientGone },
+	}
+
+	for _, useSendFile := range []bool{true, false} {
+		for _, test := range tests {
+			name := test.name + "/buffered"
+			if useSendFile {
+				name = test.name + "/sendfile"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				if !useSendFile {
+					disableSendFile(t)
+				}
+				setDownloadLimits(t, test.writeTimeoutMs, test.minBytesPerSecond, 64<<10)
+
+				file, _ := newObjectTestFile(t, fileSize)
+				conn, client := newLoopbackPair(t)
+
+				// Small buffers make a stalled client block the writes sooner.
+				conn.SetWriteBuffer(64 << 10)
+				client.SetReadBuffer(64 << 10)
+
+				clientErr := make(chan error, 1)
+				go func() { clientErr <- test.client(client) }()
+				if test.name == "client gone" {
+					<-clientErr
+				}
+
+				before := handlers.Stats.GetDownloadStats()
+				stream := &objectBodyStream{objectBody: objectBody{parts: []objectBodyPart{{offset: 0, length: fileSize}}}, conn: conn, file: file}
+				defer stream.Close()
+
+				started := time.Now()
+				sent, err := stream.WriteTo(bufio.NewWriterSize(conn, 4096))
+				if err == nil || sent == fileSize {
+					t.Fatalf("download sent %d bytes with error %v, want it aborted", sent, err)
+				}
+
+				after := handlers.Stats.GetDownloadStats()
+				for outcome, counter := range counters {
+					increase := counter(after) - counter(before)
+					if outcome == test.outcome && increase != 1 {
+						t.Errorf("expected counter increased by %d, want 1", increase)
+					} else if outcome != test.outcome && increase != 0 {
+						t.Errorf("counter of outcome %v increased by %d", outcome, increase)
+					}
+				}
+
+				if after.Completed != before.Completed {
+					t.Error("aborted download was counted as completed")
+				}
+
+				if elapsed := time.Since(started); elapsed > 5*time.Second {
+					t.Errorf("download took %v to be aborted", elapsed)
+				}
+
+				if !test.reset {
+					return
+				}
+
+				// Once closed, the client finds the connection reset rather than waiting on it to time out.
+				conn.Close()
+				err = <-clientErr
+				if err == nil {
+					client.SetReadDeadline(time.Now().Add(5 * time.Second))
+					_, err = io.Copy(io.Discard, client)
+				}
+
+				if !errors.Is(err, syscall.ECONNRESET) {
+					t.Errorf("client reading after the download was aborted got %v, want the connection reset", err)
+				}
+			})
+		}
+	}
+}
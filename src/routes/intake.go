@@ -6,56 +6,62 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"speedyvault/src/config"
 	"speedyvault/src/handlers"
 	. "speedyvault/src/handlers/constants"
 	"speedyvault/src/routes/middleware"
+	"syscall"
 
 	"github.com/valyala/fasthttp"
-	"github.com/zeebo/blake3"
 )
 
-func BucketUpload(ctx *fasthttp.RequestCtx) {
+// Authorizes a request which wants to write to an object, checking the context is allowed to create or update it.
+// If authorization fails, nil will be returned and the response will be modified to reflect this.
+func authorizeObjectWrite(ctx *fasthttp.RequestCtx) (*handlers.CachedBucket, ObjectOperationFlags) {
 	bucket, access := middleware.AuthorizeBucketAPIRequest(ctx)
 	if bucket == nil {
 		ctx.SetConnectionClose()
-		return
+		return nil, 0
 	}
 
 	// Check if the context is even allowed any of the possible operations.
 	if !access.HasAny(ObjectCreate | ObjectUpdate) {
 		middleware.GeneralPermissionDeniedAccess(ctx)
 		ctx.SetConnectionClose()
-		return
+		return nil, 0
 	}
 
-	key := ctx.Path()
-
 	// Check for any access constraints to this key, and handle request accordingly.
-	if condition := bucket.GetKeyAccessCondition(key); condition == DenyAll {
+	if condition := bucket.GetKeyAccessCondition(ctx.Path()); condition == DenyAll {
 		// Only API keys can bypass 'DenyAll'.
 		if !access.HasRequired(ObjectAPIKeyAccess) {
 			ctx.Error("permission denied (resource is restricted)", 403)
 			ctx.SetConnectionClose()
-			return
+			return nil, 0
 		}
 	}
 
-	stream := ctx.Request.BodyStream()
+	return bucket, access
+}
 
-	objectId := handlers.Misc.NewRandomUID()
-	objectFilePath := bucket.GetObjectPath(objectId)
+// Streams the request body into a newly created file at the path through the hasher, returning the size of what was received.
+// If streaming fails, the file is removed, the response is modified to reflect the error and false is returned.
+func streamBodyToFile(ctx *fasthttp.RequestCtx, filePath string, hasher *handlers.BodyHasher) (uint64, bool) {
+	stream := ctx.Request.BodyStream()
 
-	// Try create the object file stored on disk.
-	file, err := os.Create(objectFilePath)
+	// Try create the file stored on disk.
+	file, err := handlers.File.CreateDiskFile(filePath)
 	if err != nil {
 		log.Println(err)
 		ctx.SetStatusCode(500)
 		ctx.SetConnectionClose()
-		return
+		return 0, false
 	}
 
-	hasher := blake3.New()
+	// The file is incomplete until the whole body has been received, so it needs removing if the server is forced to exit before then.
+	handlers.Lifecycle.TrackPartialFile(filePath)
+	defer handlers.Lifecycle.UntrackPartialFile(filePath)
 
 	// Receive the file in chunks and stream directly to the file.
 	streamBuffer := make([]byte, config.AppConfig.UploadStreamingChunkSize)
@@ -64,21 +70,21 @@ func BucketUpload(ctx *fasthttp.RequestCtx) {
 		bytesRead, err := stream.Read(streamBuffer)
 		if err != nil && err != io.EOF {
 			file.Close()
-			os.Remove(objectFilePath)
+			os.Remove(filePath)
 			log.Println(err)
 			ctx.SetStatusCode(500)
 			ctx.SetConnectionClose()
-			return
+			return 0, false
 		}
 
 		// Count the total bytes received, return 413 if over limit.
 		bytesReceived += uint64(bytesRead)
 		if bytesReceived > config.AppConfig.MaxSinglePartSize {
 			file.Close()
-			os.Remove(objectFilePath)
+			os.Remove(filePath)
 			ctx.Error(fmt.Sprintf("single part cannot exceed %d bytes", config.AppConfig.MaxSinglePartSize), 413)
 			ctx.SetConnectionClose()
-			return
+			return 0, false
 		}
 
 		bufferSlice := streamBuffer[0:bytesRead]
@@ -86,11 +92,11 @@ func BucketUpload(ctx *fasthttp.RequestCtx) {
 		// Stream the bytes into the file.
 		if _, err := file.Write(bufferSlice); err != nil {
 			file.Close()
-			os.Remove(objectFilePath)
+			os.Remove(filePath)
 			log.Println(err)
 			ctx.SetStatusCode(500)
 			ctx.SetConnectionClose()
-			return
+			return 0, false
 		}
 
 		// Add the buffer bytes into the digest (returns an error but the package always returns a hardcoded nil).
@@ -102,57 +108,266 @@ func BucketUpload(ctx *fasthttp.RequestCtx) {
 		}
 	}
 
-	file.Close()
+	// The upload is acknowledged once stored, so it must not be lost past that point.
+	if err := handlers.File.SyncDiskFile(file); err != nil {
+		file.Close()
+		os.Remove(filePath)
+		log.Println("Problem while flushing received file ", err)
+		ctx.SetStatusCode(500)
+		return 0, false
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(filePath)
+		log.Println("Problem while closing received file ", err)
+		ctx.SetStatusCode(500)
+		return 0, false
+	}
+
+	return bytesReceived, true
+}
+
+// Takes over a request body which Nginx has already spooled to disk, moving it to the path and passing it through the hasher, returning its size.
+// The spooled file is passed in the 'X-SV-RP-Body-File' header, and must be within the configured Nginx upload directory.
+// If this fails, the response is modified to reflect the error and false is returned.
+func ingestSpooledBody(ctx *fasthttp.RequestCtx, filePath string, hasher *handlers.BodyHasher) (uint64, bool) {
+	spooledPath := string(ctx.Request.Header.Peek("X-SV-RP-Body-File"))
+	if spooledPath == "" {
+		ctx.Error("missing spooled request body", 400)
+		return 0, false
+	}
+
+	// The header should always be set by Nginx, but never trust it with anything outside of its own directory.
+	if !isWithinUploadDirectory(spooledPath) {
+		log.Println("Refusing spooled request body outside of the Nginx upload directory ", spooledPath)
+		ctx.Error("invalid spooled request body", 400)
+		return 0, false
+	}
+
+	// Symlinks are refused as well, as they could point anywhere.
+	if info, err := os.Lstat(spooledPath); err != nil {
+		log.Println("Problem while reading spooled request body ", err)
+		ctx.Error("invalid spooled request body", 400)
+		return 0, false
+	} else if !info.Mode().IsRegular() {
+		log.Println("Refusing spooled request body which isn't a regular file ", spooledPath)
+		ctx.Error("invalid spooled request body", 400)
+		return 0, false
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		log.Println(err)
+		ctx.SetStatusCode(500)
+		return 0, false
+	}
+
+	// The file is incomplete until it has been hashed, so it needs removing if the server is forced to exit before then.
+	handlers.Lifecycle.TrackPartialFile(filePath)
+	defer handlers.Lifecycle.UntrackPartialFile(filePath)
+
+	// Move the file rather than copying it where possible, Nginx ignores the spooled file being gone once the request is over.
+	source := spooledPath
+	if err := os.Rename(spooledPath, filePath); err == nil {
+		source = filePath
+	} else if linkError, ok := err.(*os.LinkError); !ok || linkError.Err != syscall.EXDEV {
+		log.Println("Problem while moving spooled request body ", err)
+		ctx.SetStatusCode(500)
+		return 0, false
+	}
+
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		os.Remove(filePath)
+		log.Println(err)
+		ctx.SetStatusCode(500)
+		return 0, false
+	}
+	defer sourceFile.Close()
+
+	var writer io.Writer = hasher
+
+	// Spooled on another filesystem, so the body has to be copied over while hashing it.
+	var file *os.File
+	if source == spooledPath {
+		if file, err = handlers.File.CreateDiskFile(filePath); err != nil {
+			log.Println(err)
+			ctx.SetStatusCode(500)
+			return 0, false
+		}
+		defer file.Close()
+
+		writer = io.MultiWriter(file, hasher)
+	}
+
+	size, err := io.CopyBuffer(writer, sourceFile, make([]byte, config.AppConfig.UploadStreamingChunkSize))
+	if err != nil {
+		os.Remove(filePath)
+		log.Println("Problem while hashing spooled request body ", err)
+		ctx.SetStatusCode(500)
+		return 0, false
+	}
+
+	// The upload is acknowledged once stored, so it must not be lost past that point.
+	if file == nil {
+		file = sourceFile
+	}
+
+	if err := handlers.File.SyncDiskFile(file); err != nil {
+		os.Remove(filePath)
+		log.Println("Problem while flushing received file ", err)
+		ctx.SetStatusCode(500)
+		return 0, false
+	}
 
-	digest := hasher.Sum(nil)
+	return uint64(size), true
+}
 
-	// Extract the content type header (if set by the client).
+// Determines whether the spooled file lies within the Nginx upload directory, resolving any symlinks in the directories leading to it.
+// The file itself must not be a symlink, which is checked separately.
+func isWithinUploadDirectory(spooledPath string) bool {
+	uploadDirectory, err := filepath.EvalSymlinks(config.AppConfig.NginxUploadDirectory)
+	if err != nil {
+		log.Println("Problem while resolving the Nginx upload directory ", err)
+		return false
+	}
+
+	directory, err := filepath.EvalSymlinks(filepath.Dir(spooledPath))
+	if err != nil {
+		return false
+	}
+
+	relativePath, err := filepath.Rel(uploadDirectory, filepath.Join(directory, filepath.Base(spooledPath)))
+	return err == nil && filepath.IsLocal(relativePath)
+}
+
+// Receives the request body into a newly created file at the path, either from the connection or from Nginx depending on the config.
+// The body is verified against any digests the client sent, returning the BLAKE3 digest, the checksums to store alongside the object and the size of what was received.
+// If receiving or verification fails, the file is removed, the response is modified to reflect the error and false is returned.
+func receiveBodyToFile(ctx *fasthttp.RequestCtx, filePath string) ([]byte, handlers.Checksums, uint64, bool) {
+	expected, err := handlers.Checksum.GetExpectedDigests(&ctx.Request.Header)
+	if err != nil {
+		ctx.Error("invalid digest header: "+err.Error(), 400)
+		ctx.SetConnectionClose()
+		return nil, handlers.Checksums{}, 0, false
+	}
+
+	hasher := handlers.Checksum.NewBodyHasher(expected)
+
+	var size uint64
+	var ok bool
+	if config.AppConfig.UseNginxStreaming {
+		size, ok = ingestSpooledBody(ctx, filePath, hasher)
+	} else {
+		size, ok = streamBodyToFile(ctx, filePath, hasher)
+	}
+
+	if !ok {
+		return nil, handlers.Checksums{}, 0, false
+	}
+
+	// Nothing has been stored yet, so a corrupted transfer only costs the received file.
+	checksums, err := hasher.Verify()
+	if err != nil {
+		os.Remove(filePath)
+		ctx.Error("received content does not match the expected digest", 400)
+		return nil, handlers.Checksums{}, 0, false
+	}
+
+	return hasher.Digest(), checksums, size, true
+}
+
+// Checks the preconditions of a request writing to an object against the object currently stored under the key.
+// This only saves receiving a body which would be refused anyway, the preconditions are checked again when the object is stored.
+// If the request should not proceed, false is returned and the response is modified to reflect this.
+func checkWritePreconditions(ctx *fasthttp.RequestCtx, bucket *handlers.CachedBucket, key []byte) bool {
+	preconditions := handlers.Conditional.GetPreconditions(&ctx.Request.Header)
+	if !preconditions.Any() {
+		return true
+	}
+
+	object, err := handlers.Object.GetObjectByKey(bucket, key)
+	if err != nil {
+		ctx.SetStatusCode(500)
+		return false
+	}
+
+	if handlers.Conditional.Evaluate(preconditions, object, false) != handlers.PreconditionPassed {
+		ctx.Error("precondition failed", 412)
+		return false
+	}
+
+	return true
+}
+
+// Extracts the content type header (if set by the client).
+func requestContentType(ctx *fasthttp.RequestCtx) sql.NullString {
 	derivedContentType := sql.NullString{Valid: false}
 	if contentType := ctx.Request.Header.ContentType(); contentType != nil {
 		derivedContentType.Valid = true
 		derivedContentType.String = string(contentType)
 	}
 
-	// Store the object in the database, method depending on permissions.
-	var objectCreateError error
-	if access.HasRequired(ObjectCreate) {
-		objectCreateError = handlers.Object.CreateObject(bucket, objectId, derivedContentType, digest, bytesReceived, key)
-		if objectCreateError == nil {
-			// Return 201 if a new object was created.
+	return derivedContentType
+}
+
+// Stores a fully received staged object file under the key, creating or replacing the object depending on the permissions of the context.
+// The response is modified to reflect the outcome, and the object file is removed if it ends up unused.
+func storeObject(ctx *fasthttp.RequestCtx, bucket *handlers.CachedBucket, access ObjectOperationFlags, objectId string, contentType sql.NullString, digest []byte, checksums handlers.Checksums, size uint64, key []byte) {
+	preconditions := handlers.Conditional.GetPreconditions(&ctx.Request.Header)
+	isCreated, err := handlers.Object.PutObject(bucket, objectId, contentType, digest, checksums, size, key, access.HasRequired(ObjectCreate), access.HasRequired(ObjectUpdate), preconditions)
+	if err == nil {
+		// Return 201 if a new object was created, or 200 if the object was replaced.
+		if isCreated {
 			ctx.SetStatusCode(201)
-			return
-		} else if objectCreateError != handlers.ObjectOperationConflictError {
-			os.Remove(objectFilePath)
-			ctx.SetStatusCode(500)
-			return
+		} else {
+			ctx.SetStatusCode(200)
 		}
+
+		return
 	}
 
-	// If an object cannot be created, the fallback is to overwrite the object.
-	var objectUpdateError error
-	if access.HasRequired(ObjectUpdate) {
-		objectUpdateError = handlers.Object.ReplaceObject(bucket, objectId, derivedContentType, digest, bytesReceived, key)
-		if objectUpdateError == nil {
-			// Return 200 if the object was replaced.
-			ctx.SetStatusCode(200)
-			return
-		} else if objectUpdateError != handlers.ObjectOperationConflictError {
-			os.Remove(objectFilePath)
-			ctx.SetStatusCode(500)
-			return
-		}
+	// The object is committed, so the staged file must be kept until it is moved into place on the next start.
+	if err == handlers.ObjectNotDurableError {
+		ctx.Error("object was stored but may not be durable, retry the upload", 500)
+		return
 	}
 
 	// Remove the file as we don't need it past this point.
-	os.Remove(objectFilePath)
+	os.Remove(handlers.File.GetStagingPath(objectId))
+
+	switch err {
+	case handlers.ObjectPreconditionFailedError:
+		ctx.Error("precondition failed", 412)
+	case handlers.ObjectOperationConflictError, handlers.ObjectNotFoundError:
+		// The context is only allowed to create or replace the object, but not the one the key requires.
+		middleware.GeneralPermissionDeniedAccess(ctx)
+	default:
+		ctx.SetStatusCode(500)
+	}
+}
+
+func BucketUpload(ctx *fasthttp.RequestCtx) {
+	bucket, access := authorizeObjectWrite(ctx)
+	if bucket == nil {
+		return
+	}
+
+	// Refuse the upload before receiving the body if the client's expectations of the current object don't hold.
+	if !checkWritePreconditions(ctx, bucket, ctx.Path()) {
+		ctx.SetConnectionClose()
+		return
+	}
+
+	handlers.Lifecycle.BeginTransfer()
+	defer handlers.Lifecycle.EndTransfer()
+
+	objectId := handlers.Misc.NewRandomUID()
 
-	// If both operations resulted in a conflict (which indicates a race, will be restructured in the future).
-	if objectCreateError == handlers.ObjectOperationConflictError && objectUpdateError == handlers.ObjectOperationConflictError {
-		ctx.Error("operation conflict detected", 503)
-		ctx.Response.Header.Set("Retry-After", "0")
+	// The file is received into the staging directory, so that it only appears at its final location once committed.
+	digest, checksums, bytesReceived, ok := receiveBodyToFile(ctx, handlers.File.GetStagingPath(objectId))
+	if !ok {
 		return
 	}
 
-	// Return a permission error as the operation has failed due to being unable to perform one or the other operation.
-	middleware.GeneralPermissionDeniedAccess(ctx)
+	storeObject(ctx, bucket, access, objectId, requestContentType(ctx), digest, checksums, bytesReceived, ctx.Path())
 }
@@ -0,0 +1,148 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path"
+	"speedyvault/src/config"
+	"speedyvault/src/handlers"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestUploadChecksums(t *testing.T) {
+	client := newTestClient(t)
+
+	content := []byte("checksummed upload")
+	sha256Digest := sha256.Sum256(content)
+	contentDigest := "sha-256=:" + base64.StdEncoding.EncodeToString(sha256Digest[:]) + ":"
+	wrongDigest := sha256.Sum256([]byte("something else"))
+
+	tests := []struct {
+		name    string
+		key     string
+		headers []string
+		status  int
+	}{
+		{name: "matching", key: "/checksum/matching", headers: []string{"Content-Digest", contentDigest}, status: 201},
+		{name: "mismatching", key: "/checksum/mismatching", headers: []string{"Content-Digest", "sha-256=:" + base64.StdEncoding.EncodeToString(wrongDigest[:]) + ":"}, status: 400},
+		{name: "invalid", key: "/checksum/invalid", headers: []string{"Content-Digest", "sha-256=:tooshort:"}, status: 400},
+		{name: "conflicting", key: "/checksum/conflicting", headers: []string{"Content-Digest", contentDigest, "Repr-Digest", "sha-256=:" + base64.StdEncoding.EncodeToString(wrongDigest[:]) + ":"}, status: 400},
+		{name: "unknown algorithm", key: "/checksum/unknown", headers: []string{"Content-Digest", "md5=:AAAAAAAAAAAAAAAAAAAAAA==:"}, status: 201},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := doTestRequest(t, client, fasthttp.MethodPut, test.key, content, test.headers...)
+			if response.StatusCode() != test.status {
+				t.Fatalf("upload gave status %d, want %d: %s", response.StatusCode(), test.status, response.Body())
+			}
+
+			// Refused uploads must not store anything.
+			response = doTestRequest(t, client, fasthttp.MethodGet, test.key, nil)
+			if test.status != 201 {
+				if response.StatusCode() != 404 {
+					t.Errorf("refused upload was stored, download gave status %d", response.StatusCode())
+				}
+
+				return
+			}
+
+			if response.StatusCode() != 200 || string(response.Body()) != string(content) {
+				t.Errorf("download gave status %d with body %q", response.StatusCode(), response.Body())
+			}
+		})
+	}
+
+	// The verified SHA-256 checksum is served back alongside the BLAKE3 digest.
+	response := doTestRequest(t, client, fasthttp.MethodGet, "/checksum/matching", nil)
+	if reprDigest := string(response.Header.Peek("Repr-Digest")); !strings.Contains(reprDigest, contentDigest) || !strings.HasPrefix(reprDigest, "blake3=:") {
+		t.Errorf("download gave Repr-Digest %q, want it to include %q", reprDigest, contentDigest)
+	}
+
+	// Nothing is left behind in the staging directory by the refused uploads.
+	entries, err := os.ReadDir(path.Dir(handlers.File.GetStagingPath("_")))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d files were left in the staging directory", len(entries))
+	}
+}
+
+func TestUploadNotDurable(t *testing.T) {
+	client := newTestClient(t)
+
+	bucket, err := handlers.Bucket.GetBucketByName("test-bucket")
+	if err != nil || bucket == nil {
+		t.Fatalf("fetching test bucket: %v", err)
+	}
+
+	// A dangling link in place of the objects directory stops any uploaded file from being moved into place, after the object is committed.
+	objectsDirectory := path.Dir(path.Dir(path.Dir(bucket.GetObjectPath("ab_"))))
+	if err := os.MkdirAll(objectsDirectory, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(objectsDirectory, objectsDirectory+".aside"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(objectsDirectory+".missing", objectsDirectory); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := false
+	restore := func() {
+		if restored {
+			return
+		}
+
+		restored = true
+		if err := os.Remove(objectsDirectory); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(objectsDirectory+".aside", objectsDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(restore)
+
+	content := []byte("stored but not durable")
+	if response := doTestRequest(t, client, fasthttp.MethodPut, "/durable/object", content); response.StatusCode() != 500 {
+		t.Fatalf("upload which couldn't be moved into place gave status %d, want 500", response.StatusCode())
+	}
+
+	// The committed object is served from the staging directory meanwhile.
+	response := doTestRequest(t, client, fasthttp.MethodGet, "/durable/object", nil)
+	if response.StatusCode() != 200 || string(response.Body()) != string(content) {
+		t.Fatalf("download gave status %d with body %q", response.StatusCode(), response.Body())
+	}
+
+	// The staged file is moved into place on the next start.
+	restore()
+
+	gracePeriodMs := config.AppConfig.GarbageCollectionGraceMs
+	config.AppConfig.GarbageCollectionGraceMs = 0
+	t.Cleanup(func() { config.AppConfig.GarbageCollectionGraceMs = gracePeriodMs })
+
+	time.Sleep(10 * time.Millisecond)
+	if err := handlers.Maintenance.RecoverStagedFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	object, err := handlers.Object.GetObjectByKey(bucket, []byte("/durable/object"))
+	if err != nil || object == nil {
+		t.Fatalf("fetching object: %v", err)
+	}
+	if _, err := os.Stat(object.File.GetPath()); err != nil {
+		t.Errorf("staged file was not moved into place: %v", err)
+	}
+
+	response = doTestRequest(t, client, fasthttp.MethodGet, "/durable/object", nil)
+	if response.StatusCode() != 200 || string(response.Body()) != string(content) {
+		t.Errorf("download after recovering gave status %d with body %q", response.StatusCode(), response.Body())
+	}
+}
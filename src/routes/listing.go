@@ -0,0 +1,113 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"speedyvault/src/handlers"
+	. "speedyvault/src/handlers/constants"
+	"speedyvault/src/routes/middleware"
+
+	"github.com/valyala/fasthttp"
+)
+
+// The most objects and common prefixes that can be listed in a single page.
+const maxListLimit = 1000
+
+type listedObject struct {
+	Key       string `json:"key"`
+	Size      uint64 `json:"size"`
+	ETag      string `json:"etag"`
+	CreatedMs uint64 `json:"created_ms"`
+}
+
+type listResponse struct {
+	Objects        []listedObject `json:"objects"`
+	CommonPrefixes []string       `json:"common_prefixes"`
+	Truncated      bool           `json:"truncated"`
+	NextCursor     string         `json:"next_cursor,omitempty"`
+}
+
+func BucketList(ctx *fasthttp.RequestCtx) {
+	bucket, access := middleware.AuthorizeBucketAPIRequest(ctx)
+	if bucket == nil {
+		return
+	}
+
+	if !access.HasRequired(ObjectList) {
+		middleware.GeneralPermissionDeniedAccess(ctx)
+		return
+	}
+
+	query := ctx.QueryArgs()
+	delimiter := query.Peek("delimiter")
+
+	// Keys are stored with the leading slash of the request path, which clients don't include when listing.
+	prefix := append([]byte("/"), query.Peek("prefix")...)
+
+	limit := maxListLimit
+	if rawLimit := query.Peek("limit"); len(rawLimit) != 0 {
+		parsedLimit, err := handlers.Misc.Btoui64(rawLimit)
+		if err != nil || parsedLimit == 0 || parsedLimit > maxListLimit {
+			ctx.Error("invalid limit 'limit' value", 400)
+			return
+		}
+
+		limit = int(parsedLimit)
+	}
+
+	// Resume from a previous page if a cursor was given, otherwise start after the specified key (if any).
+	var cursor handlers.ObjectListCursor
+	if after := query.Peek("after"); len(after) != 0 {
+		cursor.Key = append([]byte("/"), after...)
+	}
+	if rawCursor := query.Peek("cursor"); len(rawCursor) != 0 {
+		var err error
+		if cursor, err = handlers.Object.DecodeListCursor(rawCursor); err != nil {
+			ctx.Error("invalid cursor 'cursor' value", 400)
+			return
+		}
+	}
+
+	// Restricted objects should not be visible to anything other than API keys, not even through the common prefixes they would roll up into.
+	var visible func(key []byte) bool
+	if !access.HasRequired(ObjectAPIKeyAccess) {
+		visible = func(key []byte) bool {
+			return bucket.GetKeyAccessCondition(key) != DenyAll
+		}
+	}
+
+	listing, err := handlers.Object.ListObjects(bucket, prefix, delimiter, cursor, limit, visible)
+	if err != nil {
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	response := listResponse{
+		Objects:        make([]listedObject, 0, len(listing.Objects)),
+		CommonPrefixes: make([]string, 0, len(listing.CommonPrefixes)),
+		Truncated:      listing.NextCursor != nil,
+	}
+
+	for _, object := range listing.Objects {
+		response.Objects = append(response.Objects, listedObject{Key: string(object.Key[1:]), Size: object.Size, ETag: string(object.ETag), CreatedMs: object.CreatedMs})
+	}
+
+	for _, commonPrefix := range listing.CommonPrefixes {
+		response.CommonPrefixes = append(response.CommonPrefixes, string(commonPrefix[1:]))
+	}
+
+	if listing.NextCursor != nil {
+		response.NextCursor = listing.NextCursor.Encode()
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Println("Problem while encoding object listing ", err)
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
@@ -0,0 +1,95 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net"
+	"os"
+	"speedyvault/src/config"
+	"speedyvault/src/handlers"
+	. "speedyvault/src/handlers/constants"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// Every test runs against the debug database (in memory, with the test bucket) and a temporary data directory.
+func TestMain(m *testing.M) {
+	dataDirectory, err := os.MkdirTemp("", "speedyvault-routes-")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	config.AppConfig.DataDirectory = dataDirectory
+	config.AppConfig.DebugMode = true
+	config.AppConfig.UploadDurability = config.DurabilityNone
+	handlers.Database.InitDatabase()
+
+	code := m.Run()
+	os.RemoveAll(dataDirectory)
+	os.Exit(code)
+}
+
+// The API key inserted with the debug rows.
+var testAPIKey = base64.RawStdEncoding.EncodeToString([]byte("canttouchthiscanttouchthissomemrcanttouchthiscanttouchthissomemr"))
+
+// Serves the bucket routes over an in-memory listener, returning a client connected to it.
+func newTestClient(t *testing.T) *fasthttp.Client {
+	t.Helper()
+
+	return serveTestClient(t, &fasthttp.Server{Handler: RequestRouter, StreamRequestBody: true})
+}
+
+// Serves requests with the server over an in-memory listener until the test ends, returning a client connected to it.
+func serveTestClient(t *testing.T, server *fasthttp.Server) *fasthttp.Client {
+	t.Helper()
+
+	listener := fasthttputil.NewInmemoryListener()
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Shutdown() })
+
+	return &fasthttp.Client{Dial: func(string) (net.Conn, error) { return listener.Dial() }}
+}
+
+// Signs the key with the debug MAC secret, returning the key alongside the query granting the access for the next minute.
+func signTestKey(key string, access ObjectOperationFlags) string {
+	expiry := strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 10)
+	accessRaw := strconv.FormatUint(uint64(access), 10)
+	signature := sha256.Sum256([]byte(key + expiry + accessRaw + "supersecretobjectsecretthatis32b"))
+
+	return key + "?alg=MAC-SHA256&sel=1&exp=" + expiry + "&acc=" + accessRaw + "&sig=" + base64.RawURLEncoding.EncodeToString(signature[:])
+}
+
+// Sends a request for the key in the test bucket, alongside any headers given as name and value pairs.
+// The request is authorized with the debug API key unless the key has been signed.
+func doTestRequest(t *testing.T, client *fasthttp.Client, method string, key string, body []byte, headers ...string) *fasthttp.Response {
+	t.Helper()
+
+	request := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(request)
+
+	request.Header.SetMethod(method)
+	request.SetRequestURI("http://vault" + key)
+	request.Header.Set("X-SV-RP-Bucket", "test-bucket")
+	if !strings.Contains(key, "&sig=") {
+		request.Header.Set("X-SV-Auth-Key", testAPIKey)
+	}
+	for i := 0; i < len(headers); i += 2 {
+		request.Header.Set(headers[i], headers[i+1])
+	}
+	if body != nil {
+		request.SetBody(body)
+	}
+
+	response := &fasthttp.Response{}
+	if err := client.Do(request, response); err != nil {
+		t.Fatal(err)
+	}
+
+	return response
+}
@@ -6,6 +6,8 @@ package middleware
 import (
 	"bytes"
 	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/base64"
 	"log"
 	"speedyvault/src/config"
@@ -25,6 +27,21 @@ func GeneralPermissionDeniedAccess(ctx *fasthttp.RequestCtx) {
 	ctx.Error("permission denied (insufficient access)", 401)
 }
 
+// Authorizes a request to the admin API against the root credential.
+// If authorization fails, false will be returned and the response will be modified to reflect this.
+func AuthorizeAdminRequest(ctx *fasthttp.RequestCtx) bool {
+	// Both sides are hashed first so that the comparison takes the same time regardless of the length of the provided key.
+	providedKeyHash := sha512.Sum512(ctx.Request.Header.Peek("x-sv-admin-key"))
+	rootKeyHash := sha512.Sum512([]byte(config.AppConfig.AdminRootKey))
+
+	if subtle.ConstantTimeCompare(providedKeyHash[:], rootKeyHash[:]) != 1 {
+		ctx.Error("permission denied (invalid admin key)", 401)
+		return false
+	}
+
+	return true
+}
+
 // Fetches the destination bucket from a request.
 // If this bucket cannot be found, nil is returned and the request is modified to reflect this.
 func GetBucketFromRequest(ctx *fasthttp.RequestCtx) *handlers.CachedBucket {
@@ -43,6 +60,15 @@ func GetBucketFromRequest(ctx *fasthttp.RequestCtx) *handlers.CachedBucket {
 	}
 
 	if bucket == nil {
+		// Clients which keep asking for buckets that don't exist are likely enumerating them, so they are cut off (requests for existing buckets are never throttled).
+		clientIP := getClientIP(ctx)
+		if isMissingBucketThrottled(clientIP) {
+			ctx.Error("too many requests for unknown buckets", 429)
+			ctx.Response.Header.Set("Retry-After", "60")
+			return nil
+		}
+
+		recordMissingBucketRequest(clientIP)
 		ctx.Error("bucket not found", 404)
 		return nil
 	}
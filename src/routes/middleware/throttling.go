@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"speedyvault/src/config"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const missingBucketWindowMs = 60000
+
+// The amount of requests for missing buckets a client has made in the current window.
+type missingBucketWindow struct {
+	startMs int64
+	count   uint32
+}
+
+var missingBucketWindowsLock sync.Mutex
+var missingBucketWindows = make(map[string]*missingBucketWindow)
+
+// Identifies the client of a request, preferring the address passed on by the reverse proxy.
+func getClientIP(ctx *fasthttp.RequestCtx) string {
+	if clientIP := ctx.Request.Header.Peek("x-sv-rp-client-ip"); len(clientIP) != 0 {
+		return string(clientIP)
+	}
+
+	return ctx.RemoteIP().String()
+}
+
+// Determines whether the client has made too many requests for missing buckets and should be throttled.
+func isMissingBucketThrottled(clientIP string) bool {
+	if config.AppConfig.MissingBucketRequestsPerMinute == 0 {
+		return false
+	}
+
+	missingBucketWindowsLock.Lock()
+	defer missingBucketWindowsLock.Unlock()
+
+	window := missingBucketWindows[clientIP]
+	return window != nil && time.Now().UnixMilli()-window.startMs < missingBucketWindowMs && window.count >= config.AppConfig.MissingBucketRequestsPerMinute
+}
+
+// Records a request for a missing bucket made by the client.
+func recordMissingBucketRequest(clientIP string) {
+	if config.AppConfig.MissingBucketRequestsPerMinute == 0 {
+		return
+	}
+
+	currentMs := time.Now().UnixMilli()
+
+	missingBucketWindowsLock.Lock()
+	defer missingBucketWindowsLock.Unlock()
+
+	window := missingBucketWindows[clientIP]
+	if window == nil || currentMs-window.startMs >= missingBucketWindowMs {
+		// Clients which haven't been seen for a while are cleaned up every now and then to stop the map from growing forever.
+		if window == nil && len(missingBucketWindows) >= 4096 {
+			for ip, staleWindow := range missingBucketWindows {
+				if currentMs-staleWindow.startMs >= missingBucketWindowMs {
+					delete(missingBucketWindows, ip)
+				}
+			}
+		}
+
+		window = &missingBucketWindow{startMs: currentMs}
+		missingBucketWindows[clientIP] = window
+	}
+
+	window.count++
+}
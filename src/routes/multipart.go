@@ -0,0 +1,221 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"speedyvault/src/handlers"
+
+	"github.com/valyala/fasthttp"
+)
+
+type multipartInitiateResponse struct {
+	UploadId string `json:"upload_id"`
+}
+
+// The part list is read into memory, so its size is capped well above what any valid list needs.
+const maxMultipartCompleteBodySize = 1 << 20
+
+type multipartCompleteRequest struct {
+	Parts []handlers.MultipartCompletedPart `json:"parts"` // In ascending part number order.
+}
+
+// Fetches the multipart upload referenced by the 'uploadId' query parameter of the request.
+// If the upload cannot be found, nil is returned and the response is modified to reflect this.
+func getMultipartUploadFromRequest(ctx *fasthttp.RequestCtx, bucket *handlers.CachedBucket) *handlers.MultipartUpload {
+	upload, err := handlers.Multipart.GetUpload(bucket, ctx.QueryArgs().Peek("uploadId"), ctx.Path())
+	if err != nil {
+		ctx.SetStatusCode(500)
+		return nil
+	}
+
+	if upload == nil {
+		ctx.Error("multipart upload not found", 404)
+		return nil
+	}
+
+	return upload
+}
+
+func MultipartInitiate(ctx *fasthttp.RequestCtx) {
+	bucket, _ := authorizeObjectWrite(ctx)
+	if bucket == nil {
+		return
+	}
+
+	uploadId, err := handlers.Multipart.CreateUpload(bucket, ctx.Path(), requestContentType(ctx))
+	if err != nil {
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	body, err := json.Marshal(multipartInitiateResponse{UploadId: uploadId})
+	if err != nil {
+		log.Println("Problem while encoding multipart upload ", err)
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	ctx.SetStatusCode(201)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
+
+func MultipartUploadPart(ctx *fasthttp.RequestCtx) {
+	bucket, _ := authorizeObjectWrite(ctx)
+	if bucket == nil {
+		return
+	}
+
+	partNumber, err := handlers.Misc.Btoui64(ctx.QueryArgs().Peek("partNumber"))
+	if err != nil || partNumber == 0 || partNumber > handlers.MaxMultipartPartNumber {
+		ctx.Error("invalid part number 'partNumber' value", 400)
+		ctx.SetConnectionClose()
+		return
+	}
+
+	upload := getMultipartUploadFromRequest(ctx, bucket)
+	if upload == nil {
+		ctx.SetConnectionClose()
+		return
+	}
+
+	handlers.Lifecycle.BeginTransfer()
+	defer handlers.Lifecycle.EndTransfer()
+
+	partId := handlers.Misc.NewRandomUID()
+	partFilePath := bucket.GetPartPath(partId)
+
+	// The part's digests are verified, but there's nowhere to keep them as the completed object has digests of its own.
+	digest, _, bytesReceived, ok := receiveBodyToFile(ctx, partFilePath)
+	if !ok {
+		return
+	}
+
+	if err := handlers.File.SyncDiskFileDirectory(partFilePath); err != nil {
+		os.Remove(partFilePath)
+		log.Println("Problem while flushing multipart part directory ", err)
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	if err := handlers.Multipart.PutPart(bucket, upload, uint32(partNumber), partId, digest, bytesReceived); err != nil {
+		os.Remove(partFilePath)
+
+		switch err {
+		case handlers.MultipartUploadNotFoundError:
+			ctx.Error("multipart upload not found", 404)
+		case handlers.MultipartUploadCompletingError:
+			ctx.Error("multipart upload is being completed", 409)
+		default:
+			ctx.SetStatusCode(500)
+		}
+
+		return
+	}
+
+	ctx.Response.Header.SetBytesV("ETag", handlers.File.FormatETag(digest))
+	ctx.SetStatusCode(200)
+}
+
+func MultipartComplete(ctx *fasthttp.RequestCtx) {
+	bucket, access := authorizeObjectWrite(ctx)
+	if bucket == nil {
+		return
+	}
+
+	upload := getMultipartUploadFromRequest(ctx, bucket)
+	if upload == nil {
+		return
+	}
+
+	// The client lists the parts (with their ETags) it wants in the object.
+	var body []byte
+	if stream := ctx.Request.BodyStream(); stream != nil {
+		// Read one byte past the cap to tell whether the body goes over it.
+		var err error
+		body, err = io.ReadAll(io.LimitReader(stream, maxMultipartCompleteBodySize+1))
+		if err != nil {
+			log.Println(err)
+			ctx.SetStatusCode(500)
+			ctx.SetConnectionClose()
+			return
+		}
+
+		if len(body) > maxMultipartCompleteBodySize {
+			ctx.Error(fmt.Sprintf("part list cannot exceed %d bytes", maxMultipartCompleteBodySize), 413)
+			ctx.SetConnectionClose()
+			return
+		}
+	}
+
+	var request multipartCompleteRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		ctx.Error("invalid JSON body", 400)
+		return
+	}
+
+	if !checkWritePreconditions(ctx, bucket, upload.Key) {
+		return
+	}
+
+	// Lock the upload so no part can change while the object is being assembled.
+	parts, err := handlers.Multipart.BeginComplete(upload, request.Parts)
+	if err != nil {
+		switch err {
+		case handlers.MultipartUploadNotFoundError:
+			ctx.Error("multipart upload not found", 404)
+		case handlers.MultipartUploadCompletingError:
+			ctx.Error("multipart upload is already being completed", 409)
+		case handlers.MultipartPartListInvalidError:
+			ctx.Error("part list must be in ascending part number order and match the uploaded parts and their ETags", 400)
+		default:
+			ctx.SetStatusCode(500)
+		}
+
+		return
+	}
+
+	handlers.Lifecycle.BeginTransfer()
+	defer handlers.Lifecycle.EndTransfer()
+
+	// Join the parts into a single object file, which from here on is treated the same as a single part upload.
+	objectId := handlers.Misc.NewRandomUID()
+	digest, size, err := handlers.Multipart.ConcatenateParts(bucket, parts, objectId)
+	if err != nil {
+		handlers.Multipart.EndComplete(upload)
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	storeObject(ctx, bucket, access, objectId, upload.ContentTypeMime, digest, handlers.Checksums{}, size, upload.Key)
+
+	// The parts are no longer needed once the object has been stored, otherwise the upload is unlocked so completing can be retried.
+	if status := ctx.Response.StatusCode(); status == 200 || status == 201 {
+		handlers.Multipart.RemoveUpload(bucket, upload)
+		ctx.Response.Header.SetBytesV("ETag", handlers.File.FormatETag(digest))
+	} else {
+		handlers.Multipart.EndComplete(upload)
+	}
+}
+
+func MultipartAbort(ctx *fasthttp.RequestCtx) {
+	bucket, _ := authorizeObjectWrite(ctx)
+	if bucket == nil {
+		return
+	}
+
+	upload := getMultipartUploadFromRequest(ctx, bucket)
+	if upload == nil {
+		return
+	}
+
+	if err := handlers.Multipart.RemoveUpload(bucket, upload); err != nil {
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	ctx.SetStatusCode(204)
+}
@@ -0,0 +1,53 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"speedyvault/src/handlers"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestMultipartCompleteBodyLimit(t *testing.T) {
+	client := newTestClient(t)
+
+	response := doTestRequest(t, client, fasthttp.MethodPost, "/multipart/limited?uploads", nil)
+	if response.StatusCode() != 201 {
+		t.Fatalf("initiating gave status %d", response.StatusCode())
+	}
+
+	var initiated multipartInitiateResponse
+	if err := json.Unmarshal(response.Body(), &initiated); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadKey := "/multipart/limited?uploadId=" + initiated.UploadId
+	response = doTestRequest(t, client, fasthttp.MethodPut, uploadKey+"&partNumber=1", []byte("multipart content"))
+	if response.StatusCode() != 200 {
+		t.Fatalf("uploading part gave status %d", response.StatusCode())
+	}
+
+	partList, err := json.Marshal(multipartCompleteRequest{Parts: []handlers.MultipartCompletedPart{{PartNumber: 1, ETag: string(response.Header.Peek("ETag"))}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A valid part list padded out past the cap is refused without being parsed, leaving the upload in place.
+	padded := append(partList, bytes.Repeat([]byte(" "), maxMultipartCompleteBodySize)...)
+	if response := doTestRequest(t, client, fasthttp.MethodPost, uploadKey, padded); response.StatusCode() != 413 {
+		t.Fatalf("completing with an oversized body gave status %d, want 413", response.StatusCode())
+	}
+
+	if response := doTestRequest(t, client, fasthttp.MethodPost, uploadKey, []byte("{")); response.StatusCode() != 400 {
+		t.Errorf("completing with invalid JSON gave status %d, want 400", response.StatusCode())
+	}
+
+	if response := doTestRequest(t, client, fasthttp.MethodPost, uploadKey, partList); response.StatusCode() != 201 {
+		t.Fatalf("completing gave status %d, want 201: %s", response.StatusCode(), response.Body())
+	}
+
+	if response := doTestRequest(t, client, fasthttp.MethodGet, "/multipart/limited", nil); response.StatusCode() != 200 || string(response.Body()) != "multipart content" {
+		t.Errorf("download gave status %d with body %q", response.StatusCode(), response.Body())
+	}
+}
@@ -0,0 +1,142 @@
+package routes
+
+import (
+	"os"
+	"path/filepath"
+	"speedyvault/src/config"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Stands in for Nginx in front of the backend, spooling request bodies to files and passing on only their paths.
+type stubProxy struct {
+	client          *fasthttp.Client
+	uploadDirectory string
+}
+
+// Serves the routes with Nginx streaming enabled, returning the proxy in front of them.
+func newStubProxy(t *testing.T) *stubProxy {
+	t.Helper()
+
+	uploadDirectory := t.TempDir()
+	previousConfig := config.AppConfig
+	config.AppConfig.UseNginxStreaming = true
+	config.AppConfig.NginxUploadDirectory = uploadDirectory
+	t.Cleanup(func() { config.AppConfig = previousConfig })
+
+	return &stubProxy{client: newTestClient(t), uploadDirectory: uploadDirectory}
+}
+
+// Sends a request the way Nginx passes it on, with the spooled body file (if any) in place of the body.
+func (proxy *stubProxy) do(t *testing.T, method string, key string, bodyFile string, headers ...string) *fasthttp.Response {
+	t.Helper()
+
+	if bodyFile != "" {
+		headers = append(headers, "X-SV-RP-Body-File", bodyFile)
+	}
+
+	return doTestRequest(t, proxy.client, method, key, nil, headers...)
+}
+
+// Spools the content into a new file within the upload directory, as Nginx does with request bodies.
+func (proxy *stubProxy) spool(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	spooledPath := filepath.Join(proxy.uploadDirectory, name)
+	if err := os.WriteFile(spooledPath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return spooledPath
+}
+
+func TestNginxStreaming(t *testing.T) {
+	proxy := newStubProxy(t)
+
+	spooledPath := proxy.spool(t, "0000000001", "spooled content")
+	if response := proxy.do(t, fasthttp.MethodPut, "/nginx/object", spooledPath); response.StatusCode() != 201 {
+		t.Fatalf("upload gave status %d: %s", response.StatusCode(), response.Body())
+	}
+
+	if _, err := os.Stat(spooledPath); !os.IsNotExist(err) {
+		t.Errorf("spooled file was not moved: %v", err)
+	}
+
+	// The body is left to Nginx, which serves the file from the internal location mapping onto the data directory.
+	response := proxy.do(t, fasthttp.MethodGet, "/nginx/object", "")
+	if response.StatusCode() != 200 || len(response.Body()) != 0 {
+		t.Fatalf("download gave status %d with a %d byte body", response.StatusCode(), len(response.Body()))
+	}
+
+	redirect := string(response.Header.Peek("X-Accel-Redirect"))
+	relativePath, found := strings.CutPrefix(redirect, config.AppConfig.NginxInternalLocation)
+	if !found {
+		t.Fatalf("download redirected to %q, outside of the internal location", redirect)
+	}
+
+	content, err := os.ReadFile(filepath.Join(config.AppConfig.DataDirectory, filepath.FromSlash(relativePath)))
+	if err != nil || string(content) != "spooled content" {
+		t.Errorf("redirected to a file holding %q (%v)", content, err)
+	}
+
+	for _, header := range []string{"ETag", "Last-Modified", "Cache-Control", "Repr-Digest"} {
+		if len(response.Header.Peek(header)) == 0 {
+			t.Errorf("download is missing the %s header", header)
+		}
+	}
+
+	// Nginx applies the range itself, so the backend must not.
+	response = proxy.do(t, fasthttp.MethodGet, "/nginx/object", "", "Range", "bytes=0-3")
+	if response.StatusCode() != 200 || len(response.Header.Peek("X-Accel-Redirect")) == 0 || len(response.Header.Peek("Content-Range")) != 0 {
+		t.Errorf("ranged download gave status %d with Content-Range %q", response.StatusCode(), response.Header.Peek("Content-Range"))
+	}
+
+	// Conditional requests are still answered by the backend.
+	response = proxy.do(t, fasthttp.MethodGet, "/nginx/object", "", "If-None-Match", string(response.Header.Peek("ETag")))
+	if response.StatusCode() != 304 || len(response.Header.Peek("X-Accel-Redirect")) != 0 {
+		t.Errorf("conditional download gave status %d, want 304 without a redirect", response.StatusCode())
+	}
+}
+
+func TestNginxStreamingRejectsBodyFiles(t *testing.T) {
+	proxy := newStubProxy(t)
+
+	outsideDirectory := t.TempDir()
+	outsidePath := filepath.Join(outsideDirectory, "outside")
+	if err := os.WriteFile(outsidePath, []byte("outside"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(outsidePath, filepath.Join(proxy.uploadDirectory, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outsideDirectory, filepath.Join(proxy.uploadDirectory, "linked-directory")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		bodyFile string
+	}{
+		{name: "missing", bodyFile: ""},
+		{name: "outside", bodyFile: outsidePath},
+		{name: "escape", bodyFile: proxy.uploadDirectory + "/../" + filepath.Base(outsideDirectory) + "/outside"},
+		{name: "symlink", bodyFile: filepath.Join(proxy.uploadDirectory, "link")},
+		{name: "symlinked directory", bodyFile: filepath.Join(proxy.uploadDirectory, "linked-directory", "outside")},
+		{name: "directory", bodyFile: proxy.uploadDirectory},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if response := proxy.do(t, fasthttp.MethodPut, "/nginx/rejected", test.bodyFile); response.StatusCode() != 400 {
+				t.Errorf("upload gave status %d, want 400", response.StatusCode())
+			}
+		})
+	}
+
+	if content, err := os.ReadFile(outsidePath); err != nil || string(content) != "outside" {
+		t.Errorf("file outside the upload directory was touched: %q (%v)", content, err)
+	}
+}
@@ -0,0 +1,44 @@
+package routes
+
+import (
+	"speedyvault/src/handlers"
+	. "speedyvault/src/handlers/constants"
+	"speedyvault/src/routes/middleware"
+
+	"github.com/valyala/fasthttp"
+)
+
+func ObjectRemove(ctx *fasthttp.RequestCtx) {
+	bucket, access := middleware.AuthorizeBucketAPIRequest(ctx)
+	if bucket == nil {
+		return
+	}
+
+	if !access.HasRequired(ObjectDelete) {
+		middleware.GeneralPermissionDeniedAccess(ctx)
+		return
+	}
+
+	key := ctx.Path()
+
+	// Check for any access constraints to this key, and handle request accordingly.
+	if condition := bucket.GetKeyAccessCondition(key); condition == DenyAll {
+		// Only API keys can bypass 'DenyAll'.
+		if !access.HasRequired(ObjectAPIKeyAccess) {
+			ctx.Error("permission denied (resource is restricted)", 403)
+			return
+		}
+	}
+
+	if err := handlers.Object.DeleteObject(bucket, key); err != nil {
+		if err == handlers.ObjectNotFoundError {
+			ctx.Error("object not found", 404)
+			return
+		}
+
+		ctx.SetStatusCode(500)
+		return
+	}
+
+	ctx.SetStatusCode(204)
+}
@@ -0,0 +1,124 @@
+package routes
+
+import (
+	"os"
+	"speedyvault/src/handlers"
+	. "speedyvault/src/handlers/constants"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Returns the reference count of the file the object is currently stored in, alongside its location on disk.
+func getTestObjectFile(t *testing.T, key string) (uint64, string) {
+	t.Helper()
+
+	bucket, err := handlers.Bucket.GetBucketByName("test-bucket")
+	if err != nil || bucket == nil {
+		t.Fatalf("fetching test bucket: %v", err)
+	}
+
+	object, err := handlers.Object.GetObjectByKey(bucket, []byte(key))
+	if err != nil || object == nil {
+		t.Fatalf("fetching object %s: %v", key, err)
+	}
+
+	var refCount uint64
+	if err := handlers.DB.QueryRow("SELECT ref_count FROM files WHERE uid = ?", object.File.UID).Scan(&refCount); err != nil {
+		t.Fatal(err)
+	}
+
+	return refCount, object.File.GetPath()
+}
+
+func TestObjectRemove(t *testing.T) {
+	client := newTestClient(t)
+
+	// Identical content is deduplicated, so both objects share a single file.
+	for _, key := range []string{"/remove/a", "/remove/b"} {
+		if response := doTestRequest(t, client, fasthttp.MethodPut, key, []byte("removed content")); response.StatusCode() != 201 {
+			t.Fatalf("upload of %s gave status %d", key, response.StatusCode())
+		}
+	}
+
+	refCount, filePath := getTestObjectFile(t, "/remove/a")
+	if refCount != 2 {
+		t.Fatalf("shared file has reference count %d, want 2", refCount)
+	}
+
+	if response := doTestRequest(t, client, fasthttp.MethodDelete, "/remove/a", nil); response.StatusCode() != 204 {
+		t.Fatalf("delete gave status %d, want 204", response.StatusCode())
+	}
+	if response := doTestRequest(t, client, fasthttp.MethodGet, "/remove/a", nil); response.StatusCode() != 404 {
+		t.Errorf("download after delete gave status %d, want 404", response.StatusCode())
+	}
+	if response := doTestRequest(t, client, fasthttp.MethodDelete, "/remove/a", nil); response.StatusCode() != 404 {
+		t.Errorf("deleting again gave status %d, want 404", response.StatusCode())
+	}
+
+	// The file is still used by the other object.
+	if refCount, _ := getTestObjectFile(t, "/remove/b"); refCount != 1 {
+		t.Errorf("shared file has reference count %d after a delete, want 1", refCount)
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		t.Errorf("file still in use was removed: %v", err)
+	}
+
+	// Removing the last reference removes the file as well.
+	if response := doTestRequest(t, client, fasthttp.MethodDelete, "/remove/b", nil); response.StatusCode() != 204 {
+		t.Fatalf("delete gave status %d, want 204", response.StatusCode())
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Errorf("unreferenced file was not removed: %v", err)
+	}
+
+	var fileRows int
+	if err := handlers.DB.QueryRow("SELECT COUNT(*) FROM files WHERE ref_count = 0").Scan(&fileRows); err != nil || fileRows != 0 {
+		t.Errorf("%d unreferenced file rows left behind (%v)", fileRows, err)
+	}
+}
+
+func TestObjectRemovePermissions(t *testing.T) {
+	client := newTestClient(t)
+
+	rule, err := handlers.Admin.CreateAccessRule("test-bucket", handlers.AdminAccessRule{Regex: "^/restricted/", Action: DenyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { handlers.Admin.DeleteAccessRule("test-bucket", rule.Id) })
+
+	for _, key := range []string{"/restricted/object", "/unrestricted/object"} {
+		if response := doTestRequest(t, client, fasthttp.MethodPut, key, []byte(key)); response.StatusCode() != 201 {
+			t.Fatalf("upload of %s gave status %d", key, response.StatusCode())
+		}
+	}
+
+	tests := []struct {
+		name   string
+		key    string
+		status int
+	}{
+		{name: "restricted key", key: signTestKey("/restricted/object", ObjectDelete), status: 403},
+		{name: "without delete access", key: signTestKey("/unrestricted/object", ObjectRead|ObjectUpdate), status: 401},
+		{name: "expired signature", key: "/unrestricted/object?alg=MAC-SHA256&sel=1&exp=0&acc=4&sig=", status: 401},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if response := doTestRequest(t, client, fasthttp.MethodDelete, test.key, nil); response.StatusCode() != test.status {
+				t.Errorf("delete gave status %d, want %d", response.StatusCode(), test.status)
+			}
+		})
+	}
+
+	// Refused deletes leave the objects in place, while a signed delete of an unrestricted key goes through.
+	for _, key := range []string{"/restricted/object", "/unrestricted/object"} {
+		if response := doTestRequest(t, client, fasthttp.MethodGet, key, nil); response.StatusCode() != 200 {
+			t.Errorf("download of %s gave status %d after refused deletes", key, response.StatusCode())
+		}
+	}
+
+	if response := doTestRequest(t, client, fasthttp.MethodDelete, signTestKey("/unrestricted/object", ObjectDelete), nil); response.StatusCode() != 204 {
+		t.Errorf("signed delete gave status %d, want 204", response.StatusCode())
+	}
+}
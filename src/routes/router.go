@@ -0,0 +1,50 @@
+package routes
+
+import (
+	"github.com/valyala/fasthttp"
+)
+
+// Routes requests to the correct handler.
+func RequestRouter(ctx *fasthttp.RequestCtx) {
+	if ctx.IsPut() {
+		if ctx.QueryArgs().Has("uploadId") {
+			MultipartUploadPart(ctx)
+			return
+		}
+
+		BucketUpload(ctx)
+	} else if ctx.IsPost() {
+		if ctx.QueryArgs().Has("uploads") {
+			MultipartInitiate(ctx)
+		} else if ctx.QueryArgs().Has("uploadId") {
+			MultipartComplete(ctx)
+		} else {
+			ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+		}
+	} else if ctx.IsGet() {
+		if len(ctx.Request.Header.Peek("content-length")) != 0 {
+			ctx.Error("body not allowed in GET requests", 400)
+			ctx.SetConnectionClose()
+			return
+		}
+
+		// Listing is done on the bucket root rather than on an object key.
+		if string(ctx.Path()) == "/" && ctx.QueryArgs().Has("list") {
+			BucketList(ctx)
+			return
+		}
+
+		ObjectDownload(ctx)
+	} else if ctx.IsHead() {
+		ObjectHead(ctx)
+	} else if ctx.IsDelete() {
+		if ctx.QueryArgs().Has("uploadId") {
+			MultipartAbort(ctx)
+			return
+		}
+
+		ObjectRemove(ctx)
+	} else {
+		ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+	}
+}
@@ -2,6 +2,15 @@
 
 package system
 
-func OpenFile() {
+import "os"
 
+// Flushes the entries of the directory to disk, so that files created, renamed or removed within it survive a power loss.
+func SyncDirectory(directory string) error {
+	dir, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
 }
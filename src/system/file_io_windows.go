@@ -1,3 +1,8 @@
 //go:build windows
 
 package system
+
+// Directories can't be opened for flushing on Windows, where NTFS journals changes to directory entries by itself.
+func SyncDirectory(directory string) error {
+	return nil
+}
@@ -0,0 +1,5 @@
+package system
+
+import "errors"
+
+var ErrSendFileUnsupported = errors.New("sendfile is not supported for this file or connection")
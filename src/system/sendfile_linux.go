@@ -0,0 +1,64 @@
+//go:build linux
+
+package system
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// The most bytes to hand to a single sendfile call, as the kernel caps a single call at just under 2GB regardless.
+const maxSendFileChunk = 1 << 30
+
+// Sends length bytes of the file starting at offset to the connection without copying them through userspace.
+// Returns the amount of bytes sent, which is always length unless an error is returned.
+// Returns ErrSendFileUnsupported (with nothing sent) if the file or connection can't be used with sendfile, in which case the caller should fall back to copying.
+func SendFile(conn *net.TCPConn, file *os.File, offset int64, length int64) (int64, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	// Fd() puts the file back into blocking mode, which is fine for regular files as they are never polled.
+	fileFd := int(file.Fd())
+
+	var written int64 = 0
+	var sendErr error
+	err = rawConn.Write(func(connFd uintptr) bool {
+		for written < length {
+			n, err := syscall.Sendfile(int(connFd), fileFd, &offset, int(min(length-written, maxSendFileChunk)))
+			if n > 0 {
+				written += int64(n)
+			}
+
+			switch {
+			case err == syscall.EINTR:
+				continue
+			case err == syscall.EAGAIN:
+				// The socket buffer is full, wait for the connection to become writable again.
+				return false
+			case err != nil:
+				if written == 0 && (err == syscall.EINVAL || err == syscall.ENOSYS || err == syscall.EOPNOTSUPP) {
+					sendErr = ErrSendFileUnsupported
+				} else {
+					sendErr = os.NewSyscallError("sendfile", err)
+				}
+
+				return true
+			case n == 0:
+				// The file is shorter than expected, which means it was truncated underneath us.
+				sendErr = io.ErrUnexpectedEOF
+				return true
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return written, err
+	}
+
+	return written, sendErr
+}
@@ -0,0 +1,223 @@
+//go:build linux
+
+package system
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+// Connects to a loopback listener, returning the sending side and a channel which receives everything read on the other side once it's closed.
+func newLoopbackConn(tb testing.TB) (*net.TCPConn, <-chan []byte) {
+	tb.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+
+		content, _ := io.ReadAll(conn)
+		received <- content
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+
+	return conn.(*net.TCPConn), received
+}
+
+// Like newLoopbackConn, but throws away everything read rather than collecting it.
+func newDiscardingLoopbackConn(tb testing.TB) *net.TCPConn {
+	tb.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		io.Copy(io.Discard, conn)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+
+	return conn.(*net.TCPConn)
+}
+
+// Writes random content of the given size to a temporary file, returning the opened file alongside its content.
+func newTestFile(tb testing.TB, size int) (*os.File, []byte) {
+	tb.Helper()
+
+	content := make([]byte, size)
+	rand.Read(content)
+
+	filePath := path.Join(tb.TempDir(), "file")
+	if err := os.WriteFile(filePath, content, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { file.Close() })
+
+	return file, content
+}
+
+func TestSendFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int64
+		length int64
+	}{
+		{name: "full", offset: 0, length: 4 << 20},
+		{name: "range", offset: 12345, length: 1 << 20},
+		{name: "tail", offset: 4<<20 - 100, length: 100},
+		{name: "empty", offset: 0, length: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, content := newTestFile(t, 4<<20)
+			conn, received := newLoopbackConn(t)
+
+			written, err := SendFile(conn, file, test.offset, test.length)
+			if err != nil || written != test.length {
+				t.Fatalf("sent %d bytes with error %v, want %d", written, err, test.length)
+			}
+
+			conn.Close()
+			if !bytes.Equal(<-received, content[test.offset:test.offset+test.length]) {
+				t.Error("received content doesn't match the range of the file")
+			}
+		})
+	}
+}
+
+func TestSendFileTruncated(t *testing.T) {
+	file, _ := newTestFile(t, 1<<20)
+	conn, _ := newLoopbackConn(t)
+
+	if _, err := SendFile(conn, file, 0, 1<<19); err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncated between chunks, as happens when the file is overwritten in place during a download.
+	if err := os.Truncate(file.Name(), 1<<19+100); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := SendFile(conn, file, 1<<19, 1<<19)
+	if err != io.ErrUnexpectedEOF || written != 100 {
+		t.Errorf("sent %d bytes with error %v, want 100 and io.ErrUnexpectedEOF", written, err)
+	}
+}
+
+func TestSendFileUnsupported(t *testing.T) {
+	// Directories can't be sent from, unlike regular files.
+	directory, err := os.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer directory.Close()
+
+	conn, _ := newLoopbackConn(t)
+
+	written, err := SendFile(conn, directory, 0, 7)
+	if err != ErrSendFileUnsupported || written != 0 {
+		t.Errorf("sent %d bytes with error %v, want nothing and ErrSendFileUnsupported", written, err)
+	}
+}
+
+// Compares sending a file with sendfile against copying it through a buffer, the way downloads fall back to.
+func BenchmarkSendFile(b *testing.B) {
+	const fileSize = 64 << 20
+	const chunkSize = 2 << 20
+
+	transfers := []struct {
+		name   string
+		offset int64
+		length int64
+	}{
+		{name: "full", offset: 0, length: fileSize},
+		{name: "range", offset: 12345, length: 4 << 20},
+	}
+
+	file, _ := newTestFile(b, fileSize)
+
+	for _, transfer := range transfers {
+		b.Run(transfer.name+"/sendfile", func(b *testing.B) {
+			conn := newDiscardingLoopbackConn(b)
+			b.SetBytes(transfer.length)
+
+			for b.Loop() {
+				for written := int64(0); written != transfer.length; {
+					n, err := SendFile(conn, file, transfer.offset+written, min(chunkSize, transfer.length-written))
+					if err != nil {
+						b.Fatal(err)
+					}
+
+					written += n
+				}
+			}
+		})
+
+		b.Run(transfer.name+"/buffered", func(b *testing.B) {
+			conn := newDiscardingLoopbackConn(b)
+			writer := bufio.NewWriter(conn)
+			buffer := make([]byte, chunkSize)
+			b.SetBytes(transfer.length)
+
+			for b.Loop() {
+				for written := int64(0); written != transfer.length; {
+					chunk := buffer[:min(chunkSize, transfer.length-written)]
+					n, err := file.ReadAt(chunk, transfer.offset+written)
+					if err != nil && err != io.EOF {
+						b.Fatal(err)
+					}
+
+					if _, err := writer.Write(chunk[:n]); err != nil {
+						b.Fatal(err)
+					}
+
+					written += int64(n)
+				}
+
+				if err := writer.Flush(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package system
+
+import (
+	"net"
+	"os"
+)
+
+// Only implemented on Linux, callers are expected to fall back to copying through a buffer.
+func SendFile(conn *net.TCPConn, file *os.File, offset int64, length int64) (int64, error) {
+	return 0, ErrSendFileUnsupported
+}